@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// fragmentDuration is the least playback time of a fragment, fragments
+	// start at the sync samples of the video.
+	fragmentDuration = 2 * time.Second
+	// livePace is how fast /fmp4/live sends fragments, relative to their
+	// playback time, 0 sends them as fast as it can.
+	livePace = 1.0
+)
+
+// fmp4 is the video of a segmentSource repackaged as fragmented MP4: an
+// init segment, ftyp and a moov without samples, then a moof and mdat per
+// fragment. The bytes of the samples stay in the source, parts maps the
+// file onto them. A source still being written, its moov first, has the
+// fragments of the samples written so far.
+type fmp4 struct {
+	init      []byte
+	fragments []fragment
+	parts     []part
+	size      int64
+	complete  bool // all the samples of moov are in fragments
+}
+
+// fragment is a moof and its mdat.
+type fragment struct {
+	Seq      uint32  `json:"seq"`
+	Time     float64 `json:"time"`     // seconds
+	Duration float64 `json:"duration"` // seconds
+	Offset   int64   `json:"offset"`   // in the fMP4 file
+	Size     int64   `json:"size"`
+}
+
+// part is a piece of the fMP4 file, bytes of its own or of the source.
+type part struct {
+	offset int64 // in the fMP4 file
+	data   []byte
+	from   int64 // in the source, if data is nil
+	size   int64
+}
+
+// fragmentMP4 repackages the MP4 file in the size bytes of r.
+func fragmentMP4(r io.ReaderAt, size int64) (*fmp4, error) {
+	rs := io.NewSectionReader(r, 0, size)
+	tracks, err := readMP4Tracks(rs, size)
+	if err != nil {
+		return nil, err
+	}
+	moovBox, err := findPath(rs, size, "moov")
+	if err != nil {
+		return nil, err
+	}
+	moov := make([]byte, moovBox.size)
+	if _, err := r.ReadAt(moov, moovBox.offset); err != nil {
+		return nil, err
+	}
+	init, err := initMoov(moov, tracks)
+	if err != nil {
+		return nil, err
+	}
+	init = append(mp4Box("ftyp", []byte("iso5\x00\x00\x02\x00iso5iso6mp41isom")), init...)
+
+	f := &fmp4{init: init}
+	f.add(part{data: init})
+	cuts := fragmentCuts(tracks)
+	next := make([]int, len(tracks)) // the first sample of each track not in a fragment yet
+	for k, t0 := range cuts {
+		t1 := time.Duration(1<<63 - 1)
+		if k+1 < len(cuts) {
+			t1 = cuts[k+1]
+		}
+		fr := fragment{Seq: uint32(len(f.fragments) + 1), Time: t0.Seconds(), Offset: f.size}
+		var moof []byte
+		var dataOffsets []int // of the truns in moof
+		var samples [][]mp4Sample
+		for i, t := range tracks {
+			first := next[i]
+			for next[i] < len(t.samples) && sampleTime(t, t.samples[next[i]].time) < t1 {
+				next[i]++
+			}
+			if first == next[i] {
+				continue
+			}
+			traf, at := trackFragment(t, first, next[i])
+			dataOffsets = append(dataOffsets, len(moof)+at)
+			moof = append(moof, traf...)
+			samples = append(samples, t.samples[first:next[i]])
+			fr.Duration = max(fr.Duration, (min(sampleTime(t, t.duration), t1) - t0).Seconds())
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		if !within(samples, size) {
+			// not written yet
+			return f, nil
+		}
+		mfhd := fullBox("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, fr.Seq))
+		moofSize := 8 + len(mfhd) + len(moof)
+		moof = mp4Box("moof", append(mfhd, moof...))
+		// sample data is relative to the start of moof, after the mdat header
+		dataOffset := int64(moofSize + 8)
+		var mdat []part
+		var mdatSize int64
+		for i, ss := range samples {
+			binary.BigEndian.PutUint32(moof[8+len(mfhd)+dataOffsets[i]:], uint32(dataOffset+mdatSize))
+			for _, s := range ss {
+				if n := len(mdat); n > 0 && mdat[n-1].from+mdat[n-1].size == s.offset {
+					mdat[n-1].size += int64(s.size)
+				} else {
+					mdat = append(mdat, part{from: s.offset, size: int64(s.size)})
+				}
+				mdatSize += int64(s.size)
+			}
+		}
+		if mdatSize+8 > 1<<32-1 {
+			return nil, fmt.Errorf("mp4: fragment %d of %d bytes is too large", fr.Seq, mdatSize)
+		}
+		f.add(part{data: moof})
+		f.add(part{data: binary.BigEndian.AppendUint32(nil, uint32(mdatSize+8))})
+		f.add(part{data: []byte("mdat")})
+		for _, p := range mdat {
+			f.add(p)
+		}
+		fr.Size = f.size - fr.Offset
+		f.fragments = append(f.fragments, fr)
+	}
+	f.complete = true
+	return f, nil
+}
+
+// within reports whether the bytes of samples are in the first size bytes.
+func within(samples [][]mp4Sample, size int64) bool {
+	for _, ss := range samples {
+		for _, s := range ss {
+			if s.offset+int64(s.size) > size {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *fmp4) add(p part) {
+	p.offset = f.size
+	if p.data != nil {
+		p.size = int64(len(p.data))
+	}
+	f.parts = append(f.parts, p)
+	f.size += p.size
+}
+
+func sampleTime(t mp4Track, ts uint64) time.Duration {
+	return time.Duration(float64(ts) / float64(t.timescale) * float64(time.Second))
+}
+
+// fragmentCuts are the start times of the fragments: the sync samples of
+// the first video track at least fragmentDuration apart, or of the first
+// track without video.
+func fragmentCuts(tracks []mp4Track) []time.Duration {
+	main := tracks[0]
+	for _, t := range tracks {
+		if t.handler == "vide" {
+			main = t
+			break
+		}
+	}
+	cuts := []time.Duration{0}
+	for _, s := range main.samples {
+		if t := sampleTime(main, s.time); s.sync && t >= cuts[len(cuts)-1]+fragmentDuration {
+			cuts = append(cuts, t)
+		}
+	}
+	return cuts
+}
+
+// trackFragment is the traf of samples [first, last) of t, and where the
+// data offset of its trun is, to be set when the moof is complete.
+func trackFragment(t mp4Track, first, last int) ([]byte, int) {
+	// default-base-is-moof
+	tfhd := fullBox("tfhd", 0, 0x020000, binary.BigEndian.AppendUint32(nil, t.id))
+	tfdt := fullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, t.samples[first].time))
+	// data offset, then duration, size, flags and composition offset per sample
+	body := binary.BigEndian.AppendUint32(nil, uint32(last-first))
+	body = binary.BigEndian.AppendUint32(body, 0)
+	for i := first; i < last; i++ {
+		s := t.samples[i]
+		end := t.duration
+		if i+1 < len(t.samples) {
+			end = t.samples[i+1].time
+		}
+		flags := uint32(0x01010000) // depends on others, not a sync sample
+		if s.sync {
+			flags = 0x02000000 // depends on no other
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(end-s.time))
+		body = binary.BigEndian.AppendUint32(body, s.size)
+		body = binary.BigEndian.AppendUint32(body, flags)
+		body = binary.BigEndian.AppendUint32(body, uint32(s.cto))
+	}
+	trun := fullBox("trun", 1, 0x000f01, body)
+	traf := mp4Box("traf", bytes.Join([][]byte{tfhd, tfdt, trun}, nil))
+	// traf header, tfhd, tfdt, trun header, sample count
+	return traf, 8 + len(tfhd) + len(tfdt) + 12 + 4
+}
+
+// initMoov is moov without samples and with an mvex, for fragments.
+func initMoov(moov []byte, tracks []mp4Track) ([]byte, error) {
+	b, err := readBoxHeader(bytes.NewReader(moov), 0, int64(len(moov)))
+	if err != nil {
+		return nil, err
+	}
+	moov = moov[b.headerLen:]
+	body, err := emptySampleTables(moov)
+	if err != nil {
+		return nil, err
+	}
+	var mvex []byte
+	for _, t := range tracks {
+		// track, sample description 1, no defaults
+		trex := binary.BigEndian.AppendUint32(nil, t.id)
+		trex = append(trex, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+		mvex = append(mvex, fullBox("trex", 0, 0, trex)...)
+	}
+	return mp4Box("moov", append(body, mp4Box("mvex", mvex)...)), nil
+}
+
+// emptySampleTables rewrites the boxes in body down to the sample tables, which are emptied. Sample groups and dependencies are
+// left out, fragments don't have them.
+func emptySampleTables(body []byte) ([]byte, error) {
+	var out []byte
+	for len(body) > 0 {
+		b, err := readBoxHeader(bytes.NewReader(body), 0, int64(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		box := body[:b.size]
+		body = body[b.size:]
+		switch b.typ {
+		case "trak", "mdia", "minf", "stbl":
+			child, err := emptySampleTables(box[b.headerLen:])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, mp4Box(b.typ, child)...)
+		case "stts", "stsc", "stco", "co64":
+			if b.typ == "co64" {
+				b.typ = "stco"
+			}
+			out = append(out, fullBox(b.typ, 0, 0, make([]byte, 4))...)
+		case "stsz":
+			out = append(out, fullBox(b.typ, 0, 0, make([]byte, 8))...)
+		case "stss", "ctts", "sdtp", "sgpd", "sbgp", "stps", "cslg":
+		case "mvex":
+		default:
+			out = append(out, box...)
+		}
+	}
+	return out, nil
+}
+
+func mp4Box(typ string, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 8+len(body)), uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func fullBox(typ string, version byte, flags uint32, body []byte) []byte {
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return mp4Box(typ, append(hdr, body...))
+}
+
+// fmp4File reads the fMP4 file, the bytes of the samples from src.
+type fmp4File struct {
+	*fmp4
+	src io.ReaderAt
+}
+
+func (f fmp4File) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	i := sort.Search(len(f.parts), func(i int) bool { return f.parts[i].offset+f.parts[i].size > off })
+	for ; n < len(p) && i < len(f.parts); i++ {
+		pt := f.parts[i]
+		at := off + int64(n) - pt.offset
+		want := p[n : n+int(min(int64(len(p)-n), pt.size-at))]
+		if pt.data != nil {
+			n += copy(want, pt.data[at:])
+			continue
+		}
+		m, err := f.src.ReadAt(want, pt.from+at)
+		n += m
+		if err != nil && !(errors.Is(err, io.EOF) && m == len(want)) {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fmp4Cache keeps the repackaging of the source as it was last seen.
+var fmp4Cache struct {
+	sync.Mutex
+	key string
+	f   *fmp4
+}
+
+// openFMP4 repackages version of source, see versionSegments, or takes it
+// from fmp4Cache if its segments didn't change.
+func openFMP4(version int) (fmp4File, *stream, error) {
+	segs, err := versionSegments(version)
+	if err != nil {
+		return fmp4File{}, nil, err
+	}
+	st := newStream(segs)
+	key := fmt.Sprint(segs)
+	fmp4Cache.Lock()
+	defer fmp4Cache.Unlock()
+	if fmp4Cache.key != key {
+		start := time.Now()
+		f, err := fragmentMP4(st, st.size())
+		if err != nil {
+			st.Close()
+			return fmp4File{}, nil, err
+		}
+		fmt.Printf("fmp4: %d fragments of %d bytes, repackaged in %s\n", len(f.fragments), f.size, time.Since(start))
+		fmp4Cache.key, fmp4Cache.f = key, f
+	}
+	return fmp4File{fmp4: fmp4Cache.f, src: st}, st, nil
+}
+
+// serveFMP4 serves the video repackaged as fMP4:
+//   - /fmp4/live streams the init segment, then the fragments as their
+//     playback time comes, and those of the media added to the source
+//     meanwhile, with chunked transfer encoding
+//   - /fmp4/video.mp4 is the whole fMP4 file, by range
+//   - /fmp4/index.json is where the init segment and each fragment are in
+//     it, to seek by range
+func serveFMP4(w http.ResponseWriter, r *http.Request) {
+	f, st, err := openFMP4(0)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer func() { st.Close() }()
+	switch r.URL.Path {
+	case "/fmp4/live":
+		streamFragments(w, r, f, &st)
+	case "/fmp4/video.mp4":
+		http.ServeContent(w, r, "video.mp4", time.Time{}, io.NewSectionReader(f, 0, f.size))
+	case "/fmp4/index.json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Init      fragment   `json:"init"`
+			Fragments []fragment `json:"fragments"`
+		}{fragment{Size: int64(len(f.init))}, f.fragments})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamFragments sends the init segment and the fragments of f paced by
+// livePace, from the fragment at ?from= seconds on. While the source is
+// written, its moov first, the fragments of the media added to it follow as
+// it comes, until all the samples of moov are sent or no media came for
+// liveWait. Of a "grow:" source, the stream goes on with the fragments of
+// the next version once it reaches the end of its own. There is no length, HTTP/1.1 sends it chunked. *st is the
+// stream f reads, replaced by the one of every repackaging.
+func streamFragments(w http.ResponseWriter, r *http.Request, f fmp4File, st **stream) {
+	from, _ := strconv.ParseFloat(r.URL.Query().Get("from"), 64)
+	next := sort.Search(len(f.fragments), func(i int) bool { return f.fragments[i].Time+f.fragments[i].Duration > from })
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	if _, err := w.Write(f.init); err != nil {
+		return
+	}
+	rc.Flush()
+	fmt.Printf("fmp4 live %s: from fragment %d of %d\n", r.RemoteAddr, next+1, len(f.fragments))
+	var start time.Time // of the first fragment sent, which plays at t0
+	var t0 float64
+	version := 0 // of the source f repackages
+	for {
+		ready := f.fragments
+		longer := f.complete && version < lastVersion()
+		if longer && len(ready) > 0 {
+			// the last fragment ends where this version does, it goes on
+			// in the next one
+			ready = ready[:len(ready)-1]
+		}
+		for ; next < len(ready); next++ {
+			fr := ready[next]
+			if start.IsZero() {
+				start, t0 = time.Now(), fr.Time
+			}
+			if livePace > 0 {
+				due := time.Duration((fr.Time - t0) / livePace * float64(time.Second))
+				select {
+				case <-time.After(time.Until(start.Add(due))):
+				case <-r.Context().Done():
+					fmt.Printf("fmp4 live %s: gone before fragment %d\n", r.RemoteAddr, fr.Seq)
+					return
+				}
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(f, fr.Offset, fr.Size)); err != nil {
+				fmt.Printf("fmp4 live %s: fragment %d: %v\n", r.RemoteAddr, fr.Seq, err)
+				return
+			}
+			rc.Flush()
+		}
+		if f.complete && !longer && next >= len(f.fragments) {
+			fmt.Printf("fmp4 live %s: all fragments sent\n", r.RemoteAddr)
+			return
+		}
+		if longer {
+			version++
+		}
+		g, gst, err := grownFMP4(r.Context(), f, version)
+		if err != nil {
+			fmt.Printf("fmp4 live %s: after fragment %d: %v\n", r.RemoteAddr, next, err)
+			return
+		}
+		(*st).Close()
+		f, *st = g, gst
+	}
+}
+
+// grownFMP4 waits up to liveWait for version of the source to grow past f
+// and repackages it.
+func grownFMP4(ctx context.Context, f fmp4File, version int) (fmp4File, *stream, error) {
+	deadline := time.Now().Add(liveWait)
+	for {
+		g, st, err := openFMP4(version)
+		if err == nil && g.fmp4 != f.fmp4 {
+			return g, st, nil
+		}
+		if err == nil {
+			st.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmp4File{}, nil, fmt.Errorf("no new media within %s", liveWait)
+		}
+		select {
+		case <-time.After(livePoll):
+		case <-ctx.Done():
+			return fmp4File{}, nil, ctx.Err()
+		}
+	}
+}
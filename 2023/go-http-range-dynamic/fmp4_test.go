@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func box(typ string, payloads ...[]byte) []byte {
+	return mp4Box(typ, bytes.Join(payloads, nil))
+}
+
+func fbox(typ string, payloads ...[]byte) []byte {
+	return fullBox(typ, 0, 0, bytes.Join(payloads, nil))
+}
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+type testTrack struct {
+	handler          string
+	timescale, delta uint32
+	sizes, sync      []uint32
+	perChunk         int
+}
+
+// buildMP4 encodes 4 seconds of 10fps video with a keyframe every second,
+// and audio in chunks of 5 samples, moov at the end unless moovFirst. Every
+// byte of a sample is the track number followed by the low byte of the
+// sample number.
+func buildMP4(moovFirst bool) []byte {
+	video := testTrack{handler: "vide", timescale: 1000, delta: 100, perChunk: 2, sync: []uint32{1, 11, 21, 31}}
+	for i := 0; i < 40; i++ {
+		video.sizes = append(video.sizes, uint32(100+i))
+	}
+	audio := testTrack{handler: "soun", timescale: 8000, delta: 1600, perChunk: 5}
+	for i := 0; i < 20; i++ {
+		audio.sizes = append(audio.sizes, 20)
+	}
+	tracks := []testTrack{video, audio}
+
+	ftyp := box("ftyp", []byte("isom"), u32s(512), []byte("isomiso2mp41"))
+	mdat, moov := encodeTracks(tracks, uint32(len(ftyp)+8))
+	if !moovFirst {
+		return bytes.Join([][]byte{ftyp, box("mdat", mdat), moov}, nil)
+	}
+	mdat, moov = encodeTracks(tracks, uint32(len(ftyp)+len(moov)+8))
+	return bytes.Join([][]byte{ftyp, moov, box("mdat", mdat)}, nil)
+}
+
+// encodeTracks is the mdat body and moov of tracks, mdat starting at base.
+func encodeTracks(tracks []testTrack, base uint32) (mdat, moov []byte) {
+	offsets := make([][]uint32, len(tracks))
+	for c := 0; c < 20; c++ {
+		for ti, t := range tracks {
+			first := c * t.perChunk
+			if first >= len(t.sizes) {
+				continue
+			}
+			offsets[ti] = append(offsets[ti], base+uint32(len(mdat)))
+			for s := first; s < min(first+t.perChunk, len(t.sizes)); s++ {
+				mdat = append(mdat, bytes.Repeat([]byte{byte(ti + 1), byte(s)}, int(t.sizes[s]))[:t.sizes[s]]...)
+			}
+		}
+	}
+	var traks [][]byte
+	for ti, t := range tracks {
+		duration := t.delta * uint32(len(t.sizes))
+		stbl := [][]byte{
+			fbox("stsd", u32s(0)),
+			fbox("stts", u32s(1, uint32(len(t.sizes)), t.delta)),
+			fbox("stsz", u32s(0, uint32(len(t.sizes))), u32s(t.sizes...)),
+			fbox("stsc", u32s(1, 1, uint32(t.perChunk), 1)),
+			fbox("stco", u32s(uint32(len(offsets[ti]))), u32s(offsets[ti]...)),
+		}
+		if t.sync != nil {
+			stbl = append(stbl, fbox("stss", u32s(uint32(len(t.sync))), u32s(t.sync...)))
+		}
+		traks = append(traks, box("trak",
+			fbox("tkhd", u32s(0, 0, uint32(ti+1), 0, duration), make([]byte, 60)),
+			box("mdia",
+				fbox("mdhd", u32s(0, 0, t.timescale, duration, 0)),
+				fbox("hdlr", u32s(0), []byte(t.handler), make([]byte, 13)),
+				box("minf", box("stbl", stbl...)),
+			),
+		))
+	}
+	mvhd := fbox("mvhd", u32s(0, 0, 1000, 4000), make([]byte, 80))
+	return mdat, box("moov", append([][]byte{mvhd}, traks...)...)
+}
+
+func TestFragmentMP4(t *testing.T) {
+	src := buildMP4(false)
+	f, err := fragmentMP4(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := io.ReadAll(io.NewSectionReader(fmp4File{fmp4: f, src: bytes.NewReader(src)}, 0, f.size))
+	if err != nil || int64(len(file)) != f.size {
+		t.Fatalf("read %d of %d bytes: %v", len(file), f.size, err)
+	}
+	r := bytes.NewReader(file)
+
+	moov, err := findPath(r, f.size, "moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := descend(r, moov, "mvex", "trex"); err != nil {
+		t.Errorf("init segment: %v", err)
+	}
+	if stss, err := descend(r, moov, "trak", "mdia", "minf", "stbl", "stss"); err == nil {
+		t.Errorf("init segment has samples: %+v", stss)
+	}
+
+	// fragments at the keyframes 2s apart, each sample where trun says
+	if len(f.fragments) != 2 || f.fragments[1].Time != 2 || f.fragments[1].Duration != 2 {
+		t.Fatalf("fragments %+v", f.fragments)
+	}
+	samples := map[int]int{} // per track
+	for _, fr := range f.fragments {
+		moof, err := readBoxHeader(r, fr.Offset, f.size)
+		if err != nil || moof.typ != "moof" {
+			t.Fatalf("fragment %d: %q %v", fr.Seq, moof.typ, err)
+		}
+		trafs, err := children(r, moof.bodyOffset(), moof.end())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, traf := range trafs[1:] {
+			tfhd, _ := descend(r, traf, "tfhd")
+			trun, _ := descend(r, traf, "trun")
+			body, _ := readBoxBody(r, trun)
+			id := int(binary.BigEndian.Uint32(file[tfhd.bodyOffset()+4:]))
+			count := int(binary.BigEndian.Uint32(body[4:]))
+			offset := moof.offset + int64(binary.BigEndian.Uint32(body[8:]))
+			for i := 0; i < count; i++ {
+				size := int64(binary.BigEndian.Uint32(body[12+i*16+4:]))
+				n := samples[id]
+				if sample := file[offset : offset+size]; sample[0] != byte(id) || sample[1] != byte(n) {
+					t.Fatalf("fragment %d track %d sample %d: % x", fr.Seq, id, n, sample[:2])
+				}
+				samples[id]++
+				offset += size
+			}
+		}
+	}
+	if samples[1] != 40 || samples[2] != 20 {
+		t.Errorf("samples in fragments %v", samples)
+	}
+}
+
+func TestServeFMP4(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(name, buildMP4(false), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src, pace := source, livePace
+	source, livePace = segmentFiles{name}, 0
+	defer func() { source, livePace = src, pace }()
+	get := func(path, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		serveFMP4(rec, req)
+		return rec
+	}
+
+	var index struct {
+		Init      fragment
+		Fragments []fragment
+	}
+	if err := json.Unmarshal(get("/fmp4/index.json", "").Body.Bytes(), &index); err != nil || len(index.Fragments) != 2 {
+		t.Fatalf("index %+v, %v", index, err)
+	}
+	file := get("/fmp4/video.mp4", "").Body.Bytes()
+	fr := index.Fragments[1]
+	rec := get("/fmp4/video.mp4", fmt.Sprintf("bytes=%d-%d", fr.Offset, fr.Offset+fr.Size-1))
+	if rec.Code != 206 || !bytes.Equal(rec.Body.Bytes(), file[fr.Offset:fr.Offset+fr.Size]) || string(rec.Body.Bytes()[4:8]) != "moof" {
+		t.Errorf("fragment by range: %d %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+	if live := get("/fmp4/live", "").Body.Bytes(); !bytes.Equal(live, file) {
+		t.Errorf("live stream of %d bytes differs from the %d of the file", len(live), len(file))
+	}
+	if live := get("/fmp4/live?from=2.5", "").Body.Bytes(); !bytes.Equal(live, append(file[:index.Init.Size:index.Init.Size], file[fr.Offset:]...)) {
+		t.Errorf("live stream from 2.5s: %d bytes", len(live))
+	}
+}
+
+func TestServeFMP4Growing(t *testing.T) {
+	defer func(src segmentSource, pace float64, wait, poll time.Duration) {
+		source, livePace, liveWait, livePoll = src, pace, wait, poll
+	}(source, livePace, liveWait, livePoll)
+	livePace, liveWait, livePoll = 0, 200*time.Millisecond, 5*time.Millisecond
+	live := func() []byte {
+		rec := httptest.NewRecorder()
+		serveFMP4(rec, httptest.NewRequest("GET", "/fmp4/live", nil))
+		return rec.Body.Bytes()
+	}
+
+	// the fMP4 file of the whole video, to compare with
+	dir := t.TempDir()
+	mp4 := buildMP4(true)
+	name := filepath.Join(dir, "video.mp4")
+	if err := os.WriteFile(name, mp4, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	whole, err := fragmentMP4(bytes.NewReader(mp4), int64(len(mp4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := io.ReadAll(io.NewSectionReader(fmp4File{fmp4: whole, src: bytes.NewReader(mp4)}, 0, whole.size))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory receiving the video in segments while it streams: the
+	// first one has the moov and no whole fragment
+	segments := filepath.Join(dir, "segments")
+	os.Mkdir(segments, 0o755)
+	moov, err := findPath(bytes.NewReader(mp4), int64(len(mp4)), "moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cuts := []int{0, int(moov.end()) + 100, len(mp4) * 2 / 3, len(mp4)}
+	write := func(i int) {
+		os.WriteFile(filepath.Join(segments, fmt.Sprintf("part-%03d", i)), mp4[cuts[i]:cuts[i+1]], 0o644)
+	}
+	write(0)
+	source = segmentDir(segments)
+	partial, st, err := openFMP4(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if len(partial.fragments) != 0 || partial.complete {
+		t.Fatalf("fMP4 of the moov alone: %d fragments", len(partial.fragments))
+	}
+	go func() {
+		for i := 1; i < len(cuts)-1; i++ {
+			time.Sleep(50 * time.Millisecond)
+			write(i)
+		}
+	}()
+	start := time.Now()
+	if got := live(); !bytes.Equal(got, file) {
+		t.Errorf("live stream of a growing directory: %d bytes, want the %d of the fMP4 file", len(got), len(file))
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > liveWait {
+		t.Errorf("live stream of a growing directory ended after %v", d)
+	}
+
+	// a directory that stops growing ends the stream after liveWait
+	os.Remove(filepath.Join(segments, "part-002"))
+	start = time.Now()
+	if got := live(); !bytes.Equal(got, file[:whole.fragments[1].Offset]) {
+		t.Errorf("live stream of a stalled directory: %d bytes", len(got))
+	}
+	if d := time.Since(start); d < liveWait {
+		t.Errorf("live stream of a stalled directory ended after %v", d)
+	}
+
+	// versions: the last fragment of one goes on in the next
+	again := filepath.Join(dir, "again.mp4")
+	os.WriteFile(again, mp4, 0o644)
+	source = segmentVersions{name, again}
+	// each stream starts at the first version
+	for range 2 {
+		if got := live(); !bytes.Equal(got, file) {
+			t.Errorf("live stream of versions: %d bytes, want %d", len(got), len(file))
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.zeng.dev/httprange"
+)
+
+var (
+	// liveWait is how long a request for bytes not written yet waits for them.
+	liveWait = 10 * time.Second
+	// livePoll is how often the size of a live file is checked.
+	livePoll = 200 * time.Millisecond
+)
+
+// doneSuffix marks a live file complete: a writer creates name+doneSuffix
+// next to it after its last write.
+const doneSuffix = ".done"
+
+// growingFile is the size of a file being written, polled while requests
+// watch it.
+type growingFile struct {
+	mu       sync.Mutex
+	size     int64
+	complete bool
+	changed  chan struct{} // closed and replaced at every change
+	watchers int
+	stop     chan struct{}
+}
+
+func (g *growingFile) state() (int64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.size, g.complete
+}
+
+// wait waits until the file is larger than offset, complete, or ctx is done.
+func (g *growingFile) wait(ctx context.Context, offset int64) (int64, bool) {
+	for {
+		g.mu.Lock()
+		size, complete, changed := g.size, g.complete, g.changed
+		g.mu.Unlock()
+		if size > offset || complete {
+			return size, complete
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return size, complete
+		}
+	}
+}
+
+func (g *growingFile) update(size int64, complete bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if size == g.size && complete == g.complete {
+		return
+	}
+	g.size, g.complete = size, complete
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// liveFiles are the growing files of root being watched, by name.
+type liveFiles struct {
+	root  *os.Root
+	mu    sync.Mutex
+	files map[string]*growingFile
+}
+
+func newLiveFiles(root *os.Root) *liveFiles {
+	return &liveFiles{root: root, files: map[string]*growingFile{}}
+}
+
+// stat is the size of name and whether it is complete.
+func (l *liveFiles) stat(name string) (int64, bool, error) {
+	finfo, err := l.root.Stat(name)
+	if err != nil {
+		return 0, false, err
+	}
+	if finfo.IsDir() {
+		return 0, false, fmt.Errorf("%s is a directory", name)
+	}
+	_, err = l.root.Stat(name + doneSuffix)
+	return finfo.Size(), err == nil, nil
+}
+
+// watch returns the growingFile of name, polled until release is called by
+// every watcher.
+func (l *liveFiles) watch(name string) (g *growingFile, release func(), err error) {
+	size, complete, err := l.stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g, ok := l.files[name]
+	if !ok {
+		g = &growingFile{size: size, complete: complete, changed: make(chan struct{}), stop: make(chan struct{})}
+		l.files[name] = g
+		go l.poll(name, g, livePoll)
+	}
+	g.update(size, complete)
+	g.watchers++
+	return g, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if g.watchers--; g.watchers == 0 {
+			delete(l.files, name)
+			close(g.stop)
+		}
+	}, nil
+}
+
+func (l *liveFiles) poll(name string, g *growingFile, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+		size, complete, err := l.stat(name)
+		if err != nil {
+			continue // replaced or removed, the requests time out
+		}
+		g.update(size, complete)
+	}
+}
+
+// serveLive serves ranges of a file that is still being written. Until it
+// is complete its length is unknown, Content-Range is "bytes N-M/*", and a
+// range starting at or after what is written waits up to liveWait for new
+// bytes. Once complete, responses carry the real size.
+func (l *liveFiles) serveLive(w http.ResponseWriter, req *http.Request, name string) {
+	g, release, err := l.watch(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer release()
+	f, err := l.root.Open(name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" {
+		rangeHeader = "bytes=0-" // a live file is only ever served in parts
+	}
+	size, complete := g.state()
+	total := int64(httprange.UnknownSize)
+	if complete {
+		total = size
+	}
+	opts := httprange.Options{MaxLength: sizePerRequst}
+	ranges, err := httprange.Parse(rangeHeader, total, opts)
+	if errors.Is(err, httprange.ErrUnknownSize) {
+		// a suffix range, of what is written so far
+		ranges, err = httprange.Parse(rangeHeader, size, opts)
+	}
+	switch {
+	case errors.Is(err, httprange.ErrNoOverlap):
+		w.Header().Set("Content-Range", httprange.Unsatisfied(size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 400)
+		return
+	case len(ranges) > 1:
+		http.Error(w, "unsuported multi-part", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	ra := ranges[0]
+
+	if ra.Start >= size && !complete {
+		ctx, cancel := context.WithTimeout(req.Context(), liveWait)
+		size, complete = g.wait(ctx, ra.Start)
+		cancel()
+	}
+	if complete {
+		total = size
+	}
+	switch {
+	case ra.Start >= size && complete:
+		w.Header().Set("Content-Range", httprange.Unsatisfied(size))
+		http.Error(w, "range beyond the complete file", http.StatusRequestedRangeNotSatisfiable)
+		return
+	case ra.Start >= size:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("no bytes after %d within %s", size, liveWait), http.StatusServiceUnavailable)
+		return
+	}
+	ra.Length = min(ra.Length, size-ra.Start)
+
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", ra.ContentRange(total))
+	w.Header().Set("Content-Length", strconv.FormatInt(ra.Length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method != "HEAD" {
+		io.Copy(w, io.NewSectionReader(f, ra.Start, ra.Length))
+	}
+}
+
+// liveName is the file of a /live/ URL path, "" if it isn't one.
+func liveName(urlPath string) string {
+	name := strings.TrimPrefix(path.Clean(urlPath), "/live/")
+	if name == path.Clean(urlPath) || !fs.ValidPath(name) || strings.HasSuffix(name, doneSuffix) {
+		return ""
+	}
+	return name
+}
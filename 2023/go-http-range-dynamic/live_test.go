@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeLive(t *testing.T) {
+	defer func(wait, poll time.Duration) { liveWait, livePoll = wait, poll }(liveWait, livePoll)
+	liveWait, livePoll = 2*time.Second, 5*time.Millisecond
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "live.mp4")
+	if err := os.WriteFile(name, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	appendLater := func(d time.Duration, data string) {
+		go func() {
+			time.Sleep(d)
+			f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f.WriteString(data)
+			f.Close()
+		}()
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	l := newLiveFiles(root)
+	get := func(file, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/live/"+file, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		l.serveLive(rec, req, file)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, code int, contentRange, body string) {
+		t.Helper()
+		if rec.Code != code || rec.Header().Get("Content-Range") != contentRange || (body != "" && rec.Body.String() != body) {
+			t.Errorf("%d %q %q, want %d %q %q", rec.Code, rec.Header().Get("Content-Range"), rec.Body, code, contentRange, body)
+		}
+	}
+
+	// the length is unknown while the file is written
+	expect(get("live.mp4", ""), 206, "bytes 0-9/*", "0123456789")
+	expect(get("live.mp4", "bytes=2-5"), 206, "bytes 2-5/*", "2345")
+	expect(get("live.mp4", "bytes=-4"), 206, "bytes 6-9/*", "6789")
+
+	// a range past what is written waits for it
+	appendLater(50*time.Millisecond, "abcde")
+	start := time.Now()
+	expect(get("live.mp4", "bytes=10-"), 206, "bytes 10-14/*", "abcde")
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("answered after %v, before the bytes were written", d)
+	}
+
+	// until liveWait
+	liveWait = 50 * time.Millisecond
+	rec := get("live.mp4", "bytes=15-")
+	expect(rec, 503, "", "")
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("503 without Retry-After: %v", rec.Header())
+	}
+
+	// completion releases a waiting request with the real size
+	liveWait = 2 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.WriteFile(name+doneSuffix, nil, 0o644)
+	}()
+	expect(get("live.mp4", "bytes=15-"), 416, "bytes */15", "")
+	expect(get("live.mp4", "bytes=0-4"), 206, "bytes 0-4/15", "01234")
+	expect(get("live.mp4", "bytes=12-"), 206, "bytes 12-14/15", "cde")
+	expect(get("live.mp4", "bytes=20-30"), 416, "bytes */15", "")
+
+	if rec := get("missing.mp4", ""); rec.Code != 404 {
+		t.Errorf("missing file: %d", rec.Code)
+	}
+	if len(l.files) != 0 {
+		t.Errorf("%d files still watched", len(l.files))
+	}
+}
+
+func TestLiveName(t *testing.T) {
+	for urlPath, want := range map[string]string{
+		"/live/live.mp4":          "live.mp4",
+		"/live/sub/live.mp4":      "sub/live.mp4",
+		"/live/../main.go":        "",
+		"/live/a/../../main.go":   "",
+		"/live/live.mp4.done":     "",
+		"/live/":                  "",
+		"/live":                   "",
+		"/vfull.mp4":              "",
+		"/other/live/live.mp4":    "",
+		"/live/./sub/../live.mp4": "live.mp4",
+	} {
+		if got := liveName(urlPath); got != want {
+			t.Errorf("liveName(%q) = %q, want %q", urlPath, got, want)
+		}
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"errors"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/textproto"
 	"os"
 	"strconv"
-	"strings"
+	"time"
+
+	"example.zeng.dev/httprange"
 )
 
 var isFakeDynamic bool
@@ -18,48 +19,102 @@ var isFakeDynamic bool
 func main() {
 	port := flag.String("p", "9100", "port to serve on")
 	directory := flag.String("d", "media/", "the directory of static file to host")
-	flag.BoolVar(&isFakeDynamic, "dynamic", false, "whether return a large enough Content-Length to browser")
+	segments := flag.String("segments", "grow:media/dun-dun-dance-part1.mp4,media/dun-dun-dance.mp4", "the video at /: a file, files joined into one by commas, a directory of segments in name order, which may keep growing, "+
+		`or "grow:" and longer and longer versions of the video by commas, the next served once a request nears the end of one`)
+	flag.BoolVar(&isFakeDynamic, "dynamic", false, "whether return a large enough Content-Length to browser, the default of new sessions, ?dynamic= sets it per session")
+	flag.DurationVar(&sessionTTL, "session-ttl", sessionTTL, "time an idle session is kept")
+	flag.DurationVar(&sessionSettle, "session-settle", 0, "shrink the length told a session to the real size once the video hasn't grown for this long, 0 is never")
+	tlsOn := flag.Bool("tls", false, "serve HTTPS with HTTP/1.1 and h2, with a self-signed certificate unless -cert and -key")
+	certFile := flag.String("cert", "", "PEM certificate file of -tls")
+	keyFile := flag.String("key", "", "PEM key file of -tls")
+	h2c := flag.Bool("h2c", false, "serve cleartext h2 with prior knowledge next to HTTP/1.1, without -tls")
+	h3 := flag.Bool("h3", false, "serve HTTP/3 on UDP port -p too, needs -tls")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "time to read the request headers, 0 is none")
+	readTimeout := flag.Duration("read-timeout", 0, "time to read a whole request, 0 is none")
+	writeTimeout := flag.Duration("write-timeout", 0, "time to write a response, 0 is none, cuts off chunks sent slower")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "time a keep-alive connection waits for the next request")
+	maxConns := flag.Int("max-conns", 0, "most TCP connections at a time, more wait to be accepted, 0 is no cap")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "most TCP connections of a client address, more are closed, 0 is no cap")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time the transfers in flight at SIGINT/SIGTERM may take to finish")
+	policySpec := flag.String("policy", "", `how ranges are answered by class, e.g. "tail-probe=moov,prefetch=416", `+
+		"classes sequential, seek, tail-probe, prefetch, actions serve, tail (the real tail), moov (synthetic), 416")
+	flag.DurationVar(&fragmentDuration, "fragment", fragmentDuration, "least playback time of a fragment of /fmp4/, cut at keyframes")
+	flag.Float64Var(&livePace, "live-pace", livePace, "speed /fmp4/live sends fragments at, relative to playback, 0 is as fast as possible")
+	flag.DurationVar(&liveWait, "live-wait", liveWait, "time a /live/ request for bytes not written yet waits for them")
+	flag.DurationVar(&livePoll, "live-poll", livePoll, "how often the size of a /live/ file being written is checked")
 	flag.Parse()
 
+	var err error
+	if policy, err = parsePolicy(*policySpec); err != nil {
+		log.Fatal(err)
+	}
+	root, err := os.OpenRoot(*directory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	live := newLiveFiles(root)
+	if source, err = newSegmentSource(*segments); err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/admin/sessions", sessions.serveSessions)
+	http.HandleFunc("/fmp4/live", serveFMP4) // withLog would keep the endless body
+	http.HandleFunc("/fmp4/", withLog(serveFMP4))
 	fs := withLog(http.FileServer(http.Dir(*directory)).ServeHTTP)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			rangeVideo(w, r)
 			return
 		}
+		if name := liveName(r.URL.Path); name != "" {
+			withLog(func(w http.ResponseWriter, r *http.Request) { live.serveLive(w, r, name) })(w, r)
+			return
+		}
 		fs(w, r)
 	})
 
-	log.Printf("Serving %s on HTTP port: %s\n", *directory, *port)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	log.Printf("Serving %s on HTTP port: %s, tls: %v, h2c: %v, h3: %v\n", *directory, *port, *tlsOn, *h2c, *h3)
+	err = listenAndServe(serveOptions{
+		addr:              ":" + *port,
+		tls:               *tlsOn,
+		certFile:          *certFile,
+		keyFile:           *keyFile,
+		h2c:               *h2c,
+		h3:                *h3,
+		readHeaderTimeout: *readHeaderTimeout,
+		readTimeout:       *readTimeout,
+		writeTimeout:      *writeTimeout,
+		idleTimeout:       *idleTimeout,
+		maxConns:          *maxConns,
+		maxConnsPerIP:     *maxConnsPerIP,
+		shutdownTimeout:   *shutdownTimeout,
+	}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 const (
-	vpart1         = "./media/dun-dun-dance-part1.mp4"
-	vfull          = "./media/dun-dun-dance.mp4"
 	sizePerRequst  = 5 * 1000 * 1000    // 5MB/req
 	largeEnoughLen = 1000 * 1000 * 1000 // 1GB
 )
 
-func openfile(name string) (*os.File, int64, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, 0, err
-	}
-	finfo, err := f.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-	return f, finfo.Size(), nil
-}
+// source is the stream rangeVideo serves, see -segments.
+var source segmentSource
 
 func rangeVideo(w http.ResponseWriter, req *http.Request) {
-	f, size, err := openfile(vpart1)
+	version := sessions.version(req)
+	segs, err := versionSegments(version)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	defer f.Close()
+	f := newStream(segs)
+	defer func() { f.Close() }()
+	size := f.size()
+	sess := sessions.negotiate(w, req, size)
+	// the length the session is told, the size in Content-Range
+	claimed := sess.Length
 
 	w.Header().Set("Content-Type", "video/mp4")
 
@@ -75,77 +130,93 @@ func rangeVideo(w http.ResponseWriter, req *http.Request) {
 	// }
 	//
 	// but this not worked for Safari and Firefox
-	if rangeHeader == "" {
-		ra := httpRange{
-			start:  0,
-			length: sizePerRequst,
-		}
+	if rangeHeader == "" && size == 0 {
+		// an empty stream has no range 0-0 to hint with
 		w.Header().Set("Accept-Ranges", "bytes")
-		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
-		if isFakeDynamic {
-			w.Header().Set("Content-Range", ra.contentRange(largeEnoughLen))
-		} else {
-			w.Header().Set("Content-Range", ra.contentRange(size))
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var ra httpRange
+	if rangeHeader == "" {
+		// hint the browser to send serial range requests with a 206 of the
+		// start, answered as a range from 0 is
+		ra = httpRange{start: 0, length: min(sizePerRequst, size)}
+		fmt.Printf("\n%s request without range, hint browser to send serial range requests\n", req.RemoteAddr)
+	} else {
+		// browser sends range request
+		fmt.Printf("\n%s request range %s\n", req.RemoteAddr, rangeHeader)
+		ranges, err := parseRange(rangeHeader, claimed)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
 
-		w.WriteHeader(http.StatusPartialContent)
-		fmt.Printf("hint browser to send serial range requests, response 206, 0-%d/%s\n", sizePerRequst-1, w.Header().Get("Content-Range"))
-		if req.Method != "HEAD" {
-			written, err := io.CopyN(w, f, ra.length)
-			if written != ra.length {
-				fmt.Printf("desired range size: %d, actual written: %d, err: %v\n\n", ra.length, written, err)
-			}
+		// multi-part requests are not supported
+		if len(ranges) > 1 {
+			http.Error(w, "unsuported multi-part", http.StatusRequestedRangeNotSatisfiable)
+			return
 		}
-		return
+		ra = ranges[0]
 	}
-
-	// browser sends range request
-	reqer := req.RemoteAddr
-	fmt.Printf("\n%s request range %s\n", reqer, rangeHeader)
-	ranges, err := parseRange(rangeHeader, size)
-	// if isFakeDynamic {
-	// 	ranges, err = parseRange(rangeHeader, largeEnoughLen)
-	// }
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
+	if ra.start < claimed {
+		ra.length = min(ra.length, claimed-ra.start)
 	}
-
-	// multi-part requests are not supported
-	if len(ranges) > 1 {
-		http.Error(w, "unsuported multi-part", http.StatusRequestedRangeNotSatisfiable)
-		return
+	d := policy.decide(sess.ID, ra, claimed)
+	fmt.Printf("policy: range %d-%d is %s (%s), %s\n", ra.start, ra.start+ra.length-1, d.class, d.reason, d.action)
+	// a session reading near the end of its version of a "grow:" source
+	// moves on to the next, a tail probe doesn't read the video, nor does
+	// the hint
+	if was := version; d.class != classTailProbe && rangeHeader != "" {
+		for version < lastVersion() && ra.start+sizePerRequst > size {
+			version++
+			if segs, err = versionSegments(version); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			f.Close()
+			f = newStream(segs)
+			size = f.size()
+		}
+		if version != was {
+			fmt.Printf("range start %d, session %s grown to version %d, %d bytes\n", ra.start, sess.ID, version, size)
+			claimed = sessions.grown(sess.ID, version, size)
+		}
 	}
-
-	ra := ranges[0]
-
-	if ra.start+sizePerRequst > size && ra.length > 1024*1024 /* try trick the tail verify */ {
-		fmt.Printf("part1 size %d, range start %d size %d,open full file\n", size, ra.start, ra.length)
-		f, size, err = openfile(vfull)
+	// where the bytes are read from, the range answered may be another
+	var content io.ReaderAt = f
+	from, avail := ra.start, size
+	var servedFrom string
+	switch d.action {
+	case actionRefuse:
+		w.Header().Set("Content-Range", httprange.Unsatisfied(claimed))
+		http.Error(w, fmt.Sprintf("%s refused by policy", d.class), http.StatusRequestedRangeNotSatisfiable)
+		return
+	case actionRealTail:
+		from = max(ra.start-(claimed-size), 0)
+	case actionMoov:
+		moov, err := findMoov(f, size)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		defer f.Close()
+		ra.length = min(ra.length, sizePerRequst)
+		content, from, avail = bytes.NewReader(syntheticMoov(moov, ra.length)), 0, ra.length
+		servedFrom = "synthetic moov"
 	}
-
-	if _, err := f.Seek(ra.start, io.SeekStart); err != nil {
-		if ra.start+ra.length == largeEnoughLen { // trick the tail verify
-			_, err = f.Seek(size-ra.length, io.SeekStart)
-		}
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
+	if from >= avail {
+		w.Header().Set("Content-Range", httprange.Unsatisfied(claimed))
+		http.Error(w, fmt.Sprintf("range starts at %d, past the stream", ra.start), http.StatusRequestedRangeNotSatisfiable)
+		return
 	}
-	fmt.Printf("response range bytes %d-%d, %d KB\n", ra.start, ra.start+ra.length-1, ra.length/1024)
-	sendSize := ra.length
-
-	if isFakeDynamic {
-		w.Header().Set("Content-Range", ra.contentRange(largeEnoughLen))
-	} else {
-		w.Header().Set("Content-Range", ra.contentRange(size))
+	sendSize := min(ra.length, avail-from)
+	ra.length = sendSize
+	if content == f {
+		servedFrom = f.span(from, sendSize)
 	}
+	fmt.Printf("response range bytes %d-%d, %d KB, from %s, session %s\n", ra.start, ra.start+ra.length-1, ra.length/1024, servedFrom, sess.ID)
+	sessions.served(sess.ID, ra.start+ra.length)
+	w.Header().Set("Content-Range", ra.contentRange(claimed))
 
 	w.Header().Set("Accept-Ranges", "bytes")
 	if w.Header().Get("Content-Encoding") == "" {
@@ -154,7 +225,7 @@ func rangeVideo(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusPartialContent)
 
 	if req.Method != "HEAD" {
-		written, err := io.CopyN(w, f, sendSize)
+		written, err := io.Copy(w, io.NewSectionReader(content, from, sendSize))
 		if written != sendSize || err != nil {
 			fmt.Println(ra, size)
 			fmt.Printf("desired range size: %d, actual written: %d, err: %v\n\n", sendSize, written, err)
@@ -164,88 +235,27 @@ func rangeVideo(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// --- httpRange and its funcs are ported from net/http fs.go
-
 // httpRange specifies the byte range to be sent to the client.
 type httpRange struct {
 	start, length int64
 }
 
 func (r httpRange) contentRange(size int64) string {
-	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+	return httprange.Range{Start: r.start, Length: r.length}.ContentRange(size)
 }
 
-var errNoOverlap = errors.New("invalid range: failed to overlap")
-
-// parseRange parses a Range header string as per RFC 7233.
-// errNoOverlap is returned if none of the ranges overlap.
+// parseRange parses a Range header string as per RFC 9110, see
+// httprange.Parse. An open-ended range is capped to sizePerRequst bytes.
+// Ranges beyond size are kept, since the server may attempt to return a
+// largeEnoughLen, so errNoOverlap never happens.
 func parseRange(s string, size int64) ([]httpRange, error) {
-	if s == "" {
-		return nil, nil // header not present
-	}
-	const b = "bytes="
-	if !strings.HasPrefix(s, b) {
-		return nil, errors.New("invalid range")
-	}
-	var ranges []httpRange
-	noOverlap := false
-	for _, ra := range strings.Split(s[len(b):], ",") {
-		ra = textproto.TrimString(ra)
-		if ra == "" {
-			continue
-		}
-		start, end, ok := strings.Cut(ra, "-")
-		if !ok {
-			return nil, errors.New("invalid range")
-		}
-		start, end = textproto.TrimString(start), textproto.TrimString(end)
-		var r httpRange
-		if start == "" {
-			if end == "" || end[0] == '-' {
-				return nil, errors.New("invalid range")
-			}
-			i, err := strconv.ParseInt(end, 10, 64)
-			if i < 0 || err != nil {
-				return nil, errors.New("invalid range")
-			}
-			if i > size {
-				i = size
-			}
-			r.start = size - i
-			r.length = size - r.start
-		} else {
-			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i < 0 {
-				return nil, errors.New("invalid range")
-			}
-			if i >= size {
-				// If the range begins after the size of the content,
-				// then it does not overlap.
-				noOverlap = true
-				//continue, since server may attempt to return a largeEnoughLen, errNoOverlap never happen
-			}
-			r.start = i
-			if end == "" {
-				r.length = sizePerRequst
-				if r.length > size-r.start && !noOverlap {
-					r.length = size - r.start
-				}
-			} else {
-				i, err := strconv.ParseInt(end, 10, 64)
-				if err != nil || r.start > i {
-					return nil, errors.New("invalid range")
-				}
-				if i >= size {
-					i = size - 1
-				}
-				r.length = i - r.start + 1
-			}
-		}
-		ranges = append(ranges, r)
+	parsed, err := httprange.Parse(s, size, httprange.Options{MaxLength: sizePerRequst, KeepBeyondEnd: true})
+	if err != nil {
+		return nil, err
 	}
-	if noOverlap && len(ranges) == 0 {
-		// The specified ranges did not overlap with the content.
-		return nil, errNoOverlap
+	ranges := make([]httpRange, len(parsed))
+	for i, r := range parsed {
+		ranges[i] = httpRange{start: r.Start, length: r.Length}
 	}
 	return ranges, nil
 }
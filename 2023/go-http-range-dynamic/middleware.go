@@ -15,7 +15,7 @@ func withLog(ha func(w http.ResponseWriter, r *http.Request)) func(w http.Respon
 
 		fmt.Println()
 		fmt.Println("------ request ------")
-		fmt.Println(r.Method, r.URL)
+		fmt.Println(r.Method, r.URL, r.Proto, r.RemoteAddr)
 		for k, v := range r.Header {
 			if k != "Range" {
 				continue
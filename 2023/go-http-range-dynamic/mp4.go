@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// boxHeader is the header of an ISO BMFF (MP4) box.
+type boxHeader struct {
+	typ       string
+	offset    int64 // where the box starts in the file
+	size      int64 // size of the whole box, header included
+	headerLen int64
+}
+
+func (b boxHeader) bodyOffset() int64 { return b.offset + b.headerLen }
+func (b boxHeader) bodySize() int64   { return b.size - b.headerLen }
+func (b boxHeader) end() int64        { return b.offset + b.size }
+
+var errBoxNotFound = errors.New("mp4: box not found")
+
+// readBoxHeader reads the box header at offset. end is the end of the
+// parent box, a box with size 0 extends to it.
+func readBoxHeader(r io.ReadSeeker, offset, end int64) (boxHeader, error) {
+	var buf [16]byte
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return boxHeader{}, err
+	}
+	if _, err := io.ReadFull(r, buf[:8]); err != nil {
+		return boxHeader{}, err
+	}
+	b := boxHeader{
+		typ:       string(buf[4:8]),
+		offset:    offset,
+		size:      int64(binary.BigEndian.Uint32(buf[:4])),
+		headerLen: 8,
+	}
+	switch b.size {
+	case 0:
+		b.size = end - offset
+	case 1:
+		if _, err := io.ReadFull(r, buf[8:16]); err != nil {
+			return boxHeader{}, err
+		}
+		b.size = int64(binary.BigEndian.Uint64(buf[8:16]))
+		b.headerLen = 16
+	}
+	if b.size < b.headerLen || b.end() > end {
+		return boxHeader{}, fmt.Errorf("mp4: bad size %d of box %q at %d", b.size, b.typ, offset)
+	}
+	return b, nil
+}
+
+// findBox returns the first box of typ among the sibling boxes in [start, end).
+func findBox(r io.ReadSeeker, start, end int64, typ string) (boxHeader, error) {
+	for offset := start; offset+8 <= end; {
+		b, err := readBoxHeader(r, offset, end)
+		if err != nil {
+			return boxHeader{}, err
+		}
+		if b.typ == typ {
+			return b, nil
+		}
+		offset = b.end()
+	}
+	return boxHeader{}, errBoxNotFound
+}
+
+// findPath walks down a path of box types from the top level of a file,
+// like "moov", "mvhd".
+func findPath(r io.ReadSeeker, size int64, path ...string) (boxHeader, error) {
+	return descend(r, boxHeader{size: size}, path...)
+}
+
+// descend walks down a path of box types from parent.
+func descend(r io.ReadSeeker, parent boxHeader, path ...string) (boxHeader, error) {
+	b := parent
+	for _, typ := range path {
+		var err error
+		if b, err = findBox(r, b.bodyOffset(), b.end(), typ); err != nil {
+			return boxHeader{}, fmt.Errorf("%w: %s", err, typ)
+		}
+	}
+	return b, nil
+}
+
+// readBoxBody reads the whole body of b.
+func readBoxBody(r io.ReadSeeker, b boxHeader) ([]byte, error) {
+	if b.bodySize() > 256<<20 {
+		return nil, fmt.Errorf("mp4: box %q of %d bytes is too large", b.typ, b.size)
+	}
+	if _, err := r.Seek(b.bodyOffset(), io.SeekStart); err != nil {
+		return nil, err
+	}
+	body := make([]byte, b.bodySize())
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// children lists the boxes in [start, end).
+func children(r io.ReadSeeker, start, end int64) ([]boxHeader, error) {
+	var boxes []boxHeader
+	for offset := start; offset+8 <= end; {
+		b, err := readBoxHeader(r, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, b)
+		offset = b.end()
+	}
+	return boxes, nil
+}
+
+// mp4Track is a track of a (non-fragmented) MP4 file with its sample table
+// resolved to file offsets.
+type mp4Track struct {
+	id        uint32
+	handler   string // "vide", "soun", ...
+	timescale uint32
+	duration  uint64 // sum of sample durations, in timescale
+	samples   []mp4Sample
+}
+
+type mp4Sample struct {
+	offset int64
+	size   uint32
+	time   uint64 // decode time, in timescale
+	cto    int32  // composition time offset, in timescale
+	sync   bool
+}
+
+// readMP4Tracks parses the sample tables of all tracks in moov.
+func readMP4Tracks(r io.ReadSeeker, size int64) ([]mp4Track, error) {
+	moov, err := findPath(r, size, "moov")
+	if err != nil {
+		return nil, err
+	}
+	traks, err := children(r, moov.bodyOffset(), moov.end())
+	if err != nil {
+		return nil, err
+	}
+	var tracks []mp4Track
+	for _, trak := range traks {
+		if trak.typ != "trak" {
+			continue
+		}
+		t, err := readMP4Track(r, trak)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("mp4: no track")
+	}
+	return tracks, nil
+}
+
+func readMP4Track(r io.ReadSeeker, trak boxHeader) (mp4Track, error) {
+	var t mp4Track
+	read := func(parent boxHeader, path ...string) ([]byte, error) {
+		b, err := descend(r, parent, path...)
+		if err != nil {
+			return nil, err
+		}
+		return readBoxBody(r, b)
+	}
+
+	tkhd, err := read(trak, "tkhd")
+	if err != nil || len(tkhd) < 24 {
+		return t, fmt.Errorf("mp4: bad tkhd: %v", err)
+	}
+	if tkhd[0] == 1 {
+		t.id = binary.BigEndian.Uint32(tkhd[20:24])
+	} else {
+		t.id = binary.BigEndian.Uint32(tkhd[12:16])
+	}
+	mdhd, err := read(trak, "mdia", "mdhd")
+	if err != nil || len(mdhd) < 24 {
+		return t, fmt.Errorf("mp4: bad mdhd: %v", err)
+	}
+	if mdhd[0] == 1 {
+		t.timescale = binary.BigEndian.Uint32(mdhd[20:24])
+	} else {
+		t.timescale = binary.BigEndian.Uint32(mdhd[12:16])
+	}
+	hdlr, err := read(trak, "mdia", "hdlr")
+	if err != nil || len(hdlr) < 12 {
+		return t, fmt.Errorf("mp4: bad hdlr: %v", err)
+	}
+	t.handler = string(hdlr[8:12])
+
+	stbl, err := descend(r, trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return t, err
+	}
+	tables := map[string][]byte{}
+	for _, typ := range []string{"stts", "stss", "stsz", "stsc", "stco", "co64", "ctts"} {
+		b, err := findBox(r, stbl.bodyOffset(), stbl.end(), typ)
+		if errors.Is(err, errBoxNotFound) {
+			continue
+		}
+		if err != nil {
+			return t, err
+		}
+		if tables[typ], err = readBoxBody(r, b); err != nil {
+			return t, err
+		}
+	}
+	t.samples, t.duration, err = resolveSamples(tables)
+	return t, err
+}
+
+// maxSamples bounds the sample count of a track, a day of 120fps video.
+const maxSamples = 24 * 3600 * 120
+
+// resolveSamples turns the sample tables into samples.
+func resolveSamples(tables map[string][]byte) ([]mp4Sample, uint64, error) {
+	table := func(typ string, entrySize int) ([]byte, int, error) {
+		body := tables[typ]
+		if len(body) < 8 {
+			return nil, 0, fmt.Errorf("mp4: missing %s", typ)
+		}
+		n := int(binary.BigEndian.Uint32(body[4:8]))
+		if len(body)-8 < n*entrySize {
+			return nil, 0, fmt.Errorf("mp4: short %s", typ)
+		}
+		return body[8:], n, nil
+	}
+
+	// sample sizes
+	stsz := tables["stsz"]
+	if len(stsz) < 12 {
+		return nil, 0, errors.New("mp4: missing stsz")
+	}
+	fixedSize := binary.BigEndian.Uint32(stsz[4:8])
+	count := int(binary.BigEndian.Uint32(stsz[8:12]))
+	if fixedSize == 0 && len(stsz)-12 < count*4 || count > maxSamples {
+		return nil, 0, errors.New("mp4: bad stsz")
+	}
+	samples := make([]mp4Sample, count)
+	for i := range samples {
+		samples[i].size = fixedSize
+		if fixedSize == 0 {
+			samples[i].size = binary.BigEndian.Uint32(stsz[12+i*4:])
+		}
+	}
+
+	// decode times
+	stts, n, err := table("stts", 8)
+	if err != nil {
+		return nil, 0, err
+	}
+	var decodeTime uint64
+	i := 0
+	for e := 0; e < n; e++ {
+		sampleCount := int(binary.BigEndian.Uint32(stts[e*8:]))
+		delta := uint64(binary.BigEndian.Uint32(stts[e*8+4:]))
+		for j := 0; j < sampleCount && i < count; j++ {
+			samples[i].time = decodeTime
+			decodeTime += delta
+			i++
+		}
+	}
+
+	// composition offsets, version 1 has signed ones, which version 0
+	// writers put in too
+	if _, ok := tables["ctts"]; ok {
+		ctts, n, err := table("ctts", 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		i := 0
+		for e := 0; e < n; e++ {
+			sampleCount := int(binary.BigEndian.Uint32(ctts[e*8:]))
+			offset := int32(binary.BigEndian.Uint32(ctts[e*8+4:]))
+			for j := 0; j < sampleCount && i < count; j++ {
+				samples[i].cto = offset
+				i++
+			}
+		}
+	}
+
+	// sync samples, every sample is a sync sample without stss
+	if _, ok := tables["stss"]; ok {
+		stss, n, err := table("stss", 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		for e := 0; e < n; e++ {
+			if k := int(binary.BigEndian.Uint32(stss[e*4:])) - 1; k >= 0 && k < count {
+				samples[k].sync = true
+			}
+		}
+	} else {
+		for i := range samples {
+			samples[i].sync = true
+		}
+	}
+
+	// chunk offsets
+	var chunkOffsets []int64
+	if _, ok := tables["co64"]; ok {
+		co64, n, err := table("co64", 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		for e := 0; e < n; e++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint64(co64[e*8:])))
+		}
+	} else {
+		stco, n, err := table("stco", 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		for e := 0; e < n; e++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint32(stco[e*4:])))
+		}
+	}
+
+	// samples of chunks
+	stsc, n, err := table("stsc", 12)
+	if err != nil {
+		return nil, 0, err
+	}
+	i = 0
+	for e := 0; e < n; e++ {
+		firstChunk := int(binary.BigEndian.Uint32(stsc[e*12:])) - 1
+		perChunk := int(binary.BigEndian.Uint32(stsc[e*12+4:]))
+		lastChunk := len(chunkOffsets)
+		if e+1 < n {
+			lastChunk = int(binary.BigEndian.Uint32(stsc[(e+1)*12:])) - 1
+		}
+		for c := max(firstChunk, 0); c < lastChunk && c < len(chunkOffsets); c++ {
+			offset := chunkOffsets[c]
+			for j := 0; j < perChunk && i < count; j++ {
+				samples[i].offset = offset
+				offset += int64(samples[i].size)
+				i++
+			}
+		}
+	}
+	if i != count {
+		return nil, 0, fmt.Errorf("mp4: %d samples in chunks, %d in stsz", i, count)
+	}
+	return samples, decodeTime, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rangeClass is what a range request of a client is, judged from the
+// ranges it asked for before.
+type rangeClass int
+
+const (
+	// classSequential continues where the previous range ended.
+	classSequential rangeClass = iota
+	// classSeek jumps elsewhere, the user moved the playhead.
+	classSeek
+	// classTailProbe reaches the end of the length the client was told,
+	// browsers read it to check the size or look for a moov box at the end.
+	classTailProbe
+	// classPrefetch is a little ahead of the previous range.
+	classPrefetch
+)
+
+var classNames = map[rangeClass]string{
+	classSequential: "sequential",
+	classSeek:       "seek",
+	classTailProbe:  "tail-probe",
+	classPrefetch:   "prefetch",
+}
+
+func (c rangeClass) String() string { return classNames[c] }
+
+// policyAction is how a class of ranges is answered.
+type policyAction int
+
+const (
+	// actionServe sends the bytes asked for, a 416 beyond the real end.
+	actionServe policyAction = iota
+	// actionRealTail sends the real end of the stream in place of the end of
+	// the length the client was told.
+	actionRealTail
+	// actionMoov sends the moov box of the stream, padded with a free box.
+	actionMoov
+	// actionRefuse answers 416.
+	actionRefuse
+)
+
+var actionNames = map[policyAction]string{
+	actionServe:    "serve",
+	actionRealTail: "tail",
+	actionMoov:     "moov",
+	actionRefuse:   "416",
+}
+
+func (a policyAction) String() string { return actionNames[a] }
+
+const (
+	// seqSlack is how far a sequential range may start from the end of the
+	// previous one, players overlap their requests a little.
+	seqSlack = 64 * 1024
+	// prefetchWindow is how far ahead of the previous range a prefetch starts.
+	prefetchWindow = 2 * sizePerRequst
+	// historyTTL is how long the history of an idle client is kept.
+	historyTTL = 10 * time.Minute
+)
+
+// clientHistory is what a client asked for so far.
+type clientHistory struct {
+	next     int64 // the end of the last range served, +1
+	requests int
+	seen     time.Time
+}
+
+// decision is what the policy makes of a range.
+type decision struct {
+	class  rangeClass
+	action policyAction
+	reason string
+}
+
+// rangePolicy classifies the ranges of each client and answers each class
+// with its action.
+type rangePolicy struct {
+	actions map[rangeClass]policyAction
+
+	mu      sync.Mutex
+	clients map[string]*clientHistory
+}
+
+// policy answers the ranges of rangeVideo, see -policy.
+var policy = newRangePolicy(nil)
+
+// newRangePolicy answers tail probes with the real tail and serves the rest,
+// unless actions says otherwise.
+func newRangePolicy(actions map[rangeClass]policyAction) *rangePolicy {
+	p := &rangePolicy{
+		actions: map[rangeClass]policyAction{classTailProbe: actionRealTail},
+		clients: map[string]*clientHistory{},
+	}
+	for c, a := range actions {
+		p.actions[c] = a
+	}
+	return p
+}
+
+// parsePolicy parses the actions of classes, e.g.
+// "tail-probe=moov,prefetch=416". Classes not given keep their default.
+func parsePolicy(s string) (*rangePolicy, error) {
+	actions := map[rangeClass]policyAction{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("policy %q: want class=action", kv)
+		}
+		c, ok := lookup(classNames, strings.TrimSpace(k))
+		if !ok {
+			return nil, fmt.Errorf("policy %q: class is one of sequential, seek, tail-probe, prefetch", kv)
+		}
+		a, ok := lookup(actionNames, strings.TrimSpace(v))
+		if !ok {
+			return nil, fmt.Errorf("policy %q: action is one of serve, tail, moov, 416", kv)
+		}
+		actions[c] = a
+	}
+	return newRangePolicy(actions), nil
+}
+
+func lookup[K comparable](names map[K]string, name string) (K, bool) {
+	for k, n := range names {
+		if n == name {
+			return k, true
+		}
+	}
+	var zero K
+	return zero, false
+}
+
+func (p *rangePolicy) String() string {
+	var parts []string
+	for _, c := range []rangeClass{classSequential, classSeek, classTailProbe, classPrefetch} {
+		parts = append(parts, fmt.Sprintf("%s=%s", c, p.actions[c]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// classify judges ra of a client with history h, nil for its first request,
+// told the stream is claimed bytes long.
+func classify(h *clientHistory, ra httpRange, claimed int64) (rangeClass, string) {
+	end := ra.start + ra.length
+	switch {
+	case end >= claimed && ra.start > 0 && (h == nil || ra.start > h.next+seqSlack):
+		return classTailProbe, fmt.Sprintf("ends at the claimed size %d", claimed)
+	case h == nil && ra.start == 0:
+		return classSequential, "first range, from the start"
+	case h == nil:
+		return classSeek, fmt.Sprintf("first range, at %d", ra.start)
+	case ra.start >= h.next-seqSlack && ra.start <= h.next+seqSlack:
+		return classSequential, fmt.Sprintf("continues at %d after %d", ra.start, h.next)
+	case ra.start > h.next && ra.start-h.next <= prefetchWindow:
+		return classPrefetch, fmt.Sprintf("%d bytes ahead of %d", ra.start-h.next, h.next)
+	}
+	return classSeek, fmt.Sprintf("jumps from %d to %d", h.next, ra.start)
+}
+
+// decide classifies ra of client, and records it unless it is a tail probe,
+// which doesn't move the playhead.
+func (p *rangePolicy) decide(client string, ra httpRange, claimed int64) decision {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, h := range p.clients {
+		if now.Sub(h.seen) > historyTTL {
+			delete(p.clients, k)
+		}
+	}
+	h := p.clients[client]
+	class, reason := classify(h, ra, claimed)
+	if class != classTailProbe {
+		if h == nil {
+			h = &clientHistory{}
+			p.clients[client] = h
+		}
+		h.next = ra.start + ra.length
+	}
+	if h != nil {
+		h.requests++
+		h.seen = now
+	}
+	return decision{class: class, action: p.actions[class], reason: reason}
+}
+
+// findMoov is the moov box among the top-level boxes of the size bytes of r,
+// nil if there is none.
+func findMoov(r io.ReaderAt, size int64) ([]byte, error) {
+	var hdr [16]byte
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := r.ReadAt(hdr[:8], offset); err != nil {
+			return nil, err
+		}
+		boxSize, hdrSize := int64(binary.BigEndian.Uint32(hdr[:4])), int64(8)
+		switch boxSize {
+		case 0: // to the end
+			boxSize = size - offset
+		case 1: // 64-bit size
+			if _, err := r.ReadAt(hdr[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			boxSize, hdrSize = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if boxSize < hdrSize || offset+boxSize > size {
+			return nil, fmt.Errorf("box %q at %d: bad size %d", hdr[4:8], offset, boxSize)
+		}
+		if string(hdr[4:8]) == "moov" {
+			moov := make([]byte, boxSize)
+			_, err := r.ReadAt(moov, offset)
+			return moov, err
+		}
+		offset += boxSize
+	}
+	return nil, nil
+}
+
+// syntheticMoov is n bytes of MP4 boxes: moov, if it fits, then a free box
+// a demuxer skips. Below 8 bytes, there is no room for a box.
+func syntheticMoov(moov []byte, n int64) []byte {
+	b := make([]byte, n)
+	if int64(len(moov)) == n || int64(len(moov))+8 <= n {
+		copy(b, moov)
+	} else {
+		moov = nil
+	}
+	if free := b[len(moov):]; len(free) >= 8 {
+		binary.BigEndian.PutUint32(free, uint32(len(free)))
+		copy(free[4:], "free")
+	}
+	return b
+}
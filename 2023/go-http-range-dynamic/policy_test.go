@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	const claimed = largeEnoughLen
+	p := newRangePolicy(nil)
+	for _, tt := range []struct {
+		start, length int64
+		want          rangeClass
+	}{
+		{0, sizePerRequst, classSequential},
+		{sizePerRequst, sizePerRequst, classSequential},
+		{claimed - 1000, 1000, classTailProbe},
+		{2*sizePerRequst - 1000, sizePerRequst, classSequential}, // the probe left the playhead
+		{4 * sizePerRequst, sizePerRequst, classPrefetch},
+		{100 * sizePerRequst, sizePerRequst, classSeek},
+		{10 * sizePerRequst, sizePerRequst, classSeek}, // back
+		{11 * sizePerRequst, claimed - 11*sizePerRequst, classSequential},
+	} {
+		d := p.decide("192.0.2.1", httpRange{start: tt.start, length: tt.length}, claimed)
+		if d.class != tt.want || d.reason == "" {
+			t.Errorf("range %d+%d: %s (%s), want %s", tt.start, tt.length, d.class, d.reason, tt.want)
+		}
+	}
+	if d := p.decide("192.0.2.2", httpRange{start: claimed - 10, length: 10}, claimed); d.class != classTailProbe || d.action != actionRealTail {
+		t.Errorf("first range of another client at the end: %s %s", d.class, d.action)
+	}
+	if d := p.decide("192.0.2.3", httpRange{start: 1000, length: 10}, claimed); d.class != classSeek {
+		t.Errorf("first range of a client: %s", d.class)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := parsePolicy("tail-probe=moov, prefetch=416")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != "sequential=serve,seek=serve,tail-probe=moov,prefetch=416" {
+		t.Errorf("policy %s", got)
+	}
+	for _, s := range []string{"tail-probe", "probe=moov", "seek=skip"} {
+		if _, err := parsePolicy(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestSyntheticMoov(t *testing.T) {
+	moov := mp4Box("moov", []byte("tracks"))
+	stream := bytes.Join([][]byte{mp4Box("ftyp", []byte("isom")), mp4Box("mdat", make([]byte, 100)), moov}, nil)
+	found, err := findMoov(bytes.NewReader(stream), int64(len(stream)))
+	if err != nil || !bytes.Equal(found, moov) {
+		t.Fatalf("findMoov: %q, %v", found, err)
+	}
+	if found, err := findMoov(bytes.NewReader(stream[:20]), 20); found != nil || err == nil {
+		t.Errorf("findMoov of a cut stream: %q, %v", found, err)
+	}
+
+	for _, tt := range []struct {
+		n        int64
+		wantMoov bool
+		wantFree int
+	}{
+		{int64(len(moov)), true, 0},
+		{int64(len(moov)) + 100, true, 100},
+		{int64(len(moov)) + 4, false, len(moov) + 4}, // no room for a free box after moov
+		{4, false, 0},
+	} {
+		b := syntheticMoov(moov, tt.n)
+		if int64(len(b)) != tt.n || bytes.HasPrefix(b, moov) != tt.wantMoov {
+			t.Errorf("%d bytes: %q", tt.n, b)
+			continue
+		}
+		if tt.wantFree > 0 {
+			free := b[len(b)-tt.wantFree:]
+			if int(binary.BigEndian.Uint32(free)) != tt.wantFree || string(free[4:8]) != "free" {
+				t.Errorf("%d bytes: free box %q", tt.n, free[:8])
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// segment is a file of a segmentSource at its offset in the stream.
+type segment struct {
+	name         string
+	offset, size int64
+}
+
+// segmentSource is a byte stream made of files one after the other.
+type segmentSource interface {
+	// segments maps the stream as it is now onto its files, in order.
+	segments() ([]segment, error)
+}
+
+// segmentFiles is an ordered list of files.
+type segmentFiles []string
+
+func (s segmentFiles) segments() ([]segment, error) {
+	return mapSegments(s)
+}
+
+// segmentDir is a directory of segments in the order of their names, which
+// may keep receiving new ones, e.g. part-000, part-001.
+type segmentDir string
+
+func (d segmentDir) segments() ([]segment, error) {
+	entries, err := os.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries { // sorted by name
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, filepath.Join(string(d), e.Name()))
+		}
+	}
+	return mapSegments(names)
+}
+
+// segmentVersions is a stream that grows: each file is a longer version of
+// the one before. Its segments are those of the first version, a reader
+// moves on to the next one as it gets near the end of its own, see
+// rangeVideo and streamFragments.
+type segmentVersions []string
+
+func (v segmentVersions) segments() ([]segment, error) {
+	return v.at(0)
+}
+
+// at is the segments of version i.
+func (v segmentVersions) at(i int) ([]segment, error) {
+	return mapSegments(v[i : i+1])
+}
+
+// versionSegments is the segments of version i of source, those of a
+// segmentVersions, or else the only version of the source as it is now.
+func versionSegments(i int) ([]segment, error) {
+	if v, ok := source.(segmentVersions); ok {
+		return v.at(i)
+	}
+	return source.segments()
+}
+
+// lastVersion is the last version of source a reader can move on to, 0
+// unless it is a segmentVersions.
+func lastVersion() int {
+	if v, ok := source.(segmentVersions); ok {
+		return len(v) - 1
+	}
+	return 0
+}
+
+func mapSegments(names []string) ([]segment, error) {
+	segs := make([]segment, 0, len(names))
+	var offset int64
+	for _, name := range names {
+		finfo, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, segment{name: name, offset: offset, size: finfo.Size()})
+		offset += finfo.Size()
+	}
+	return segs, nil
+}
+
+// newSegmentSource is a segmentDir if spec is a directory, segmentVersions
+// if it is "grow:" and files separated by commas, else the list of files
+// spec separates by commas.
+func newSegmentSource(spec string) (segmentSource, error) {
+	if versions, ok := strings.CutPrefix(spec, "grow:"); ok {
+		src := segmentVersions(strings.Split(versions, ","))
+		if _, err := mapSegments(src); err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+	if finfo, err := os.Stat(spec); err == nil && finfo.IsDir() {
+		return segmentDir(spec), nil
+	}
+	src := segmentFiles(strings.Split(spec, ","))
+	if _, err := src.segments(); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// stream reads the segments of a map as one, its files are opened as reads
+// reach them.
+type stream struct {
+	segs  []segment
+	files []*os.File
+}
+
+func newStream(segs []segment) *stream {
+	return &stream{segs: segs, files: make([]*os.File, len(segs))}
+}
+
+func (s *stream) size() int64 {
+	if len(s.segs) == 0 {
+		return 0
+	}
+	last := s.segs[len(s.segs)-1]
+	return last.offset + last.size
+}
+
+// find is the index of the segment holding offset, len(s.segs) past the end.
+func (s *stream) find(offset int64) int {
+	return sort.Search(len(s.segs), func(i int) bool { return s.segs[i].offset+s.segs[i].size > offset })
+}
+
+// span names the segments of the bytes from offset on, for logs.
+func (s *stream) span(offset, length int64) string {
+	first, last := s.find(offset), s.find(offset+length-1)
+	if first == len(s.segs) {
+		return "none"
+	}
+	if last >= len(s.segs) {
+		last = len(s.segs) - 1
+	}
+	if first == last {
+		return filepath.Base(s.segs[first].name)
+	}
+	return fmt.Sprintf("%s..%s (%d)", filepath.Base(s.segs[first].name), filepath.Base(s.segs[last].name), last-first+1)
+}
+
+func (s *stream) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for i := s.find(off); n < len(p); i++ {
+		if i >= len(s.segs) {
+			return n, io.EOF
+		}
+		seg := s.segs[i]
+		if s.files[i] == nil {
+			f, err := os.Open(seg.name)
+			if err != nil {
+				return n, err
+			}
+			s.files[i] = f
+		}
+		at := off + int64(n) - seg.offset
+		m, err := s.files[i].ReadAt(p[n:n+int(min(int64(len(p)-n), seg.size-at))], at)
+		n += m
+		if errors.Is(err, io.EOF) {
+			// the segment shrank since it was mapped
+			return n, fmt.Errorf("%s: %w", seg.name, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *stream) Close() error {
+	for _, f := range s.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSegments writes parts as the files part-000, part-001, ... of dir.
+func writeSegments(t *testing.T, dir string, first int, parts ...string) {
+	t.Helper()
+	for i, p := range parts {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("part-%03d", first+i)), []byte(p), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStreamReadAt(t *testing.T) {
+	dir := t.TempDir()
+	parts := []string{"0123", "", "4567", "89", "", "", "abcdef", ""}
+	writeSegments(t, dir, 0, parts...)
+	all := strings.Join(parts, "")
+
+	segs, err := segmentDir(dir).segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newStream(segs)
+	defer f.Close()
+	if f.size() != int64(len(all)) {
+		t.Fatalf("size %d, want %d", f.size(), len(all))
+	}
+	for _, tt := range []struct {
+		off, n int
+		span   string
+	}{
+		{0, 4, "part-000"},               // a whole segment
+		{1, 2, "part-000"},               // within one
+		{2, 4, "part-000..part-002 (3)"}, // across an empty one
+		{3, 6, "part-000..part-003 (4)"},
+		{8, 4, "part-003..part-006 (4)"}, // across several empty ones
+		{0, len(all), "part-000..part-006 (7)"},
+		{15, 1, "part-006"}, // the last byte
+	} {
+		p := make([]byte, tt.n)
+		n, err := f.ReadAt(p, int64(tt.off))
+		if err != nil || n != tt.n || string(p) != all[tt.off:tt.off+tt.n] {
+			t.Errorf("ReadAt(%d, %d) = %d %q, %v, want %q", tt.n, tt.off, n, p[:n], err, all[tt.off:tt.off+tt.n])
+		}
+		if span := f.span(int64(tt.off), int64(tt.n)); span != tt.span {
+			t.Errorf("span(%d, %d) = %q, want %q", tt.off, tt.n, span, tt.span)
+		}
+	}
+
+	// past the end
+	p := make([]byte, 4)
+	if n, err := f.ReadAt(p, 14); n != 2 || err != io.EOF || string(p[:n]) != "ef" {
+		t.Errorf("ReadAt across the end = %d %q, %v", n, p[:n], err)
+	}
+	if n, err := f.ReadAt(p, 16); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v", n, err)
+	}
+	if span := f.span(16, 4); span != "none" {
+		t.Errorf("span past the end = %q", span)
+	}
+
+	// a segment that shrank since it was mapped
+	if err := os.Truncate(filepath.Join(dir, "part-003"), 1); err != nil {
+		t.Fatal(err)
+	}
+	p = make([]byte, 6)
+	if _, err := f.ReadAt(p, 6); err == nil || err == io.EOF {
+		t.Errorf("ReadAt of a shrunk segment: %v", err)
+	}
+}
+
+func TestSegmentDirGrows(t *testing.T) {
+	dir := t.TempDir()
+	writeSegments(t, dir, 0, "0123", "4567")
+	// hidden files and directories are not segments
+	os.WriteFile(filepath.Join(dir, ".part-002.tmp"), []byte("xx"), 0o644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	src, err := newSegmentSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		t.Helper()
+		segs, err := src.segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newStream(segs)
+		defer f.Close()
+		b, err := io.ReadAll(io.NewSectionReader(f, 0, f.size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if s := read(); s != "01234567" {
+		t.Errorf("stream %q", s)
+	}
+	writeSegments(t, dir, 2, "89", "", "ab")
+	if s := read(); s != "0123456789ab" {
+		t.Errorf("grown stream %q", s)
+	}
+}
+
+func TestSegmentSources(t *testing.T) {
+	dir := t.TempDir()
+	writeSegments(t, dir, 0, "0123", "0123456789")
+	a, b := filepath.Join(dir, "part-000"), filepath.Join(dir, "part-001")
+
+	src, err := newSegmentSource(a + "," + b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segs, _ := src.segments(); len(segs) != 2 || segs[1].offset != 4 || newStream(segs).size() != 14 {
+		t.Errorf("files %+v", segs)
+	}
+	if _, err := newSegmentSource(a + "," + filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing file is a source")
+	}
+
+	src, err = newSegmentSource("grow:" + a + "," + b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := src.(segmentVersions)
+	if segs, _ := v.segments(); newStream(segs).size() != 4 {
+		t.Errorf("first version %+v", segs)
+	}
+	if segs, _ := v.at(1); newStream(segs).size() != 10 {
+		t.Errorf("last version %+v", segs)
+	}
+}
+
+// TestRangeVideoSegments serves ranges across segments from /.
+func TestRangeVideoSegments(t *testing.T) {
+	dir := t.TempDir()
+	var all bytes.Buffer
+	for i := range 5 {
+		part := bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+		all.Write(part)
+		writeSegments(t, dir, i, string(part))
+	}
+	writeSegments(t, dir, 5, "")
+	defer func(src segmentSource) { source = src }(source)
+	source = segmentDir(dir)
+
+	size := all.Len()
+	for _, tt := range []struct {
+		rangeHeader string
+		from, to    int
+	}{
+		{"bytes=0-", 0, size},
+		{"bytes=990-1010", 990, 1011},
+		{"bytes=500-3500", 500, 3501},
+		{"bytes=-10", size - 10, size},
+		{fmt.Sprintf("bytes=%d-", size-1), size - 1, size},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Range", tt.rangeHeader)
+		rec := httptest.NewRecorder()
+		rangeVideo(rec, req)
+		want := fmt.Sprintf("bytes %d-%d/%d", tt.from, tt.to-1, size)
+		if rec.Code != 206 || rec.Header().Get("Content-Range") != want || !bytes.Equal(rec.Body.Bytes(), all.Bytes()[tt.from:tt.to]) {
+			t.Errorf("%s: %d %q, %d bytes, want %q", tt.rangeHeader, rec.Code, rec.Header().Get("Content-Range"), rec.Body.Len(), want)
+		}
+	}
+}
+
+// TestRangeVideoVersions serves the versions of a "grow:" source: each
+// session starts at the first and moves on to the next near its end.
+func TestRangeVideoVersions(t *testing.T) {
+	dir := t.TempDir()
+	part := bytes.Repeat([]byte("0123456789"), 100)
+	full := append(bytes.Repeat([]byte("abcdefghij"), 100), bytes.Repeat([]byte("ABCDEFGHIJ"), 100)...)
+	writeSegments(t, dir, 0, string(part), string(full))
+	defer func(src segmentSource) { source = src }(source)
+	source = segmentVersions{filepath.Join(dir, "part-000"), filepath.Join(dir, "part-001")}
+
+	get := func(target, rangeHeader string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		rangeVideo(rec, req)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, contentRange string, body []byte) {
+		t.Helper()
+		if rec.Code != 206 || rec.Header().Get("Content-Range") != contentRange || !bytes.Equal(rec.Body.Bytes(), body) {
+			t.Errorf("%d %q %.20q, want %q %.20q", rec.Code, rec.Header().Get("Content-Range"), rec.Body, contentRange, body)
+		}
+	}
+
+	// a session reading on from the end of the first version gets the next
+	rec := get("/", "")
+	expect(rec, "bytes 0-999/1000", part)
+	cookies := rec.Result().Cookies()
+	expect(get("/", "bytes=1000-", cookies...), "bytes 1000-1999/2000", full[1000:])
+	expect(get("/", "bytes=0-9", cookies...), "bytes 0-9/2000", full[:10])
+
+	// while a new one starts at the first
+	expect(get("/", ""), "bytes 0-999/1000", part)
+
+	// a tail probe doesn't move a session on
+	rec = get("/?length=4000", "bytes=-10")
+	expect(rec, "bytes 3990-3999/4000", part[990:])
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	if v := sessions.version(req); v != 0 {
+		t.Errorf("tail probe moved the session on to version %d", v)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// sessionTTL is how long an idle session is kept.
+	sessionTTL = 10 * time.Minute
+	// sessionSettle shrinks the virtual length of a session to the real size
+	// once the stream hasn't grown for that long, 0 never does.
+	sessionSettle time.Duration
+	// maxSessions caps the sessions kept, a new one beyond it replaces the
+	// one seen least recently.
+	maxSessions = 10000
+)
+
+// sessionCookie carries the session of a client, the query parameter
+// "session" does too, for clients without cookies.
+const sessionCookie = "range-session"
+
+// sessionIDLen is the length of the IDs of newSessionID, in hex digits.
+const sessionIDLen = 16
+
+// session is the virtual length a client is told, kept the same across its
+// requests until the stream changes under it.
+type session struct {
+	ID       string    `json:"id"`
+	Dynamic  bool      `json:"dynamic"` // told a length beyond the stream
+	Length   int64     `json:"length"`  // of Content-Range
+	Real     int64     `json:"real"`    // size of the stream last seen
+	Offset   int64     `json:"offset"`  // end of the last range served
+	Version  int       `json:"version"` // of a "grow:" source it reads
+	Requests int       `json:"requests"`
+	Changes  int       `json:"changes"` // of Length
+	Created  time.Time `json:"created"`
+	Seen     time.Time `json:"seen"`
+	grown    time.Time // when Real last changed
+}
+
+// sessionStore are the live sessions by ID.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+var sessions = &sessionStore{sessions: map[string]*session{}}
+
+// virtualLength is the length told for a stream of size bytes: the size,
+// or in dynamic mode the next multiple of largeEnoughLen beyond it.
+func virtualLength(size int64, dynamic bool) int64 {
+	if !dynamic {
+		return size
+	}
+	return (size/largeEnoughLen + 1) * largeEnoughLen
+}
+
+// negotiate finds or starts the session of req and agrees the length it is
+// told for a stream of size bytes. Only IDs of the sessions kept are taken,
+// any other gets a new session of a new ID. A new session starts at the
+// virtualLength, dynamic with -dynamic or ?dynamic=true, or at ?length=.
+// The length grows if the stream outgrows it, and shrinks if the stream
+// shrinks or, with sessionSettle, stops growing. It returns a copy of the
+// session.
+func (s *sessionStore) negotiate(w http.ResponseWriter, req *http.Request, size int64) session {
+	id := requestSession(req)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	sess, ok := s.sessions[id]
+	if !ok {
+		id = newSessionID()
+		dynamic := isFakeDynamic
+		if b, err := strconv.ParseBool(req.URL.Query().Get("dynamic")); err == nil {
+			dynamic = b
+		}
+		length := virtualLength(size, dynamic)
+		if n, err := strconv.ParseInt(req.URL.Query().Get("length"), 10, 64); err == nil && n > size {
+			length = n
+		}
+		sess = &session{ID: id, Dynamic: dynamic, Length: length, Real: size, Created: now, grown: now}
+		s.evict()
+		s.sessions[id] = sess
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		fmt.Printf("session %s: starts at length %d, %d real\n", id, length, size)
+	}
+	sess.Requests++
+	sess.Seen = now
+	sess.resize(size, now)
+	return *sess
+}
+
+// resize agrees the length of the session for a stream now of size bytes.
+func (sess *session) resize(size int64, now time.Time) {
+	old := sess.Length
+	switch {
+	case size > sess.Length:
+		sess.Length = virtualLength(size, sess.Dynamic)
+		fmt.Printf("session %s: grows from %d to %d, the stream has %d bytes\n", sess.ID, old, sess.Length, size)
+	case size < sess.Real:
+		sess.Length = virtualLength(size, sess.Dynamic)
+		fmt.Printf("session %s: shrinks from %d to %d, the stream shrank from %d to %d bytes\n", sess.ID, old, sess.Length, sess.Real, size)
+	case sessionSettle > 0 && sess.Length > size && now.Sub(sess.grown) >= sessionSettle:
+		sess.Length = size
+		fmt.Printf("session %s: shrinks from %d to the real %d, the stream didn't grow for %s\n", sess.ID, old, size, sessionSettle)
+	}
+	if sess.Length != old {
+		sess.Changes++
+	}
+	if size != sess.Real {
+		sess.Real, sess.grown = size, now
+	}
+}
+
+// requestSession is the session ID req carries, if any is of the form of
+// newSessionID.
+func requestSession(req *http.Request) string {
+	id := req.URL.Query().Get("session")
+	if c, err := req.Cookie(sessionCookie); id == "" && err == nil {
+		id = c.Value
+	}
+	if len(id) != sessionIDLen || strings.Trim(id, "0123456789abcdef") != "" {
+		return ""
+	}
+	return id
+}
+
+// version is the version of the source the session of req reads, 0 for a
+// new session.
+func (s *sessionStore) version(req *http.Request) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[requestSession(req)]; ok {
+		return sess.Version
+	}
+	return 0
+}
+
+// grown moves the session on to version of the source, of size bytes, and
+// returns the length it is told from now on.
+func (s *sessionStore) grown(id string, version int, size int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return size
+	}
+	sess.Version = version
+	sess.resize(size, time.Now())
+	return sess.Length
+}
+
+// served records where the last range of the session ended.
+func (s *sessionStore) served(id string, end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		sess.Offset = end
+	}
+}
+
+func (s *sessionStore) expire(now time.Time) {
+	for id, sess := range s.sessions {
+		if now.Sub(sess.Seen) > sessionTTL {
+			delete(s.sessions, id)
+			fmt.Printf("session %s: expired after %d requests\n", id, sess.Requests)
+		}
+	}
+}
+
+// evict drops the session seen least recently if there are maxSessions.
+func (s *sessionStore) evict() {
+	if len(s.sessions) < maxSessions {
+		return
+	}
+	var oldest *session
+	for _, sess := range s.sessions {
+		if oldest == nil || sess.Seen.Before(oldest.Seen) {
+			oldest = sess
+		}
+	}
+	delete(s.sessions, oldest.ID)
+	fmt.Printf("session %s: dropped after %d requests, %d sessions kept\n", oldest.ID, oldest.Requests, maxSessions)
+}
+
+func newSessionID() string {
+	b := make([]byte, sessionIDLen/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// serveSessions lists the live sessions as JSON, the most recent first.
+func (s *sessionStore) serveSessions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.expire(time.Now())
+	list := make([]session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		list = append(list, *sess)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Seen.After(list[j].Seen) })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(list)
+}
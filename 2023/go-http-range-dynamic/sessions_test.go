@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionNegotiate(t *testing.T) {
+	s := &sessionStore{sessions: map[string]*session{}}
+	negotiate := func(target string, cookie string, size int64) (session, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("GET", target, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", sessionCookie+"="+cookie)
+		}
+		rec := httptest.NewRecorder()
+		return s.negotiate(rec, req, size), rec
+	}
+
+	a, rec := negotiate("/?dynamic=true", "", 1000)
+	if a.Length != largeEnoughLen || len(rec.Result().Cookies()) != 1 {
+		t.Fatalf("new dynamic session %+v, cookies %v", a, rec.Result().Cookies())
+	}
+	if a, _ = negotiate("/", a.ID, 5000); a.Length != largeEnoughLen || a.Requests != 2 {
+		t.Errorf("grown stream within the length: %+v", a)
+	}
+	if a, _ = negotiate("/", a.ID, largeEnoughLen+1); a.Length != 2*largeEnoughLen || a.Changes != 1 {
+		t.Errorf("stream beyond the length: %+v", a)
+	}
+	if a, _ = negotiate("/?session="+a.ID, "", 3000); a.Length != largeEnoughLen || a.Changes != 2 {
+		t.Errorf("shrunk stream: %+v", a)
+	}
+
+	b, _ := negotiate("/?length=4000", "", 3000)
+	if b.Length != 4000 || b.Dynamic {
+		t.Errorf("session asking for a length: %+v", b)
+	}
+	if b, _ = negotiate("/", b.ID, 4500); b.Length != 4500 {
+		t.Errorf("stream beyond the asked length: %+v", b)
+	}
+
+	settle := sessionSettle
+	sessionSettle = time.Nanosecond
+	defer func() { sessionSettle = settle }()
+	if a, _ = negotiate("/", a.ID, 3000); a.Length != 3000 {
+		t.Errorf("settled stream: %+v", a)
+	}
+
+	s.served(a.ID, 2000)
+	rec = httptest.NewRecorder()
+	s.serveSessions(rec, httptest.NewRequest("GET", "/admin/sessions", nil))
+	var list []session
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 2 || list[0].ID != a.ID || list[0].Offset != 2000 {
+		t.Errorf("sessions %+v, %v", list, err)
+	}
+
+	s.sessions[b.ID].Seen = time.Now().Add(-2 * sessionTTL)
+	if c, _ := negotiate("/", b.ID, 3000); c.Requests != 1 || c.ID == b.ID {
+		t.Errorf("expired session kept: %+v", c)
+	}
+
+	// IDs the store didn't issue get new ones
+	for _, id := range []string{"0123456789abcdef", "not-a-session", strings.Repeat("x", 64), "0123456789ABCDEF"} {
+		c, rec := negotiate("/?session="+id, "", 3000)
+		if c.ID == id || c.Requests != 1 || len(c.ID) != sessionIDLen {
+			t.Errorf("session %q: %+v", id, c)
+		}
+		if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != c.ID {
+			t.Errorf("session %q: cookies %v", id, cookies)
+		}
+	}
+
+	// beyond maxSessions, the one seen least recently goes
+	defer func(n int) { maxSessions = n }(maxSessions)
+	maxSessions = len(s.sessions)
+	s.sessions[a.ID].Seen = time.Now().Add(-time.Minute)
+	negotiate("/", "", 3000)
+	if _, ok := s.sessions[a.ID]; ok || len(s.sessions) != maxSessions {
+		t.Errorf("%d sessions, the oldest one kept: %v", len(s.sessions), ok)
+	}
+}
+
+// TestRangeVideoClaimed checks that a session told a length gets answers
+// against it, never the real size.
+func TestRangeVideoClaimed(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 300)
+	name := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(name, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(src segmentSource, p *rangePolicy) { source, policy = src, p }(source, policy)
+	source = segmentFiles{name}
+
+	for _, tt := range []struct {
+		policy, rangeHeader string
+		code                int
+		contentRange        string
+		body                []byte
+	}{
+		{"", "bytes=-10", 206, "bytes 3990-3999/4000", content[2990:]}, // the real tail
+		{"", "bytes=3500-3599", 416, "bytes */4000", nil},
+		{"", "bytes=5000-", 416, "bytes */4000", nil},
+		{"seek=416", "bytes=100-199", 416, "bytes */4000", nil},
+		{"", "bytes=100-199", 206, "bytes 100-199/4000", content[100:200]},
+		// the hint of a request without Range is a range from 0
+		{"", "", 206, "bytes 0-2999/4000", content},
+		{"sequential=416", "", 416, "bytes */4000", nil},
+	} {
+		var err error
+		if policy, err = parsePolicy(tt.policy); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/?length=4000", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		rangeVideo(rec, req)
+		if rec.Code != tt.code || rec.Header().Get("Content-Range") != tt.contentRange || (tt.body != nil && !bytes.Equal(rec.Body.Bytes(), tt.body)) {
+			t.Errorf("%s %s: %d %q %.20q, want %d %q", tt.policy, tt.rangeHeader, rec.Code, rec.Header().Get("Content-Range"), rec.Body, tt.code, tt.contentRange)
+		}
+		if strings.Contains(rec.Body.String(), "3000") {
+			t.Errorf("%s %s: the real size leaks: %q", tt.policy, tt.rangeHeader, rec.Body)
+		}
+	}
+}
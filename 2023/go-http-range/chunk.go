@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// chunker decides how many bytes are sent for a request without Range and
+// for an open-ended "bytes=N-" range.
+var chunker chunkPolicy = fixedChunk(sizePerRequst)
+
+// minChunkSize keeps computed chunk sizes from going absurdly small.
+const minChunkSize = 64 * 1000
+
+// chunkPolicy computes the chunk size of a file.
+type chunkPolicy interface {
+	// chunkSize returns the chunk size of f, the file name in the media
+	// directory, and the policy that decided it, with the position of f
+	// restored to the start of the file.
+	chunkSize(f io.ReadSeeker, name string, finfo fs.FileInfo, ctype string) (int64, chunkPolicy)
+	String() string
+}
+
+// fixedChunk sends the same number of bytes for every file.
+type fixedChunk int64
+
+func (c fixedChunk) chunkSize(io.ReadSeeker, string, fs.FileInfo, string) (int64, chunkPolicy) {
+	return int64(c), c
+}
+
+func (c fixedChunk) String() string { return "fixed:" + formatByteSize(int64(c)) }
+
+// percentChunk sends a percentage of the file.
+type percentChunk float64
+
+func (c percentChunk) chunkSize(_ io.ReadSeeker, _ string, finfo fs.FileInfo, _ string) (int64, chunkPolicy) {
+	return max(int64(float64(finfo.Size())*float64(c)/100), minChunkSize), c
+}
+
+func (c percentChunk) String() string {
+	return "percent:" + strconv.FormatFloat(float64(c), 'f', -1, 64) + "%"
+}
+
+// bitrateChunk sends about d of playback per chunk, using the average bitrate
+// of the file. Files without a known duration fall back to fallback.
+type bitrateChunk struct {
+	d        time.Duration
+	fallback chunkPolicy
+}
+
+func (c bitrateChunk) chunkSize(f io.ReadSeeker, name string, finfo fs.FileInfo, ctype string) (int64, chunkPolicy) {
+	if ctype != "video/mp4" && ctype != "audio/mp4" && ctype != "video/quicktime" {
+		return c.fallback.chunkSize(f, name, finfo, ctype)
+	}
+	duration, err := mp4DurationOf(f, name, finfo)
+	if err != nil {
+		return c.fallback.chunkSize(f, name, finfo, ctype)
+	}
+	return max(int64(float64(finfo.Size())*c.d.Seconds()/duration.Seconds()), minChunkSize), c
+}
+
+// durationEntry is the duration of a file as of its size and modtime, or
+// why it has none.
+type durationEntry struct {
+	size     int64
+	modtime  time.Time
+	duration time.Duration
+	err      error
+}
+
+var durationCache = struct {
+	sync.Mutex
+	m map[string]durationEntry
+}{m: map[string]durationEntry{}}
+
+// mp4DurationOf returns the cached duration of name, or reads its moov if
+// the file changed since, restoring the position of f to the start.
+func mp4DurationOf(f io.ReadSeeker, name string, finfo fs.FileInfo) (time.Duration, error) {
+	durationCache.Lock()
+	e, ok := durationCache.m[name]
+	durationCache.Unlock()
+	if ok && e.size == finfo.Size() && e.modtime.Equal(finfo.ModTime()) {
+		return e.duration, e.err
+	}
+
+	duration, err := mp4Duration(f, finfo.Size())
+	if _, serr := f.Seek(0, io.SeekStart); serr != nil {
+		// f is unusable, not the file, so don't remember it
+		return 0, serr
+	}
+	durationCache.Lock()
+	durationCache.m[name] = durationEntry{size: finfo.Size(), modtime: finfo.ModTime(), duration: duration, err: err}
+	durationCache.Unlock()
+	return duration, err
+}
+
+func (c bitrateChunk) String() string { return "bitrate:" + c.d.String() }
+
+// mimeChunk picks a policy by the Content-Type of the file. The keys are
+// media types like "video/mp4" or wildcards like "video/*".
+type mimeChunk struct {
+	types    map[string]chunkPolicy
+	fallback chunkPolicy
+}
+
+func (c mimeChunk) policy(ctype string) chunkPolicy {
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if p, ok := c.types[mediaType]; ok {
+		return p
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	if p, ok := c.types[major+"/*"]; ok {
+		return p
+	}
+	return c.fallback
+}
+
+func (c mimeChunk) chunkSize(f io.ReadSeeker, name string, finfo fs.FileInfo, ctype string) (int64, chunkPolicy) {
+	return c.policy(ctype).chunkSize(f, name, finfo, ctype)
+}
+
+func (c mimeChunk) String() string {
+	var entries []string
+	for t, p := range c.types {
+		entries = append(entries, t+"="+p.String())
+	}
+	sort.Strings(entries)
+	return strings.Join(append(entries, c.fallback.String()), ",")
+}
+
+// parseChunkPolicy parses a comma separated list of policies, each with an
+// optional media type, e.g. "video/*=10s,audio/mpeg=1MB,5%". A policy is a
+// byte size (fixed), a percentage of the file, or a playback duration
+// (bitrate). The entry without a media type is the default.
+func parseChunkPolicy(s string) (chunkPolicy, error) {
+	var fallback chunkPolicy = fixedChunk(sizePerRequst)
+	types := map[string]chunkPolicy{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		mediaType, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			spec, mediaType = mediaType, ""
+		}
+		p, err := parseSinglePolicy(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		if mediaType == "" {
+			fallback = p
+		} else {
+			types[strings.TrimSpace(mediaType)] = p
+		}
+	}
+	for t, p := range types {
+		if b, ok := p.(bitrateChunk); ok {
+			b.fallback = fallback
+			types[t] = b
+		}
+	}
+	if b, ok := fallback.(bitrateChunk); ok {
+		b.fallback = fixedChunk(sizePerRequst)
+		fallback = b
+	}
+	if len(types) == 0 {
+		return fallback, nil
+	}
+	return mimeChunk{types: types, fallback: fallback}, nil
+}
+
+func parseSinglePolicy(s string) (chunkPolicy, error) {
+	switch {
+	case strings.HasSuffix(s, "%"):
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid chunk percentage %q", s)
+		}
+		return percentChunk(pct), nil
+	case strings.HasSuffix(s, "s"):
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid chunk duration %q", s)
+		}
+		return bitrateChunk{d: d}, nil
+	}
+	n, err := parseByteSize(s)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %q", s)
+	}
+	return fixedChunk(n), nil
+}
+
+// chunkConfig is the config file format of chunk policies, e.g.
+//
+//	{"default": "5MB", "types": {"video/*": "10s", "audio/mpeg": "1MB"}}
+type chunkConfig struct {
+	Default string            `json:"default"`
+	Types   map[string]string `json:"types"`
+}
+
+func loadChunkConfig(name string) (chunkPolicy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var cfg chunkConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path.Base(name), err)
+	}
+	entries := []string{cfg.Default}
+	for t, p := range cfg.Types {
+		entries = append(entries, t+"="+p)
+	}
+	return parseChunkPolicy(strings.Join(entries, ","))
+}
+
+// parseByteSize parses sizes like "5MB", "256k", "1.5MiB" or "1000".
+// Units without "i" are decimal.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s[i:])), "b")
+	multiplier, ok := map[string]float64{
+		"": 1, "k": 1e3, "m": 1e6, "g": 1e9,
+		"ki": 1 << 10, "mi": 1 << 20, "gi": 1 << 30,
+	}[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1e9 && n%1e7 == 0:
+		return strconv.FormatFloat(float64(n)/1e9, 'f', -1, 64) + "GB"
+	case n >= 1e6 && n%1e4 == 0:
+		return strconv.FormatFloat(float64(n)/1e6, 'f', -1, 64) + "MB"
+	case n >= 1e3 && n%10 == 0:
+		return strconv.FormatFloat(float64(n)/1e3, 'f', -1, 64) + "KB"
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
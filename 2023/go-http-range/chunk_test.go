@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"1000": 1000, "5MB": 5e6, "5M": 5e6, "256k": 256e3, "256KB": 256e3,
+		"1.5MiB": 1.5 * (1 << 20), "2 GiB": 2 << 30, "10b": 10,
+	} {
+		if got, err := parseByteSize(s); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "5XB", "-1"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("parseByteSize(%q) should fail", s)
+		}
+	}
+}
+
+func TestChunkPolicy(t *testing.T) {
+	// a 10 seconds long "movie" of 1MB
+	movie := box("ftyp", []byte("isom"))
+	movie = append(movie, box("moov", mvhd(1000, 10000))...)
+	movie = append(movie, box("mdat", make([]byte, 1e6-len(movie)-8))...)
+	fsys := fstest.MapFS{
+		"movie.mp4": {Data: movie},
+		"song.mp3":  {Data: make([]byte, 1e6)},
+		"notes.txt": {Data: make([]byte, 1e6)},
+	}
+	chunkOf := func(p chunkPolicy, name, ctype string) (int64, string) {
+		f, finfo, err := openfile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		n, used := p.chunkSize(f, name, finfo, ctype)
+		if pos, _ := f.Seek(0, 1); pos != 0 {
+			t.Errorf("%s: position of file is %d after chunkSize", used, pos)
+		}
+		return n, used.String()
+	}
+
+	tests := []struct {
+		spec, name, ctype string
+		want              int64
+		wantPolicy        string
+	}{
+		{"2MB", "movie.mp4", "video/mp4", 2e6, "fixed:2MB"},
+		{"10%", "movie.mp4", "video/mp4", 1e5, "percent:10%"},
+		{"1%", "movie.mp4", "video/mp4", minChunkSize, "percent:1%"},
+		{"2s", "movie.mp4", "video/mp4", 2e5, "bitrate:2s"},
+		{"2s", "song.mp3", "audio/mpeg", sizePerRequst, "fixed:5MB"},
+		{"video/*=2s,audio/mpeg=100KB,1MB", "movie.mp4", "video/mp4", 2e5, "bitrate:2s"},
+		{"video/*=2s,audio/mpeg=100KB,1MB", "song.mp3", "audio/mpeg", 1e5, "fixed:100KB"},
+		{"video/*=2s,audio/mpeg=100KB,1MB", "notes.txt", "text/plain; charset=utf-8", 1e6, "fixed:1MB"},
+		{"text/plain=50%", "notes.txt", "text/plain; charset=utf-8", 5e5, "percent:50%"},
+	}
+	for _, tt := range tests {
+		p, err := parseChunkPolicy(tt.spec)
+		if err != nil {
+			t.Fatalf("parseChunkPolicy(%q): %v", tt.spec, err)
+		}
+		if got, used := chunkOf(p, tt.name, tt.ctype); got != tt.want || used != tt.wantPolicy {
+			t.Errorf("%q of %s = %d by %s, want %d by %s", tt.spec, tt.name, got, used, tt.want, tt.wantPolicy)
+		}
+	}
+
+	for _, spec := range []string{"0", "120%", "-2s", "video/*=", "fast"} {
+		if _, err := parseChunkPolicy(spec); err == nil {
+			t.Errorf("parseChunkPolicy(%q) should fail", spec)
+		}
+	}
+}
+
+func TestBitrateChunkCache(t *testing.T) {
+	movie := func(ms uint32) []byte {
+		m := append(box("ftyp", []byte("isom")), box("moov", mvhd(1000, ms))...)
+		return append(m, box("mdat", make([]byte, 1e6-len(m)-8))...)
+	}
+	modtime := time.Now()
+	fsys := fstest.MapFS{"cached.mp4": {Data: movie(10000), ModTime: modtime}}
+	p := bitrateChunk{d: 2 * time.Second, fallback: fixedChunk(sizePerRequst)}
+	chunkOf := func() int64 {
+		f, finfo, err := openfile(fsys, "cached.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		n, _ := p.chunkSize(f, "cached.mp4", finfo, "video/mp4")
+		return n
+	}
+
+	if n := chunkOf(); n != 2e5 {
+		t.Fatalf("chunk = %d, want %d", n, int64(2e5))
+	}
+	// same size and modtime, the moov isn't read again
+	fsys["cached.mp4"].Data = movie(5000)
+	if n := chunkOf(); n != 2e5 {
+		t.Errorf("chunk of unchanged file = %d, want the cached %d", n, int64(2e5))
+	}
+	fsys["cached.mp4"].ModTime = modtime.Add(time.Second)
+	if n := chunkOf(); n != 4e5 {
+		t.Errorf("chunk of changed file = %d, want %d", n, int64(4e5))
+	}
+}
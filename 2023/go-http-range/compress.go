@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// compress negotiates a content coding for text files. Off by default, a
+// coding done on the fly has no byte ranges.
+var compress bool
+
+// codings are the content codings served from sidecar files, in the order
+// preferred when the client accepts several with the same q. Only gzip is
+// also done on the fly, there is no zstd or brotli in the standard library.
+var codings = []struct {
+	name, ext string
+}{
+	{"zstd", ".zst"},
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// isCompressible reports whether files of ctype are worth compressing.
+// Media files are compressed already.
+func isCompressible(ctype string) bool {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	ctype = strings.TrimSpace(ctype)
+	switch ctype {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml",
+		"application/x-subrip", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(ctype, "text/") || strings.HasSuffix(ctype, "+json") || strings.HasSuffix(ctype, "+xml")
+}
+
+// acceptEncoding parses an Accept-Encoding header into the q of each coding.
+func acceptEncoding(s string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, item := range strings.Split(s, ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.ToLower(textproto.TrimString(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.ToLower(textproto.TrimString(k)) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(textproto.TrimString(v), 64); err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// qOf is the q of coding in accepted, a coding not listed gets the q of "*".
+func qOf(accepted map[string]float64, coding string) float64 {
+	if q, ok := accepted[coding]; ok {
+		return q
+	}
+	return accepted["*"]
+}
+
+// identityAcceptable reports whether the file may be sent as is. RFC 9110
+// 12.5.3 only rules that out by "identity;q=0", or "*;q=0" without identity.
+func identityAcceptable(accepted map[string]float64) bool {
+	if q, ok := accepted["identity"]; ok {
+		return q > 0
+	}
+	if q, ok := accepted["*"]; ok {
+		return q > 0
+	}
+	return true
+}
+
+// negotiateEncoding picks the content coding of name for the Accept-Encoding
+// header of a request. Without that header the file is sent as
+// is, like most servers do although RFC 9110 would allow any coding.
+//
+// A sidecar file (name.gz, name.zst or name.br) older than name is stale and
+// skipped. If no sidecar fits but gzip is acceptable, gzip is returned with a
+// nil sidecar, meaning the file has to be compressed on the fly. If no coding
+// fits and identity isn't acceptable either, ok is false.
+func negotiateEncoding(fsys fs.FS, name string, finfo fs.FileInfo, header string) (coding string, sidecar mediaFile, sinfo fs.FileInfo, ok bool) {
+	if header == "" {
+		return "", nil, nil, true
+	}
+	accepted := acceptEncoding(header)
+	bestQ := 0.0
+	for _, c := range codings {
+		q := qOf(accepted, c.name)
+		if q <= bestQ || q < qOf(accepted, "identity") {
+			continue
+		}
+		f, info, err := openfile(fsys, name+c.ext)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Before(finfo.ModTime()) {
+			f.Close()
+			continue
+		}
+		if sidecar != nil {
+			sidecar.Close()
+		}
+		coding, sidecar, sinfo, bestQ = c.name, f, info, q
+	}
+	if sidecar != nil {
+		return coding, sidecar, sinfo, true
+	}
+	if qOf(accepted, "gzip") > 0 && qOf(accepted, "gzip") >= qOf(accepted, "identity") {
+		return "gzip", nil, nil, true
+	}
+	return "", nil, nil, identityAcceptable(accepted)
+}
+
+// encodingETag is the ETag of the coding representation of a file, so that
+// a range of one coding is never spliced with a range of another one.
+func encodingETag(finfo fs.FileInfo, coding string) string {
+	tag := etag(finfo)
+	return tag[:len(tag)-1] + "-" + coding + `"`
+}
+
+// serveGzip compresses f on the fly. The size of the encoded representation
+// isn't known before it's sent, so there is neither Content-Length nor byte
+// ranges of it: Range is ignored and the whole file is sent with a 200, which
+// RFC 9110 allows.
+func serveGzip(w http.ResponseWriter, req *http.Request, f io.Reader, finfo fs.FileInfo) {
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, f); err != nil {
+		logf("gzip of %d bytes: %v\n", finfo.Size(), err)
+	}
+	gz.Close()
+}
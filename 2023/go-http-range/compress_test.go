@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	accepted := acceptEncoding("gzip;q=0.5, BR ; q=0, *;q=0.1, zstd;q=x")
+	for coding, want := range map[string]float64{"gzip": 0.5, "br": 0, "deflate": 0.1, "zstd": 0} {
+		if q := qOf(accepted, coding); q != want {
+			t.Errorf("q of %s = %v, want %v", coding, q, want)
+		}
+	}
+}
+
+func TestIdentityAcceptable(t *testing.T) {
+	for header, want := range map[string]bool{
+		"gzip": true, "identity;q=0": false, "*;q=0": false, "*;q=0, identity": true,
+		"identity;q=0, *": false, "br;q=0": true,
+	} {
+		if got := identityAcceptable(acceptEncoding(header)); got != want {
+			t.Errorf("identity acceptable by %q = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestRangeEncoded(t *testing.T) {
+	defer func(c bool) { compress = c }(compress)
+	compress = true
+	dir := t.TempDir()
+	text := []byte(strings.Repeat(`{"level":"info","msg":"segment served"}`+"\n", 200))
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(text)
+	w.Close()
+	zst := bytes.Repeat([]byte("not really zstd "), 10) // sidecars are sent as they are
+	for name, data := range map[string][]byte{"log.ndjson": text, "log.ndjson.gz": gz.Bytes(), "log.ndjson.zst": zst} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modtime := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "log.ndjson"), modtime, modtime)
+	fsys := os.DirFS(dir)
+	get := func(acceptEncoding, rangeHeader, ifRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/log.ndjson", nil)
+		for k, v := range map[string]string{"Accept-Encoding": acceptEncoding, "Range": rangeHeader, "If-Range": ifRange} {
+			if v != "" {
+				req.Header.Set(k, v)
+			}
+		}
+		rec := httptest.NewRecorder()
+		rangeVideo(rec, req, fsys, "log.ndjson")
+		return rec
+	}
+
+	tags := map[string]string{}
+	for _, tt := range []struct {
+		acceptEncoding, coding string
+		encoded                []byte
+	}{
+		{"", "", text},
+		{"identity", "", text},
+		{"gzip", "gzip", gz.Bytes()},
+		{"gzip, zstd", "zstd", zst},
+		{"zstd;q=0.5, gzip", "gzip", gz.Bytes()},
+	} {
+		// ranges apply to the encoded bytes
+		rec := get(tt.acceptEncoding, "bytes=10-19", "")
+		if rec.Code != 206 || rec.Header().Get("Content-Encoding") != tt.coding {
+			t.Fatalf("Accept-Encoding %q: status %d, Content-Encoding %q, want %q",
+				tt.acceptEncoding, rec.Code, rec.Header().Get("Content-Encoding"), tt.coding)
+		}
+		if cr := rec.Header().Get("Content-Range"); cr != "bytes 10-19/"+strconv.Itoa(len(tt.encoded)) {
+			t.Errorf("Accept-Encoding %q: Content-Range %q", tt.acceptEncoding, cr)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), tt.encoded[10:20]) || rec.Header().Get("Content-Length") != "10" {
+			t.Errorf("Accept-Encoding %q: body %q, Content-Length %s", tt.acceptEncoding, rec.Body, rec.Header().Get("Content-Length"))
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary %q", tt.acceptEncoding, rec.Header().Get("Vary"))
+		}
+		tags[tt.coding] = rec.Header().Get("Etag")
+	}
+	// every coding is its own representation with its own ETag
+	if len(tags) != 3 || tags[""] == tags["gzip"] || tags["gzip"] == tags["zstd"] || tags[""] == tags["zstd"] {
+		t.Errorf("ETags of codings are not distinct: %v", tags)
+	}
+	// so a range of one coding can't be continued in another one
+	if rec := get("gzip", "bytes=10-19", tags["gzip"]); rec.Code != 206 {
+		t.Errorf("If-Range of the same coding: status %d", rec.Code)
+	}
+	if rec := get("zstd", "bytes=10-19", tags["gzip"]); rec.Code != 200 || !bytes.Equal(rec.Body.Bytes(), zst) {
+		t.Errorf("If-Range of another coding: status %d, want 200 of the whole zstd file", rec.Code)
+	}
+
+	// a sidecar older than the file is stale, and gzip is done on the fly,
+	// ignoring the range
+	old := modtime.Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "log.ndjson.gz"), old, old)
+	rec := get("gzip", "bytes=10-19", "")
+	if rec.Code != 200 || rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Content-Length") != "" {
+		t.Fatalf("on the fly gzip: status %d, headers %v", rec.Code, rec.Header())
+	}
+	if tag := rec.Header().Get("Etag"); !strings.HasPrefix(tag, "W/") || tag == "W/"+tags["gzip"] {
+		t.Errorf("on the fly gzip: Etag %s, want a weak one of its own", tag)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, text) {
+		t.Errorf("on the fly gzip: decoded %d bytes, want %d", len(got), len(text))
+	}
+	if rec := get("gzip", "", ""); rec.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("on the fly gzip advertises Accept-Ranges")
+	}
+
+	// neither the file as is nor any coding is acceptable
+	for _, header := range []string{"identity;q=0, gzip;q=0", "br, *;q=0"} {
+		if rec := get(header, "bytes=10-19", ""); rec.Code != 406 {
+			t.Errorf("Accept-Encoding %q: status %d, want 406", header, rec.Code)
+		}
+	}
+	if rec := get("identity;q=0, gzip", "bytes=10-19", ""); rec.Code != 200 || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("identity;q=0, gzip: status %d, Content-Encoding %q, want gzip", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+}
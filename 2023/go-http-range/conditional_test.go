@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRangeVideoPreconditions(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "video.mp4")
+	if err := os.WriteFile(name, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(name, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	finfo, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := etag(finfo)
+	lastModified := modtime.Format(http.TimeFormat)
+	before := modtime.Add(-time.Hour).Format(http.TimeFormat)
+	after := modtime.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		method       string
+		header       map[string]string
+		wantCode     int
+		wantBody     string
+		contentRange string
+	}{
+		{"range", "GET", map[string]string{"Range": "bytes=2-4"}, 206, "234", "bytes 2-4/10"},
+
+		{"if-range etag match", "GET", map[string]string{"Range": "bytes=2-4", "If-Range": tag}, 206, "234", "bytes 2-4/10"},
+		{"if-range etag mismatch", "GET", map[string]string{"Range": "bytes=2-4", "If-Range": `"stale"`}, 200, "0123456789", ""},
+		{"if-range weak etag", "GET", map[string]string{"Range": "bytes=2-4", "If-Range": "W/" + tag}, 200, "0123456789", ""},
+		{"if-range date match", "GET", map[string]string{"Range": "bytes=2-4", "If-Range": lastModified}, 206, "234", "bytes 2-4/10"},
+		{"if-range date mismatch", "GET", map[string]string{"Range": "bytes=2-4", "If-Range": before}, 200, "0123456789", ""},
+
+		{"if-none-match hit", "GET", map[string]string{"If-None-Match": tag}, 304, "", ""},
+		{"if-none-match weak hit", "GET", map[string]string{"If-None-Match": "W/" + tag}, 304, "", ""},
+		{"if-none-match star", "HEAD", map[string]string{"If-None-Match": "*"}, 304, "", ""},
+		{"if-none-match list", "GET", map[string]string{"If-None-Match": `"a", ` + tag}, 304, "", ""},
+		{"if-none-match miss", "GET", map[string]string{"Range": "bytes=0-0", "If-None-Match": `"a"`}, 206, "0", "bytes 0-0/10"},
+		{"if-none-match non-GET", "POST", map[string]string{"If-None-Match": tag}, 412, "", ""},
+
+		{"if-modified-since not modified", "GET", map[string]string{"If-Modified-Since": lastModified}, 304, "", ""},
+		{"if-modified-since modified", "GET", map[string]string{"Range": "bytes=0-0", "If-Modified-Since": before}, 206, "0", "bytes 0-0/10"},
+		{"if-none-match wins over if-modified-since", "GET", map[string]string{"Range": "bytes=0-0", "If-None-Match": `"a"`, "If-Modified-Since": after}, 206, "0", "bytes 0-0/10"},
+
+		{"if-match hit", "GET", map[string]string{"Range": "bytes=9-", "If-Match": tag}, 206, "9", "bytes 9-9/10"},
+		{"if-match star", "GET", map[string]string{"Range": "bytes=9-", "If-Match": "*"}, 206, "9", "bytes 9-9/10"},
+		{"if-match miss", "GET", map[string]string{"If-Match": `"stale"`}, 412, "", ""},
+		{"if-match weak", "GET", map[string]string{"If-Match": "W/" + tag}, 412, "", ""},
+
+		{"if-unmodified-since ok", "GET", map[string]string{"Range": "bytes=-2", "If-Unmodified-Since": after}, 206, "89", "bytes 8-9/10"},
+		{"if-unmodified-since failed", "GET", map[string]string{"If-Unmodified-Since": before}, 412, "", ""},
+		{"if-match wins over if-unmodified-since", "GET", map[string]string{"Range": "bytes=-2", "If-Match": tag, "If-Unmodified-Since": before}, 206, "89", "bytes 8-9/10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			rangeVideo(rec, req, os.DirFS(dir), "video.mp4")
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if got := rec.Header().Get("Etag"); got != tag {
+				t.Errorf("Etag = %q, want %q", got, tag)
+			}
+			if rec.Code == 304 && rec.Header().Get("Content-Type") != "" {
+				t.Errorf("304 carries Content-Type %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"sync"
+	"time"
+)
+
+// faststart presents MP4 files with moov after mdat as if moov came first,
+// so browsers don't have to fetch the tail of the file before playing.
+var faststart bool
+
+// faststartContent returns what rangeVideo serves for f. That is a virtual
+// file with moov moved to the front if faststart is on and f needs it, or f
+// itself. The returned FileInfo has the size of the returned content.
+func faststartContent(f mediaFile, finfo fs.FileInfo, name, ctype string) (io.ReadSeeker, fs.FileInfo, bool) {
+	if !faststart || (ctype != "video/mp4" && ctype != "audio/mp4" && ctype != "video/quicktime") {
+		return f, finfo, false
+	}
+	layout, err := faststartLayoutOf(f, finfo, name)
+	if err != nil {
+		logf("faststart %s: %v\n", name, err)
+		return f, finfo, false
+	}
+	if layout == nil {
+		return f, finfo, false
+	}
+	return &virtualFile{r: f, parts: layout.parts, size: layout.size}, virtualFileInfo{finfo, layout.size}, true
+}
+
+// faststartETag is the ETag of the faststart version of a file, which has
+// different bytes than the file itself.
+func faststartETag(finfo fs.FileInfo) string {
+	tag := etag(finfo)
+	return tag[:len(tag)-1] + `-faststart"`
+}
+
+// virtualFileInfo is the FileInfo of a file with another size.
+type virtualFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (v virtualFileInfo) Size() int64 { return v.size }
+
+// virtualPart is a part of a virtualFile, either data in memory, or length
+// bytes of the underlying file starting at srcOffset.
+type virtualPart struct {
+	offset    int64 // in the virtual file
+	length    int64
+	data      []byte
+	srcOffset int64
+}
+
+// virtualFile is a read only file made of parts.
+type virtualFile struct {
+	r      io.ReadSeeker
+	parts  []virtualPart
+	size   int64
+	offset int64
+}
+
+func (v *virtualFile) Read(p []byte) (int, error) {
+	if v.offset >= v.size {
+		return 0, io.EOF
+	}
+	var part *virtualPart
+	for i := range v.parts {
+		if v.offset < v.parts[i].offset+v.parts[i].length {
+			part = &v.parts[i]
+			break
+		}
+	}
+	pos := v.offset - part.offset
+	n := int(min(int64(len(p)), part.length-pos))
+	if part.data != nil {
+		n = copy(p[:n], part.data[pos:])
+	} else {
+		if _, err := v.r.Seek(part.srcOffset+pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		var err error
+		if n, err = v.r.Read(p[:n]); err != nil && !(err == io.EOF && n > 0) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	v.offset += int64(n)
+	return n, nil
+}
+
+func (v *virtualFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += v.offset
+	case io.SeekEnd:
+		offset += v.size
+	}
+	if offset < 0 {
+		return 0, errors.New("virtualFile.Seek: negative position")
+	}
+	v.offset = offset
+	return offset, nil
+}
+
+// faststartLayout is the layout of the faststart version of a file.
+type faststartLayout struct {
+	size    int64
+	modtime time.Time
+	srcSize int64
+	parts   []virtualPart
+}
+
+var faststartCache = struct {
+	sync.Mutex
+	m map[string]*faststartLayout
+}{m: map[string]*faststartLayout{}}
+
+// faststartLayoutOf returns the cached layout of name, or builds it if the
+// file changed since. A nil layout means the file is faststart already.
+func faststartLayoutOf(f io.ReadSeeker, finfo fs.FileInfo, name string) (*faststartLayout, error) {
+	faststartCache.Lock()
+	layout, ok := faststartCache.m[name]
+	faststartCache.Unlock()
+	if ok && layout.srcSize == finfo.Size() && layout.modtime.Equal(finfo.ModTime()) {
+		if layout.parts == nil {
+			return nil, nil
+		}
+		return layout, nil
+	}
+
+	layout, err := buildFaststartLayout(f, finfo.Size())
+	if err != nil {
+		return nil, err
+	}
+	layout.srcSize, layout.modtime = finfo.Size(), finfo.ModTime()
+	faststartCache.Lock()
+	faststartCache.m[name] = layout
+	faststartCache.Unlock()
+	if layout.parts == nil {
+		return nil, nil
+	}
+	return layout, nil
+}
+
+// buildFaststartLayout moves moov in front of the first mdat, and shifts
+// the chunk offsets in moov by how far their mdat moved.
+func buildFaststartLayout(r io.ReadSeeker, size int64) (*faststartLayout, error) {
+	boxes, err := children(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	moovIdx, mdatIdx := -1, -1
+	for i, b := range boxes {
+		switch {
+		case b.typ == "moov" && moovIdx < 0:
+			moovIdx = i
+		case b.typ == "mdat" && mdatIdx < 0:
+			mdatIdx = i
+		}
+	}
+	if moovIdx < 0 || mdatIdx < 0 {
+		return nil, errors.New("mp4: no moov or mdat")
+	}
+	if moovIdx < mdatIdx {
+		return &faststartLayout{}, nil // faststart already
+	}
+	moov := boxes[moovIdx]
+	body, err := readBoxBody(r, moov)
+	if err != nil {
+		return nil, err
+	}
+
+	// bytes before moov move back by the size of the new moov, bytes after
+	// it by how much moov grew
+	newSize := moov.size
+	var newMoov []byte
+	for i := 0; ; i++ {
+		shift := func(offset int64) int64 {
+			if offset < moov.offset {
+				return offset + newSize
+			}
+			return offset + newSize - moov.size
+		}
+		if newMoov, err = rewriteChunkOffsets("moov", body, shift); err != nil {
+			return nil, err
+		}
+		if int64(len(newMoov)) == newSize {
+			break
+		}
+		if i == 3 {
+			return nil, errors.New("mp4: size of rewritten moov doesn't settle")
+		}
+		newSize = int64(len(newMoov))
+	}
+
+	layout := &faststartLayout{}
+	add := func(p virtualPart) {
+		p.offset = layout.size
+		layout.parts = append(layout.parts, p)
+		layout.size += p.length
+	}
+	if first := boxes[mdatIdx].offset; first > 0 {
+		add(virtualPart{length: first, srcOffset: 0})
+	}
+	add(virtualPart{length: int64(len(newMoov)), data: newMoov})
+	add(virtualPart{length: moov.offset - boxes[mdatIdx].offset, srcOffset: boxes[mdatIdx].offset})
+	if moov.end() < size {
+		add(virtualPart{length: size - moov.end(), srcOffset: moov.end()})
+	}
+	return layout, nil
+}
+
+// containerBoxes are the boxes on the way from moov to the chunk offsets.
+var containerBoxes = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true}
+
+// rewriteChunkOffsets returns box typ with body, where the offsets of every
+// stco and co64 inside are mapped by shift. A stco that would overflow is
+// turned into a co64.
+func rewriteChunkOffsets(typ string, body []byte, shift func(int64) int64) ([]byte, error) {
+	switch {
+	case containerBoxes[typ]:
+		var out []byte
+		for len(body) > 0 {
+			if len(body) < 8 {
+				return nil, fmt.Errorf("mp4: truncated box in %s", typ)
+			}
+			size, headerLen := int64(binary.BigEndian.Uint32(body)), int64(8)
+			childTyp := string(body[4:8])
+			switch size {
+			case 0:
+				size = int64(len(body))
+			case 1:
+				if len(body) < 16 {
+					return nil, fmt.Errorf("mp4: truncated box in %s", typ)
+				}
+				size, headerLen = int64(binary.BigEndian.Uint64(body[8:])), 16
+			}
+			if size < headerLen || size > int64(len(body)) {
+				return nil, fmt.Errorf("mp4: bad size %d of %s in %s", size, childTyp, typ)
+			}
+			child, err := rewriteChunkOffsets(childTyp, body[headerLen:size], shift)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, child...)
+			body = body[size:]
+		}
+		return encodeBox(typ, out), nil
+
+	case typ == "stco" || typ == "co64":
+		entrySize := 4
+		if typ == "co64" {
+			entrySize = 8
+		}
+		if len(body) < 8 {
+			return nil, fmt.Errorf("mp4: truncated %s", typ)
+		}
+		n := int(binary.BigEndian.Uint32(body[4:8]))
+		if len(body)-8 < n*entrySize {
+			return nil, fmt.Errorf("mp4: truncated %s", typ)
+		}
+		offsets := make([]int64, n)
+		fits32 := true
+		for i := range offsets {
+			if typ == "co64" {
+				offsets[i] = shift(int64(binary.BigEndian.Uint64(body[8+i*8:])))
+			} else {
+				offsets[i] = shift(int64(binary.BigEndian.Uint32(body[8+i*4:])))
+			}
+			fits32 = fits32 && offsets[i] <= math.MaxUint32
+		}
+		out := append([]byte{}, body[:8]...)
+		if typ == "stco" && fits32 {
+			for _, o := range offsets {
+				out = binary.BigEndian.AppendUint32(out, uint32(o))
+			}
+			return encodeBox("stco", out), nil
+		}
+		for _, o := range offsets {
+			out = binary.BigEndian.AppendUint64(out, uint64(o))
+		}
+		return encodeBox("co64", out), nil
+	}
+	return encodeBox(typ, body), nil
+}
+
+func encodeBox(typ string, body []byte) []byte {
+	if 8+len(body) > math.MaxUint32 {
+		b := binary.BigEndian.AppendUint32(nil, 1)
+		b = append(b, typ...)
+		b = binary.BigEndian.AppendUint64(b, uint64(16+len(body)))
+		return append(b, body...)
+	}
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 8+len(body)), uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
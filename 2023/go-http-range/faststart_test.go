@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFaststartLayout(t *testing.T) {
+	movie := buildMP4(testTracks(), false)
+	layout, err := buildFaststartLayout(bytes.NewReader(movie), int64(len(movie)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// moving moov to the front gives the file buildMP4 lays out that way
+	want := buildMP4(testTracks(), true)
+	if layout.size != int64(len(want)) {
+		t.Fatalf("virtual size %d, want %d", layout.size, len(want))
+	}
+	vf := &virtualFile{r: bytes.NewReader(movie), parts: layout.parts, size: layout.size}
+	got, err := io.ReadAll(vf)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("virtual file differs from moov first file, err %v", err)
+	}
+	for _, off := range []int64{0, 5, 40, int64(len(want)) - 300, int64(len(want)) - 1} {
+		vf.Seek(off, io.SeekStart)
+		buf := make([]byte, 100)
+		n, _ := io.ReadFull(vf, buf)
+		if !bytes.Equal(buf[:n], want[off:min(off+100, int64(len(want)))]) {
+			t.Errorf("read at %d differs", off)
+		}
+	}
+
+	layout, err = buildFaststartLayout(bytes.NewReader(want), int64(len(want)))
+	if err != nil || layout.parts != nil {
+		t.Errorf("moov first file got layout %+v, %v", layout, err)
+	}
+}
+
+func TestRewriteChunkOffsetsToCo64(t *testing.T) {
+	stco := fullBox("stco", u32s(2, 100, 200))
+	out, err := rewriteChunkOffsets("stbl", stco, func(o int64) int64 { return o + math.MaxUint32 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 8+8+8+16 || string(out[12:16]) != "co64" {
+		t.Fatalf("got %x, want a co64 in stbl", out)
+	}
+	if o := binary.BigEndian.Uint64(out[32:]); o != 200+math.MaxUint32 {
+		t.Errorf("second offset %d", o)
+	}
+}
+
+func TestRangeVideoFaststart(t *testing.T) {
+	dir := t.TempDir()
+	movie := buildMP4(testTracks(), false)
+	if err := os.WriteFile(filepath.Join(dir, "movie.mp4"), movie, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(b bool) { faststart = b }(faststart)
+	want := buildMP4(testTracks(), true)
+
+	for _, on := range []bool{false, true} {
+		faststart = on
+		req := httptest.NewRequest("GET", "/movie.mp4", nil)
+		req.Header.Set("Range", "bytes=30-1029")
+		rec := httptest.NewRecorder()
+		rangeVideo(rec, req, os.DirFS(dir), "movie.mp4")
+
+		body, tag := movie, rec.Header().Get("Etag")
+		if on {
+			body = want
+		}
+		if cr := rec.Header().Get("Content-Range"); cr != "bytes 30-1029/"+strconv.Itoa(len(body)) {
+			t.Errorf("faststart %v: Content-Range %q", on, cr)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), body[30:1030]) {
+			t.Errorf("faststart %v: body differs", on)
+		}
+		if strings.HasSuffix(tag, `-faststart"`) != on {
+			t.Errorf("faststart %v: Etag %s", on, tag)
+		}
+	}
+}
@@ -1,4 +1,18 @@
 module example.zeng.dev
 
-go 1.19
+go 1.25
 
+require (
+	example.zeng.dev/httprange v0.0.0
+	github.com/quic-go/quic-go v0.59.1
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
+
+replace example.zeng.dev/httprange => ../httprange
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsSegmentDuration is the target duration of HLS segments, 0 disables the
+// /hls/ playlists.
+var hlsSegmentDuration time.Duration
+
+// hlsSegment is a moof and its mdat in the fMP4 version of a file, starting
+// at a keyframe.
+type hlsSegment struct {
+	httpRange
+	duration float64 // seconds
+}
+
+// hlsIndex is the fragmented MP4 version of one version of a file: an init
+// segment of ftyp and a moov without samples, then a moof and mdat per
+// segment. The samples stay in the file, parts map the fMP4 bytes onto it.
+type hlsIndex struct {
+	size     int64 // of the file
+	modtime  time.Time
+	target   time.Duration
+	init     httpRange
+	segments []hlsSegment
+	parts    []virtualPart
+	fsize    int64 // of the fMP4 version
+}
+
+var hlsCache = struct {
+	sync.Mutex
+	m map[string]*hlsIndex
+}{m: map[string]*hlsIndex{}}
+
+// hlsIndexOf returns the cached segmentation of name, or computes it if the
+// file changed since.
+func hlsIndexOf(f io.ReadSeeker, finfo fs.FileInfo, name string) (*hlsIndex, error) {
+	hlsCache.Lock()
+	idx, ok := hlsCache.m[name]
+	hlsCache.Unlock()
+	if ok && idx.size == finfo.Size() && idx.modtime.Equal(finfo.ModTime()) && idx.target == hlsSegmentDuration {
+		return idx, nil
+	}
+
+	idx, err := segmentMP4(f, finfo.Size(), hlsSegmentDuration)
+	if err != nil {
+		return nil, err
+	}
+	idx.modtime = finfo.ModTime()
+	hlsCache.Lock()
+	hlsCache.m[name] = idx
+	hlsCache.Unlock()
+	return idx, nil
+}
+
+// segmentMP4 repackages a MP4 file as fragmented MP4, cut at keyframes of
+// its video track, starting a new segment once the current one is at least
+// target long. Every segment decodes on its own, as HLS wants.
+func segmentMP4(r io.ReadSeeker, size int64, target time.Duration) (*hlsIndex, error) {
+	tracks, err := readMP4Tracks(r, size)
+	if err != nil {
+		return nil, err
+	}
+	video := tracks[0]
+	for _, t := range tracks {
+		if t.handler == "vide" {
+			video = t
+			break
+		}
+	}
+	if video.timescale == 0 || len(video.samples) == 0 {
+		return nil, errors.New("mp4: empty track")
+	}
+	moov, err := findPath(r, size, "moov")
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBoxBody(r, moov)
+	if err != nil {
+		return nil, err
+	}
+	init, err := initMoov(body, tracks)
+	if err != nil {
+		return nil, err
+	}
+	init = append(encodeBox("ftyp", []byte("iso6\x00\x00\x02\x00iso6mp41isom")), init...)
+
+	idx := &hlsIndex{size: size, target: target}
+	idx.add(virtualPart{data: init})
+	idx.init = httpRange{start: 0, length: idx.fsize}
+
+	// cut at the keyframes of the video, in seconds
+	cuts := []float64{0}
+	for _, s := range video.samples {
+		if t := sampleSeconds(video, s.time); s.sync && t-cuts[len(cuts)-1] >= target.Seconds() {
+			cuts = append(cuts, t)
+		}
+	}
+	next := make([]int, len(tracks)) // the first sample of each track not in a segment yet
+	for k, t0 := range cuts {
+		t1 := math.Inf(1)
+		if k+1 < len(cuts) {
+			t1 = cuts[k+1]
+		}
+		var moof []byte
+		var dataOffsets []int // of the truns in moof
+		var samples [][]mp4Sample
+		duration := 0.0
+		for i, t := range tracks {
+			first := next[i]
+			for next[i] < len(t.samples) && sampleSeconds(t, t.samples[next[i]].time) < t1 {
+				next[i]++
+			}
+			if first == next[i] {
+				continue
+			}
+			traf, at := trackFragment(t, first, next[i])
+			dataOffsets = append(dataOffsets, len(moof)+at)
+			moof = append(moof, traf...)
+			samples = append(samples, t.samples[first:next[i]])
+			duration = max(duration, min(sampleSeconds(t, t.duration), t1)-t0)
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		seq := uint32(len(idx.segments) + 1)
+		mfhd := encodeFullBox("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, seq))
+		moof = encodeBox("moof", append(mfhd, moof...))
+		// the data offsets of trun are from the start of moof, the samples
+		// follow the 8 bytes header of mdat
+		dataOffset := int64(len(moof) + 8)
+		var mdat []virtualPart
+		var mdatSize int64
+		for i, ss := range samples {
+			binary.BigEndian.PutUint32(moof[8+len(mfhd)+dataOffsets[i]:], uint32(dataOffset+mdatSize))
+			for _, s := range ss {
+				if n := len(mdat); n > 0 && mdat[n-1].srcOffset+mdat[n-1].length == s.offset {
+					mdat[n-1].length += int64(s.size)
+				} else {
+					mdat = append(mdat, virtualPart{srcOffset: s.offset, length: int64(s.size)})
+				}
+				mdatSize += int64(s.size)
+			}
+		}
+		if mdatSize+8 > math.MaxUint32 {
+			return nil, fmt.Errorf("mp4: segment %d of %d bytes is too large", seq, mdatSize)
+		}
+		start := idx.fsize
+		idx.add(virtualPart{data: moof})
+		idx.add(virtualPart{data: append(binary.BigEndian.AppendUint32(nil, uint32(mdatSize+8)), "mdat"...)})
+		for _, p := range mdat {
+			idx.add(p)
+		}
+		idx.segments = append(idx.segments, hlsSegment{
+			httpRange: httpRange{start: start, length: idx.fsize - start},
+			duration:  duration,
+		})
+	}
+	return idx, nil
+}
+
+func (idx *hlsIndex) add(p virtualPart) {
+	p.offset = idx.fsize
+	if p.data != nil {
+		p.length = int64(len(p.data))
+	}
+	idx.parts = append(idx.parts, p)
+	idx.fsize += p.length
+}
+
+func sampleSeconds(t mp4Track, ts uint64) float64 {
+	return float64(ts) / float64(t.timescale)
+}
+
+// trackFragment is the traf of samples [first, last) of t, and where the
+// data offset of its trun is, to be set when the moof is complete.
+func trackFragment(t mp4Track, first, last int) ([]byte, int) {
+	// default-base-is-moof
+	tfhd := encodeFullBox("tfhd", 0, 0x020000, binary.BigEndian.AppendUint32(nil, t.id))
+	tfdt := encodeFullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, t.samples[first].time))
+	// data offset, then duration, size, flags and composition offset per sample
+	body := binary.BigEndian.AppendUint32(nil, uint32(last-first))
+	body = binary.BigEndian.AppendUint32(body, 0)
+	for i := first; i < last; i++ {
+		s := t.samples[i]
+		end := t.duration
+		if i+1 < len(t.samples) {
+			end = t.samples[i+1].time
+		}
+		flags := uint32(0x01010000) // depends on others, not a sync sample
+		if s.sync {
+			flags = 0x02000000 // depends on no other
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(end-s.time))
+		body = binary.BigEndian.AppendUint32(body, s.size)
+		body = binary.BigEndian.AppendUint32(body, flags)
+		body = binary.BigEndian.AppendUint32(body, uint32(s.cto))
+	}
+	trun := encodeFullBox("trun", 1, 0x000f01, body)
+	traf := encodeBox("traf", bytes.Join([][]byte{tfhd, tfdt, trun}, nil))
+	// traf header, tfhd, tfdt, trun header, sample count
+	return traf, 8 + len(tfhd) + len(tfdt) + 12 + 4
+}
+
+// initMoov is the moov of body without samples and with an mvex, for
+// fragments.
+func initMoov(body []byte, tracks []mp4Track) ([]byte, error) {
+	body, err := emptySampleTables(body)
+	if err != nil {
+		return nil, err
+	}
+	var mvex []byte
+	for _, t := range tracks {
+		// track, sample description 1, no defaults
+		trex := binary.BigEndian.AppendUint32(nil, t.id)
+		trex = append(trex, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+		mvex = append(mvex, encodeFullBox("trex", 0, 0, trex)...)
+	}
+	return encodeBox("moov", append(body, encodeBox("mvex", mvex)...)), nil
+}
+
+// emptySampleTables rewrites the boxes in body down to the sample tables,
+// which are emptied. Sample groups and dependencies are left out, fragments
+// don't have them.
+func emptySampleTables(body []byte) ([]byte, error) {
+	var out []byte
+	for len(body) > 0 {
+		b, err := readBoxHeader(bytes.NewReader(body), 0, int64(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		box := body[:b.size]
+		body = body[b.size:]
+		switch b.typ {
+		case "trak", "mdia", "minf", "stbl":
+			child, err := emptySampleTables(box[b.headerLen:])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, encodeBox(b.typ, child)...)
+		case "stts", "stsc", "stco", "co64":
+			if b.typ == "co64" {
+				b.typ = "stco"
+			}
+			out = append(out, encodeFullBox(b.typ, 0, 0, make([]byte, 4))...)
+		case "stsz":
+			out = append(out, encodeFullBox(b.typ, 0, 0, make([]byte, 8))...)
+		case "stss", "ctts", "sdtp", "sgpd", "sbgp", "stps", "cslg":
+		case "mvex":
+		default:
+			out = append(out, box...)
+		}
+	}
+	return out, nil
+}
+
+func encodeFullBox(typ string, version byte, flags uint32, body []byte) []byte {
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return encodeBox(typ, append(hdr, body...))
+}
+
+// writePlaylist writes the m3u8 media playlist of idx, every segment is a
+// byte range of uri, the fMP4 version of the file.
+func (idx *hlsIndex) writePlaylist(w io.Writer, uri string) {
+	targetDuration := 1
+	for _, s := range idx.segments {
+		targetDuration = max(targetDuration, int(math.Round(s.duration)))
+	}
+	// 6 for EXT-X-MAP without EXT-X-I-FRAMES-ONLY
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprint(w, "#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(w, "#EXT-X-MAP:URI=%q,BYTERANGE=\"%d@%d\"\n", uri, idx.init.length, idx.init.start)
+	for _, s := range idx.segments {
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", s.duration, s.length, s.start, uri)
+	}
+	fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+}
+
+// serveHLS serves the playlist of /hls/<name>.m3u8, and the fMP4 version of
+// the file at /hls/<name>, which players fetch the segments of by Range.
+func serveHLS(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	p := strings.TrimPrefix(r.URL.Path, "/hls")
+	playlist := strings.HasSuffix(p, ".m3u8")
+	name, ok := mediaName(strings.TrimSuffix(p, ".m3u8"))
+	if !ok || name == "." {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	f, finfo, err := openfile(fsys, name)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	defer f.Close()
+
+	start := time.Now()
+	idx, err := hlsIndexOf(f, finfo, name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("can not segment %s: %v", name, err), http.StatusUnprocessableEntity)
+		return
+	}
+	if !playlist {
+		serveFragmented(w, r, &virtualFile{r: f, parts: idx.parts, size: idx.fsize}, virtualFileInfo{finfo, idx.fsize})
+		return
+	}
+	logf("\nhls playlist of %s: %d segments, %v\n", name, len(idx.segments), time.Since(start))
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	idx.writePlaylist(w, href("/hls/"+name))
+}
+
+// serveFragmented serves the fMP4 version of a file by range. Players ask for
+// the byte ranges of the playlist, which are never open-ended.
+func serveFragmented(w http.ResponseWriter, req *http.Request, content io.ReadSeeker, finfo fs.FileInfo) {
+	size := finfo.Size()
+	w.Header().Set("Content-Type", "video/mp4")
+	setValidators(w, finfo)
+	tag := etag(finfo)
+	w.Header().Set("Etag", tag[:len(tag)-1]+`-fmp4"`)
+	done, rangeHeader := checkPreconditions(w, req, finfo.ModTime())
+	if done {
+		return
+	}
+	if rangeHeader == "" {
+		serveFull(w, req, content, size)
+		return
+	}
+	ranges, err := parseRange(rangeHeader, size, size)
+	if err != nil {
+		rangeError(w, req, content, rangeHeader, size, err)
+		return
+	}
+	ranges = coalesceRanges(ranges)
+	if len(ranges) > maxRanges {
+		tooManyRanges(w, req, rangeHeader, len(ranges), size)
+		return
+	}
+	if len(ranges) > 1 {
+		serveMultipart(w, req, content, ranges, "video/mp4", size)
+		return
+	}
+	ra := ranges[0]
+	logf("hls fragments %s\n", ra.contentRange(size))
+	w.Header().Set("Content-Range", ra.contentRange(size))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method != "HEAD" {
+		content.Seek(ra.start, io.SeekStart)
+		if written, err := io.CopyN(w, content, ra.length); err != nil {
+			logf("desired range size: %d, actual written: %d, err: %v\n\n", ra.length, written, err)
+		}
+	}
+}
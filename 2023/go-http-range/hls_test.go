@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSegmentMP4(t *testing.T) {
+	movie := buildMP4(testTracks(), false)
+	idx, err := segmentMP4(bytes.NewReader(movie), int64(len(movie)), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.segments) != 2 {
+		t.Fatalf("got %d segments, want 2: %+v", len(idx.segments), idx.segments)
+	}
+	// segments follow the init segment and each other without gaps
+	if first := idx.segments[0]; first.start != idx.init.length || first.duration != 2 {
+		t.Errorf("first segment %+v, init %+v", first, idx.init)
+	}
+	if second := idx.segments[1]; second.start != idx.segments[0].start+idx.segments[0].length ||
+		second.duration != 2 || second.start+second.length != idx.fsize {
+		t.Errorf("second segment %+v of %d bytes", second, idx.fsize)
+	}
+
+	file, err := io.ReadAll(&virtualFile{r: bytes.NewReader(movie), parts: idx.parts, size: idx.fsize})
+	if err != nil || int64(len(file)) != idx.fsize {
+		t.Fatalf("read %d of %d bytes: %v", len(file), idx.fsize, err)
+	}
+	r := bytes.NewReader(file)
+	init, err := findPath(r, idx.init.length, "moov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := descend(r, init, "mvex", "trex"); err != nil {
+		t.Errorf("init segment: %v", err)
+	}
+	if stss, err := descend(r, init, "trak", "mdia", "minf", "stbl", "stss"); err == nil {
+		t.Errorf("init segment has samples: %+v", stss)
+	}
+	samples := map[int]int{} // per track
+	for _, s := range idx.segments {
+		checkFragment(t, file[s.start:s.start+s.length], samples)
+	}
+	if samples[1] != 40 || samples[2] != 20 {
+		t.Errorf("samples in segments %v", samples)
+	}
+}
+
+// checkFragment parses segment as a moof and its mdat, and checks every
+// sample of its truns is the next one of its track, counted in samples.
+func checkFragment(t *testing.T, segment []byte, samples map[int]int) {
+	t.Helper()
+	r := bytes.NewReader(segment)
+	boxes, err := children(r, 0, int64(len(segment)))
+	if err != nil || len(boxes) != 2 || boxes[0].typ != "moof" || boxes[1].typ != "mdat" {
+		t.Fatalf("segment is %+v, %v, want moof and mdat", boxes, err)
+	}
+	moof, mdat := boxes[0], boxes[1]
+	trafs, err := children(r, moof.bodyOffset(), moof.end())
+	if err != nil || trafs[0].typ != "mfhd" {
+		t.Fatalf("moof has %+v, %v", trafs, err)
+	}
+	for _, traf := range trafs[1:] {
+		tfhd, _ := descend(r, traf, "tfhd")
+		trun, _ := descend(r, traf, "trun")
+		body, _ := readBoxBody(r, trun)
+		id := int(binary.BigEndian.Uint32(segment[tfhd.bodyOffset()+4:]))
+		count := int(binary.BigEndian.Uint32(body[4:]))
+		offset := moof.offset + int64(binary.BigEndian.Uint32(body[8:]))
+		for i := 0; i < count; i++ {
+			size := int64(binary.BigEndian.Uint32(body[12+i*16+4:]))
+			n := samples[id]
+			if offset < mdat.bodyOffset() || offset+size > mdat.end() {
+				t.Fatalf("track %d sample %d at %d is out of mdat %+v", id, n, offset, mdat)
+			}
+			if sample := segment[offset : offset+size]; sample[0] != byte(id) || sample[1] != byte(n) {
+				t.Fatalf("track %d sample %d: % x", id, n, sample[:2])
+			}
+			samples[id]++
+			offset += size
+		}
+	}
+}
+
+func TestServeHLS(t *testing.T) {
+	dir := t.TempDir()
+	movie := buildMP4(testTracks(), true)
+	if err := os.WriteFile(filepath.Join(dir, "movie.mp4"), movie, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { hlsSegmentDuration = d }(hlsSegmentDuration)
+	hlsSegmentDuration = time.Second
+
+	rec := httptest.NewRecorder()
+	serveHLS(rec, httptest.NewRequest("GET", "/hls/movie.mp4.m3u8", nil), os.DirFS(dir))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	playlist := rec.Body.String()
+	for _, want := range []string{
+		"#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n",
+		`#EXT-X-MAP:URI="/hls/movie.mp4",BYTERANGE="`,
+		"#EXTINF:1.000,\n#EXT-X-BYTERANGE:",
+		"#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist misses %q:\n%s", want, playlist)
+		}
+	}
+	if n := strings.Count(playlist, "#EXTINF"); n != 4 {
+		t.Errorf("playlist has %d segments, want 4:\n%s", n, playlist)
+	}
+
+	// every segment of the playlist is served as a moof and its mdat
+	byteRange := regexp.MustCompile(`#EXT-X-BYTERANGE:(\d+)@(\d+)`)
+	samples := map[int]int{}
+	for _, m := range byteRange.FindAllStringSubmatch(playlist, -1) {
+		length, _ := strconv.ParseInt(m[1], 10, 64)
+		start, _ := strconv.ParseInt(m[2], 10, 64)
+		req := httptest.NewRequest("GET", "/hls/movie.mp4", nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+		rec := httptest.NewRecorder()
+		serveHLS(rec, req, os.DirFS(dir))
+		if rec.Code != 206 || int64(rec.Body.Len()) != length || rec.Header().Get("Content-Type") != "video/mp4" {
+			t.Fatalf("segment %s: %d, %d bytes, %s", m[0], rec.Code, rec.Body.Len(), rec.Header().Get("Content-Type"))
+		}
+		checkFragment(t, rec.Body.Bytes(), samples)
+	}
+	if samples[1] != 40 || samples[2] != 20 {
+		t.Errorf("samples in served segments %v", samples)
+	}
+
+	// the segmentation is cached per version of the file
+	hlsCache.Lock()
+	cached := hlsCache.m["movie.mp4"]
+	hlsCache.Unlock()
+	f, finfo, _ := openfile(os.DirFS(dir), "movie.mp4")
+	defer f.Close()
+	if idx, _ := hlsIndexOf(f, finfo, "movie.mp4"); idx != cached {
+		t.Error("segmentation is not cached")
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labSessions keeps the lab sessions, the player events a lab page sends to
+// /telemetry next to the responses its media requests got.
+var labSessions = &labStore{max: 100, sessions: map[string]*labSession{}}
+
+// maxLabRecords caps the events and responses kept of a session, a playing
+// video sends a progress event every few hundred milliseconds.
+const maxLabRecords = 10000
+
+// labEvent is an HTML5 media event as the lab page reports it.
+type labEvent struct {
+	Time         time.Time    `json:"time"`
+	Type         string       `json:"type"`
+	CurrentTime  float64      `json:"current_time"`
+	ReadyState   int          `json:"ready_state"`
+	NetworkState int          `json:"network_state"`
+	Buffered     [][2]float64 `json:"buffered,omitempty"`
+	Detail       string       `json:"detail,omitempty"`
+}
+
+// labResponse is a response to a media request of a lab page.
+type labResponse struct {
+	Time         time.Time `json:"time"`
+	Proto        string    `json:"proto"`
+	Method       string    `json:"method"`
+	Range        string    `json:"range,omitempty"`
+	Status       int       `json:"status"`
+	ContentRange string    `json:"content_range,omitempty"`
+	Bytes        int       `json:"bytes"`
+	DurationMs   float64   `json:"duration_ms"`
+}
+
+type labSession struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Preload   string        `json:"preload"`
+	Rate      string        `json:"rate,omitempty"`
+	Agent     string        `json:"agent"`
+	Start     time.Time     `json:"start"`
+	Events    []labEvent    `json:"events"`
+	Responses []labResponse `json:"responses"`
+}
+
+// labStore holds the max most recent sessions.
+type labStore struct {
+	mu       sync.Mutex
+	max      int
+	order    []string
+	sessions map[string]*labSession
+}
+
+func (st *labStore) create(s *labSession) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	s.ID, s.Start = hex.EncodeToString(b), time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.order) >= st.max {
+		delete(st.sessions, st.order[0])
+		st.order = st.order[1:]
+	}
+	st.order = append(st.order, s.ID)
+	st.sessions[s.ID] = s
+}
+
+// update calls f with session id locked, it reports whether there is one.
+func (st *labStore) update(id string, f func(s *labSession)) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[id]
+	if ok {
+		f(s)
+	}
+	return ok
+}
+
+// withLab keeps the responses to media requests of a lab page, the ones
+// with a ?lab= session, in the session.
+func withLab(ha func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("lab")
+		if id == "" {
+			ha(w, r)
+			return
+		}
+		start := time.Now()
+		ww := &basicWriter{ResponseWriter: w}
+		ha(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labSessions.update(id, func(s *labSession) {
+			if len(s.Responses) < maxLabRecords {
+				s.Responses = append(s.Responses, labResponse{
+					Time:         start,
+					Proto:        r.Proto,
+					Method:       r.Method,
+					Range:        r.Header.Get("Range"),
+					Status:       status,
+					ContentRange: ww.Header().Get("Content-Range"),
+					Bytes:        ww.BytesWritten(),
+					DurationMs:   float64(time.Since(start).Microseconds()) / 1000,
+				})
+			}
+		})
+	}
+}
+
+var labTmpl = template.Must(template.New("lab").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>lab {{.Name}}</title>
+<style>body{font-family:sans-serif} pre{height:20em;overflow:auto;background:#f4f4f4}</style>
+</head>
+<body data-session="{{.ID}}">
+<h1>{{.Name}}</h1>
+<form>
+preload <select name="preload">
+{{- range .PreloadModes}}
+<option{{if eq . $.Preload}} selected{{end}}>{{.}}</option>
+{{- end}}
+</select>
+rate <input name="rate" value="{{.Rate}}" placeholder="e.g. 256k or 3g" size="8">
+<button>new session</button>
+<a href="{{.Report}}">report</a>
+</form>
+{{- if .Audio}}
+<audio controls preload="{{.Preload}}" src="{{.Src}}"></audio>
+{{- else}}
+<video controls preload="{{.Preload}}" width="960" src="{{.Src}}"></video>
+{{- end}}
+<pre id="log"></pre>
+<script>
+const session = document.body.dataset.session;
+const media = document.querySelector("video, audio");
+const log = document.getElementById("log");
+let queue = [];
+
+function ranges(tr) {
+  const r = [];
+  for (let i = 0; i < tr.length; i++) r.push([tr.start(i), tr.end(i)]);
+  return r;
+}
+
+function flush(beacon) {
+  if (queue.length == 0) return;
+  const body = JSON.stringify({session: session, sent: Date.now(), events: queue});
+  queue = [];
+  if (beacon) {
+    navigator.sendBeacon("/telemetry", body);
+  } else {
+    fetch("/telemetry", {method: "POST", headers: {"Content-Type": "application/json"}, body: body});
+  }
+}
+
+for (const type of ["loadstart", "loadedmetadata", "loadeddata", "canplay", "canplaythrough", "play", "playing",
+    "pause", "waiting", "stalled", "suspend", "seeking", "seeked", "progress", "ratechange", "ended", "error", "abort", "emptied"]) {
+  media.addEventListener(type, () => {
+    const e = {
+      type: type,
+      t: Date.now(),
+      current_time: media.currentTime,
+      ready_state: media.readyState,
+      network_state: media.networkState,
+      buffered: ranges(media.buffered),
+      detail: media.error ? (media.error.message || "code " + media.error.code) : "",
+    };
+    queue.push(e);
+    log.textContent += new Date(e.t).toISOString().slice(11, 23) + " " + type + " t=" + e.current_time.toFixed(2) +
+      " buffered " + JSON.stringify(e.buffered) + "\n";
+    log.scrollTop = log.scrollHeight;
+  });
+}
+setInterval(flush, 1000);
+addEventListener("pagehide", () => flush(true));
+</script>
+</body>
+</html>
+`))
+
+var labPreloadModes = []string{"auto", "metadata", "none"}
+
+// serveLab serves the lab page of the media file at /lab/<name>, a player
+// with ?preload= and ?rate= reporting its events to /telemetry. Every load
+// of the page is a new session.
+func serveLab(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	name, ok := mediaName(strings.TrimPrefix(r.URL.Path, "/lab"))
+	if !ok || name == "." {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if _, err := fs.Stat(fsys, name); err != nil {
+		fsError(w, err)
+		return
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if !isMedia(ctype) {
+		http.Error(w, name+" is not a media file", http.StatusBadRequest)
+		return
+	}
+	s := &labSession{
+		Name:    name,
+		Preload: r.URL.Query().Get("preload"),
+		Rate:    r.URL.Query().Get("rate"),
+		Agent:   r.UserAgent(),
+	}
+	switch s.Preload {
+	case "auto", "metadata", "none":
+	default:
+		s.Preload = "metadata"
+	}
+	labSessions.create(s)
+
+	q := url.Values{"lab": {s.ID}}
+	if s.Rate != "" {
+		q.Set("rate", s.Rate)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	labTmpl.Execute(w, struct {
+		ID, Name, Src, Report, Preload, Rate string
+		PreloadModes                         []string
+		Audio                                bool
+	}{
+		ID:           s.ID,
+		Name:         name,
+		Src:          href("/"+name) + "?" + q.Encode(),
+		Report:       "/telemetry?session=" + s.ID,
+		Preload:      s.Preload,
+		Rate:         s.Rate,
+		PreloadModes: labPreloadModes,
+		Audio:        strings.HasPrefix(ctype, "audio/"),
+	})
+}
+
+// telemetryBatch is what the lab page posts to /telemetry, times in
+// milliseconds of the browser's clock.
+type telemetryBatch struct {
+	Session string `json:"session"`
+	Sent    int64  `json:"sent"`
+	Events  []struct {
+		labEvent
+		T int64 `json:"t"`
+	} `json:"events"`
+}
+
+// serveTelemetry takes the events of lab pages with POST, and reports a
+// session with GET ?session=, as HTML or with ?format=json as JSON.
+func serveTelemetry(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+	case "GET", "HEAD":
+		serveLabReport(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b telemetryBatch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&b); err != nil {
+		http.Error(w, "invalid telemetry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the browser and the server may disagree on the time, move the events
+	// onto the clock of the server, which the responses are timed by
+	skew := time.Duration(0)
+	if b.Sent > 0 {
+		skew = time.Since(time.UnixMilli(b.Sent))
+	}
+	ok := labSessions.update(b.Session, func(s *labSession) {
+		for _, e := range b.Events {
+			if len(s.Events) >= maxLabRecords {
+				break
+			}
+			e.labEvent.Time = time.UnixMilli(e.T).Add(skew)
+			s.Events = append(s.Events, e.labEvent)
+		}
+	})
+	if !ok {
+		http.Error(w, "unknown lab session", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// labRow is a line of a report, an event of the player or a response of
+// the server.
+type labRow struct {
+	Time     time.Time
+	OffsetMs float64
+	Player   string
+	Server   string
+}
+
+var labReportTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>lab session {{.S.ID}}</title>
+<style>body{font-family:sans-serif} td{font-family:monospace;padding:0 1em;vertical-align:top}</style>
+</head>
+<body>
+<h1>{{.S.Name}}, preload {{.S.Preload}}{{if .S.Rate}}, rate {{.S.Rate}}{{end}}</h1>
+<p>{{.S.Agent}}, started {{.S.Start.Format "2006-01-02 15:04:05"}},
+{{len .S.Events}} player events, {{len .S.Responses}} responses. <a href="?session={{.S.ID}}&amp;format=json">JSON</a></p>
+<table>
+<tr><th>+ms</th><th>player</th><th>server</th></tr>
+{{- range .Rows}}
+<tr><td>{{printf "%.0f" .OffsetMs}}</td><td>{{.Player}}</td><td>{{.Server}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+func serveLabReport(w http.ResponseWriter, r *http.Request) {
+	var s labSession
+	ok := labSessions.update(r.URL.Query().Get("session"), func(ls *labSession) {
+		s = *ls
+		s.Events = append([]labEvent(nil), ls.Events...)
+		s.Responses = append([]labResponse(nil), ls.Responses...)
+	})
+	if !ok {
+		http.Error(w, "unknown lab session", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	labReportTmpl.Execute(w, struct {
+		S    labSession
+		Rows []labRow
+	}{s, labRows(&s)})
+}
+
+// labRows merges the events and responses of s into one timeline.
+func labRows(s *labSession) []labRow {
+	var rows []labRow
+	for _, e := range s.Events {
+		what := fmt.Sprintf("%s t=%.2f ready=%d network=%d", e.Type, e.CurrentTime, e.ReadyState, e.NetworkState)
+		for _, b := range e.Buffered {
+			what += fmt.Sprintf(" [%.2f-%.2f]", b[0], b[1])
+		}
+		if e.Detail != "" {
+			what += " " + e.Detail
+		}
+		rows = append(rows, labRow{Time: e.Time, Player: what})
+	}
+	for _, resp := range s.Responses {
+		what := fmt.Sprintf("%s %s %s → %d", resp.Proto, resp.Method, resp.Range, resp.Status)
+		if resp.ContentRange != "" {
+			what += " " + resp.ContentRange
+		}
+		what += fmt.Sprintf(", %d bytes in %.0fms", resp.Bytes, resp.DurationMs)
+		rows = append(rows, labRow{Time: resp.Time, Server: what})
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Time.Before(rows[j].Time) })
+	for i := range rows {
+		rows[i].OffsetMs = float64(rows[i].Time.Sub(s.Start).Microseconds()) / 1000
+	}
+	return rows
+}
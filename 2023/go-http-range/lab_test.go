@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabSession(t *testing.T) {
+	quietLog(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "video.mp4"), make([]byte, 10000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fsys := os.DirFS(dir)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lab/", func(w http.ResponseWriter, r *http.Request) { serveLab(w, r, fsys) })
+	mux.HandleFunc("/telemetry", serveTelemetry)
+	mux.HandleFunc("/", withLab((&mediaHandler{fsys: fsys}).ServeHTTP))
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(httptest.NewRequest("GET", "/lab/video.mp4?preload=auto", nil))
+	m := regexp.MustCompile(`data-session="([0-9a-f]+)"[\s\S]*preload="auto" width="960" src="(/video.mp4\?lab=[0-9a-f]+)"`).FindStringSubmatch(rec.Body.String())
+	if rec.Code != 200 || m == nil {
+		t.Fatalf("lab page %d:\n%s", rec.Code, rec.Body)
+	}
+	id, src := m[1], m[2]
+
+	req := httptest.NewRequest("GET", src, nil)
+	req.Header.Set("Range", "bytes=0-")
+	if rec := do(req); rec.Code != 206 {
+		t.Fatalf("media request %d", rec.Code)
+	}
+	do(httptest.NewRequest("GET", "/video.mp4", nil)) // not of the session
+
+	// the browser's clock is an hour ahead
+	ahead := time.Now().Add(time.Hour)
+	batch := fmt.Sprintf(`{"session":%q,"sent":%d,"events":[
+		{"type":"loadstart","t":%d,"ready_state":0,"network_state":2},
+		{"type":"progress","t":%d,"current_time":0,"ready_state":4,"buffered":[[0,12.5]]}]}`,
+		id, ahead.UnixMilli(), ahead.Add(-time.Second).UnixMilli(), ahead.UnixMilli())
+	if rec := do(httptest.NewRequest("POST", "/telemetry", strings.NewReader(batch))); rec.Code != 204 {
+		t.Fatalf("telemetry %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(httptest.NewRequest("POST", "/telemetry", strings.NewReader(`{"session":"nope"}`))); rec.Code != 404 {
+		t.Errorf("telemetry of an unknown session %d", rec.Code)
+	}
+
+	var s labSession
+	rec = do(httptest.NewRequest("GET", "/telemetry?session="+id+"&format=json", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatalf("report %d: %v", rec.Code, err)
+	}
+	if s.Preload != "auto" || len(s.Events) != 2 || len(s.Responses) != 1 {
+		t.Fatalf("session %+v", s)
+	}
+	if r := s.Responses[0]; r.Range != "bytes=0-" || r.Status != 206 || r.ContentRange != "bytes 0-9999/10000" || r.Bytes != 10000 {
+		t.Errorf("response %+v", r)
+	}
+	if d := time.Since(s.Events[1].Time); d < -time.Minute || d > time.Minute {
+		t.Errorf("event not moved onto the server clock: %v", s.Events[1].Time)
+	}
+
+	rows := labRows(&s)
+	if len(rows) != 3 || rows[0].Player == "" || !strings.Contains(rows[2].Player, "[0.00-12.50]") {
+		t.Errorf("timeline %+v", rows)
+	}
+	rec = do(httptest.NewRequest("GET", "/telemetry?session="+id, nil))
+	if !strings.Contains(rec.Body.String(), "bytes 0-9999/10000") {
+		t.Errorf("HTML report without the response:\n%s", rec.Body)
+	}
+}
@@ -1,82 +1,291 @@
 package main
 
 import (
-	"errors"
 	"flag"
-	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
-	"net/textproto"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"time"
+
+	"example.zeng.dev/httprange"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replayMain(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	port := flag.String("p", "9100", "port to serve on")
-	directory := flag.String("d", "media/", "the directory of static file to host")
+	directory := flag.String("d", "media/", "the media to host: a directory, a .zip or .tar archive, or the http(s) URL of a bucket")
+	chunk := flag.String("chunk", "", `chunk policy of unbounded range requests, a size "5MB", a percentage "10%", `+
+		`seconds of playback "10s", optionally per media type "video/*=10s,audio/mpeg=1MB,5MB"`)
+	chunkConfig := flag.String("chunk-config", "", "JSON config file of chunk policy, overrides -chunk")
+	rate := flag.String("rate", "0", `bandwidth limit of the whole server per second, a size "256k" or a profile `+profileNames())
+	rateClient := flag.String("rate-client", "0", "bandwidth limit per remote address per second")
+	rateRequest := flag.String("rate-request", "0", "bandwidth limit per request per second, overridden by query ?rate=")
+	burst := flag.String("burst", "32KB", "burst size of bandwidth limits, overridden by query ?burst=")
+	flag.Float64Var(&throttle.jitter, "jitter", 0, "fraction 0-1 of random jitter added to throttle waits, overridden by query ?jitter=")
+	flag.IntVar(&teeHeadBytes, "tee-bytes", 0, "number of leading bytes of each response body hex dumped in the access log")
+	teeName := flag.String("tee-file", "", "file capturing all response bodies, rotated by -tee-file-size")
+	teeSize := flag.String("tee-file-size", "100MB", "size at which the -tee-file is rotated")
+	teeBackups := flag.Int("tee-file-backups", 3, "number of rotated -tee-file kept")
+	flag.BoolVar(&compress, "compress", false, "serve text files gzip/zstd/br encoded from sidecar files <file>.gz/.zst/.br, gzip on the fly otherwise")
+	flag.IntVar(&maxRanges, "max-ranges", maxRanges, "most ranges of a multipart/byteranges response after coalescing, more is answered with a 416")
+	flag.BoolVar(&faststart, "faststart", false, "serve MP4 files with moov after mdat as if moov came first")
+	flag.DurationVar(&hlsSegmentDuration, "hls", 0, "serve HLS playlists of MP4 files at /hls/<file>.m3u8, cut into segments of this duration, e.g. 6s")
+	tlsOn := flag.Bool("tls", false, "serve HTTPS with HTTP/1.1 and h2, with a self-signed certificate unless -cert and -key")
+	certFile := flag.String("cert", "", "PEM certificate file of -tls")
+	keyFile := flag.String("key", "", "PEM key file of -tls")
+	h2c := flag.Bool("h2c", false, "serve cleartext h2 with prior knowledge next to HTTP/1.1, without -tls")
+	h3 := flag.Bool("h3", false, "serve HTTP/3 on UDP port -p too, needs -tls")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "time to read the request headers, 0 is none")
+	readTimeout := flag.Duration("read-timeout", 0, "time to read a whole request, 0 is none")
+	writeTimeout := flag.Duration("write-timeout", 0, "time to write a response, 0 is none, cuts off chunks sent slower")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "time a keep-alive connection waits for the next request")
+	maxConns := flag.Int("max-conns", 0, "most TCP connections at a time, more wait to be accepted, 0 is no cap")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "most TCP connections of a client address, more are closed, 0 is no cap")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time the transfers in flight at SIGINT/SIGTERM may take to finish")
+	upload := flag.Bool("upload", false, "take resumable uploads into -d, PUT with Content-Range and tus PATCH")
+	uploadLimit := flag.String("upload-max", "0", "largest file taken by -upload, 0 is unlimited")
+	origin := flag.String("origin", "", "base URL of an origin server serving the media instead of -d, fetched in blocks and cached")
+	originCache := flag.String("origin-cache", filepath.Join(os.TempDir(), "go-http-range-cache"), "directory of the -origin block cache")
+	originBlock := flag.String("origin-block", "1MB", "size of the blocks fetched from -origin")
+	originMax := flag.String("origin-cache-size", "1GB", "size the -origin block cache is kept under by dropping the objects used least recently, 0 is unlimited")
+	originTTL := flag.Duration("origin-ttl", 10*time.Second, "how long -origin objects are served before asking the origin whether they changed")
+	record := flag.String("record", "", "JSON lines file recording the requests and responses of every client, for the replay command")
 	flag.Parse()
 
-	fs := withLog(http.FileServer(http.Dir(*directory)).ServeHTTP)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			rangeVideo(w, r)
-			return
+	var err error
+	var originBlockSize, originMaxSize int64
+	switch {
+	case *chunkConfig != "":
+		chunker, err = loadChunkConfig(*chunkConfig)
+	case *chunk != "":
+		chunker, err = parseChunkPolicy(*chunk)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range []struct {
+		s     string
+		v     *int64
+		parse func(string) (int64, error)
+	}{
+		{*rate, &throttle.global, parseRate},
+		{*rateClient, &throttle.perClient, parseRate},
+		{*rateRequest, &throttle.perRequest, parseRate},
+		{*burst, &throttle.burst, parseByteSize},
+		{*uploadLimit, &uploadMax, parseByteSize},
+		{*originBlock, &originBlockSize, parseByteSize},
+		{*originMax, &originMaxSize, parseByteSize},
+	} {
+		if *r.v, err = r.parse(r.s); err != nil {
+			log.Fatal(err)
 		}
-		if r.URL.Path == "/norange" {
-			norange(w, r)
-			return
+	}
+	if throttle.burst <= 0 || throttle.jitter < 0 || throttle.jitter > 1 {
+		log.Fatalf("invalid -burst %s or -jitter %v", *burst, throttle.jitter)
+	}
+	if throttle.global > 0 {
+		globalBucket = newTokenBucket(throttle.global, throttle.burst)
+	}
+	if *teeName != "" {
+		size, err := parseByteSize(*teeSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if teeFile, err = openRotatingFile(*teeName, size, *teeBackups); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *record != "" {
+		if recorder, err = openTraceRecorder(*record); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var media fs.FS
+	handler := &mediaHandler{}
+	if *origin != "" {
+		if *upload {
+			log.Fatal("-upload needs a local -d, not an -origin")
+		}
+		if media, err = newOriginFS(*origin, *originCache, originBlockSize, *originTTL, originMaxSize); err != nil {
+			log.Fatal(err)
 		}
-		fs(w, r)
+		*directory = *origin
+	} else {
+		var root *os.Root
+		if media, root, err = openSource(*directory); err != nil {
+			log.Fatal(err)
+		}
+		if *upload {
+			if root == nil {
+				log.Fatal("-upload needs -d to be a directory")
+			}
+			handler.uploads = newUploader(root)
+		}
+	}
+	handler.fsys = media
+
+	http.HandleFunc("/norange", func(w http.ResponseWriter, r *http.Request) {
+		norange(w, r, media)
 	})
+	http.Handle("/metrics", metrics)
+	if hlsSegmentDuration > 0 {
+		http.HandleFunc("/hls/", withLog(withRecord(func(w http.ResponseWriter, r *http.Request) {
+			serveHLS(w, r, media)
+		})))
+	}
+	http.HandleFunc("/play/", func(w http.ResponseWriter, r *http.Request) {
+		servePlayer(w, r, media)
+	})
+	http.HandleFunc("/lab/", func(w http.ResponseWriter, r *http.Request) {
+		serveLab(w, r, media)
+	})
+	http.HandleFunc("/telemetry", serveTelemetry)
+	http.HandleFunc("/", withLog(withRecord(withLab(withThrottle(handler.ServeHTTP)))))
 
-	log.Printf("Serving %s on HTTP port: %s\n", *directory, *port)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	log.Printf("Serving %s on HTTP port: %s, chunk policy: %s, tls: %v, h2c: %v, h3: %v, upload: %v\n", *directory, *port, chunker, *tlsOn, *h2c, *h3, *upload)
+	err = listenAndServe(serveOptions{
+		addr:              ":" + *port,
+		tls:               *tlsOn,
+		certFile:          *certFile,
+		keyFile:           *keyFile,
+		h2c:               *h2c,
+		h3:                *h3,
+		readHeaderTimeout: *readHeaderTimeout,
+		readTimeout:       *readTimeout,
+		writeTimeout:      *writeTimeout,
+		idleTimeout:       *idleTimeout,
+		maxConns:          *maxConns,
+		maxConnsPerIP:     *maxConnsPerIP,
+		shutdownTimeout:   *shutdownTimeout,
+	}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 const (
-	vname         = "./media/tomato-egg_stir-fry.mp4"
+	vname         = "tomato-egg_stir-fry.mp4"
 	sizePerRequst = 5 * 1000 * 1000 // 5MB/req
 )
 
-func openfile(name string) (*os.File, int64, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, 0, err
+// norange serves the whole file named by query f, or vname, without any
+// range support.
+func norange(w http.ResponseWriter, req *http.Request, fsys fs.FS) {
+	name := vname
+	if f := req.URL.Query().Get("f"); f != "" {
+		var ok bool
+		if name, ok = mediaName(f); !ok {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
 	}
-	finfo, err := f.Stat()
+	f, finfo, err := openfile(fsys, name)
 	if err != nil {
-		return nil, 0, err
+		fsError(w, err)
+		return
 	}
-	return f, finfo.Size(), nil
-}
-
-func norange(w http.ResponseWriter, req *http.Request) {
-	f, size, err := openfile(vname)
+	defer f.Close()
+	size := finfo.Size()
+	ctype, err := contentType(f, name)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	defer f.Close()
-	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Type", ctype)
 
 	if req.Method != "HEAD" {
 		io.CopyN(w, f, size)
 	}
 }
 
-func rangeVideo(w http.ResponseWriter, req *http.Request) {
-	f, size, err := openfile(vname)
+// rangeVideo serves name of fsys. Media files are sent in chunks decided by
+// chunker, even if the client asks for the whole file.
+func rangeVideo(w http.ResponseWriter, req *http.Request, fsys fs.FS, name string) {
+	f, finfo, err := openfile(fsys, name)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		fsError(w, err)
 		return
 	}
 	defer f.Close()
 
-	w.Header().Set("Content-Type", "video/mp4")
+	ctype, err := contentType(f, name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// from here on, all range math is against the content actually served
+	content, finfo, virtual := faststartContent(f, finfo, name, ctype)
+	coding, onTheFly := "", false
+	if compress && isCompressible(ctype) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		var sidecar mediaFile
+		var sinfo fs.FileInfo
+		var ok bool
+		coding, sidecar, sinfo, ok = negotiateEncoding(fsys, name, finfo, req.Header.Get("Accept-Encoding"))
+		if !ok {
+			// RFC 9110 12.5.3, identity is ruled out and nothing else fits
+			http.Error(w, "no acceptable content coding of "+name, http.StatusNotAcceptable)
+			return
+		}
+		if sidecar != nil {
+			// ranges are of the encoded bytes, RFC 9110 14.1.1
+			defer sidecar.Close()
+			content, finfo = sidecar, sinfo
+		}
+		onTheFly = coding != "" && sidecar == nil
+	}
+	size := finfo.Size()
+	w.Header().Set("Content-Type", ctype)
+	setValidators(w, finfo)
+	switch {
+	case virtual:
+		w.Header().Set("Etag", faststartETag(finfo))
+	case onTheFly:
+		// weak, another gzip level or library gives other bytes
+		w.Header().Set("Etag", "W/"+encodingETag(finfo, coding))
+	case coding != "":
+		w.Header().Set("Etag", encodingETag(finfo, coding))
+	}
+	if coding != "" {
+		w.Header().Set("Content-Encoding", coding)
+	}
+
+	done, rangeHeader := checkPreconditions(w, req, finfo.ModTime())
+	if done {
+		return
+	}
+	if onTheFly {
+		serveGzip(w, req, content, finfo)
+		return
+	}
+	if rangeHeader == "" && req.Header.Get("Range") != "" {
+		// If-Range didn't match, the file has changed since the client's
+		// last response, so it must start over with the whole new file.
+		logf("\n%s If-Range %s not matched %s, response 200, %d bytes\n",
+			req.RemoteAddr, req.Header.Get("If-Range"), w.Header().Get("Etag"), size)
+		serveFull(w, req, content, size)
+		return
+	}
+	if rangeHeader == "" && (size == 0 || !isMedia(ctype)) {
+		// an empty file has no range 0-0 to hint with
+		serveFull(w, req, content, size)
+		return
+	}
+	chunk, policy := chunker.chunkSize(content, name, finfo, ctype)
+	logf("\nchunk policy %s of %s: %d bytes\n", policy, name, chunk)
 
-	rangeHeader := req.Header.Get("Range")
 	// we can simply hint Chrome to send serial range requests for media file by
 	//
 	// if rangeHeader == "" {
@@ -91,17 +300,17 @@ func rangeVideo(w http.ResponseWriter, req *http.Request) {
 	if rangeHeader == "" {
 		ra := httpRange{
 			start:  0,
-			length: sizePerRequst,
+			length: min(chunk, size),
 		}
 		w.Header().Set("Accept-Ranges", "bytes")
 		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
 		w.Header().Set("Content-Range", ra.contentRange(size))
 		w.WriteHeader(http.StatusPartialContent)
-		fmt.Printf("hint browser to send serial range requests, response 206, 0-%d/%d\n", sizePerRequst-1, size)
+		logf("hint browser to send serial range requests, response 206, 0-%d/%d\n", ra.length-1, size)
 		if req.Method != "HEAD" {
-			written, err := io.CopyN(w, f, ra.length)
+			written, err := io.CopyN(w, content, ra.length)
 			if written != ra.length {
-				fmt.Printf("desired range size: %d, actual written: %d, err: %v\n\n", ra.length, written, err)
+				logf("desired range size: %d, actual written: %d, err: %v\n\n", ra.length, written, err)
 			}
 		}
 		return
@@ -109,44 +318,61 @@ func rangeVideo(w http.ResponseWriter, req *http.Request) {
 
 	// browser sends range request
 	reqer := req.RemoteAddr
-	fmt.Printf("\n%s request range %s\n", reqer, rangeHeader)
-	ranges, err := parseRange(rangeHeader, size)
+	logf("\n%s request range %s\n", reqer, rangeHeader)
+	ranges, err := parseRange(rangeHeader, size, chunk)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		rangeError(w, req, content, rangeHeader, size, err)
 		return
 	}
 
-	// multi-part requests are not supported
+	ranges = coalesceRanges(ranges)
+	if len(ranges) > maxRanges {
+		tooManyRanges(w, req, rangeHeader, len(ranges), size)
+		return
+	}
 	if len(ranges) > 1 {
-		http.Error(w, "unsuported multi-part", http.StatusRequestedRangeNotSatisfiable)
+		serveMultipart(w, req, content, ranges, ctype, size)
 		return
 	}
 
 	ra := ranges[0]
-	if _, err := f.Seek(ra.start, io.SeekStart); err != nil {
-		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+	if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+		rangeNotSatisfiable(w, req, size, problem{
+			Type:   problemNoOverlap,
+			Title:  "Range Not Satisfiable",
+			Detail: err.Error(),
+			Range:  rangeHeader,
+		})
 		return
 	}
-	fmt.Printf("response range bytes %d-%d, %d KB\n", ra.start, ra.start+ra.length-1, ra.length/1024)
+	logf("response range bytes %d-%d, %d KB\n", ra.start, ra.start+ra.length-1, ra.length/1024)
 	sendSize := ra.length
 	w.Header().Set("Content-Range", ra.contentRange(size))
 	w.Header().Set("Accept-Ranges", "bytes")
-	if w.Header().Get("Content-Encoding") == "" {
-		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
-	}
+	// with a Content-Encoding, content is the encoded file, so sendSize is
+	// still the exact length of the body
+	w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
 	w.WriteHeader(http.StatusPartialContent)
 
 	if req.Method != "HEAD" {
-		written, err := io.CopyN(w, f, sendSize)
+		written, err := io.CopyN(w, content, sendSize)
 		if written != sendSize || err != nil {
-			fmt.Printf("desired range size: %d, actual written: %d, err: %v\n\n", sendSize, written, err)
+			logf("desired range size: %d, actual written: %d, err: %v\n\n", sendSize, written, err)
 		} else {
-			fmt.Println()
+			logf("\n")
 		}
 	}
 }
 
-// --- httpRange and its funcs are ported from net/http fs.go
+// serveFull sends the whole file with a 200.
+func serveFull(w http.ResponseWriter, req *http.Request, f io.Reader, size int64) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if req.Method != "HEAD" {
+		io.CopyN(w, f, size)
+	}
+}
 
 // httpRange specifies the byte range to be sent to the client.
 type httpRange struct {
@@ -154,86 +380,21 @@ type httpRange struct {
 }
 
 func (r httpRange) contentRange(size int64) string {
-	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
-	//return fmt.Sprintf("bytes %d-%d/*", r.start, r.start+r.length-1)
+	return httprange.Range{Start: r.start, Length: r.length}.ContentRange(size)
 }
 
-var errNoOverlap = errors.New("invalid range: failed to overlap")
+var errNoOverlap = httprange.ErrNoOverlap
 
-// parseRange parses a Range header string as per RFC 7233.
-// errNoOverlap is returned if none of the ranges overlap.
-func parseRange(s string, size int64) ([]httpRange, error) {
-	if s == "" {
-		return nil, nil // header not present
-	}
-	const b = "bytes="
-	if !strings.HasPrefix(s, b) {
-		return nil, errors.New("invalid range")
-	}
-	var ranges []httpRange
-	noOverlap := false
-	for _, ra := range strings.Split(s[len(b):], ",") {
-		ra = textproto.TrimString(ra)
-		if ra == "" {
-			continue
-		}
-		start, end, ok := strings.Cut(ra, "-")
-		if !ok {
-			return nil, errors.New("invalid range")
-		}
-		start, end = textproto.TrimString(start), textproto.TrimString(end)
-		var r httpRange
-		if start == "" {
-			// If no start is specified, end specifies the
-			// range start relative to the end of the file,
-			// and we are dealing with <suffix-length>
-			// which has to be a non-negative integer as per
-			// RFC 7233 Section 2.1 "Byte-Ranges".
-			if end == "" || end[0] == '-' {
-				return nil, errors.New("invalid range")
-			}
-			i, err := strconv.ParseInt(end, 10, 64)
-			if i < 0 || err != nil {
-				return nil, errors.New("invalid range")
-			}
-			if i > size {
-				i = size
-			}
-			r.start = size - i
-			r.length = size - r.start
-		} else {
-			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i < 0 {
-				return nil, errors.New("invalid range")
-			}
-			if i >= size {
-				// If the range begins after the size of the content,
-				// then it does not overlap.
-				noOverlap = true
-				continue
-			}
-			r.start = i
-			if end == "" {
-				r.length = sizePerRequst
-				if r.length > size-r.start {
-					r.length = size - r.start
-				}
-			} else {
-				i, err := strconv.ParseInt(end, 10, 64)
-				if err != nil || r.start > i {
-					return nil, errors.New("invalid range")
-				}
-				if i >= size {
-					i = size - 1
-				}
-				r.length = i - r.start + 1
-			}
-		}
-		ranges = append(ranges, r)
+// parseRange parses a Range header string as per RFC 9110, see
+// httprange.Parse. An open-ended range is capped to chunk bytes.
+func parseRange(s string, size, chunk int64) ([]httpRange, error) {
+	parsed, err := httprange.Parse(s, size, httprange.Options{MaxLength: chunk})
+	if err != nil {
+		return nil, err
 	}
-	if noOverlap && len(ranges) == 0 {
-		// The specified ranges did not overlap with the content.
-		return nil, errNoOverlap
+	ranges := make([]httpRange, len(parsed))
+	for i, r := range parsed {
+		ranges[i] = httpRange{start: r.Start, length: r.Length}
 	}
 	return ranges, nil
 }
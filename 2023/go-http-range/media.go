@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+func init() {
+	// the builtin table of mime only knows a few web types, and the
+	// /etc/mime.types of a slim container image is often missing
+	for ext, typ := range map[string]string{
+		".mp4":    "video/mp4",
+		".m4v":    "video/mp4",
+		".mov":    "video/quicktime",
+		".webm":   "video/webm",
+		".mkv":    "video/x-matroska",
+		".ogv":    "video/ogg",
+		".m4a":    "audio/mp4",
+		".mp3":    "audio/mpeg",
+		".aac":    "audio/aac",
+		".oga":    "audio/ogg",
+		".ogg":    "audio/ogg",
+		".opus":   "audio/ogg",
+		".wav":    "audio/wav",
+		".flac":   "audio/flac",
+		".vtt":    "text/vtt; charset=utf-8",
+		".srt":    "application/x-subrip",
+		".log":    "text/plain; charset=utf-8",
+		".ndjson": "application/x-ndjson",
+		".ico":    "image/x-icon",
+	} {
+		mime.AddExtensionType(ext, typ)
+	}
+}
+
+// mediaFile is a file rangeVideo can seek in.
+type mediaFile interface {
+	fs.File
+	io.Seeker
+}
+
+// mediaHandler serves every file of fsys through rangeVideo, and an index
+// page for every directory. With uploads, files are uploaded into fsys too.
+type mediaHandler struct {
+	fsys    fs.FS
+	uploads *uploader
+}
+
+func (h *mediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := mediaName(r.URL.Path)
+	if !ok {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case h.uploads != nil && isUpload(r):
+		h.uploads.serve(w, r, name)
+		return
+	case r.Method == "PUT" || r.Method == "PATCH" || r.Method == "POST":
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "uploads are off, see -upload", http.StatusMethodNotAllowed)
+		return
+	}
+	finfo, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if !finfo.IsDir() {
+		rangeVideo(w, r, h.fsys, name)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+	serveIndex(w, r, h.fsys, name)
+}
+
+// mediaName turns a URL path into a name of fs.FS. It rejects paths with
+// ".." elements and hidden files, the root of fsys guards against symlinks
+// escaping the directory.
+func mediaName(urlPath string) (string, bool) {
+	if strings.ContainsRune(urlPath, 0) || strings.Contains(urlPath, "\\") {
+		return "", false
+	}
+	for _, elem := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return "", false
+		}
+	}
+	name := strings.Trim(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+// fsError answers err of opening a file. The error itself is only logged,
+// it may tell about the server's files.
+func fsError(w http.ResponseWriter, err error) {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission), errors.As(err, &pathErr):
+		// a symlink escaping the media directory is a path error too
+		logf("forbidden: %v\n", err)
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		logf("internal error: %v\n", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// openfile opens name of fsys for range reading.
+func openfile(fsys fs.FS, name string) (mediaFile, fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if finfo.IsDir() {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s is a directory", name)
+	}
+	return seekable(fsys, name, f, finfo.Size()), finfo, nil
+}
+
+// contentType picks the Content-Type from the extension of name, and sniffs
+// the first 512 bytes of f if the extension is unknown.
+func contentType(f io.ReadSeeker, name string) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// isMedia reports whether ctype is played by a HTML5 media element.
+func isMedia(ctype string) bool {
+	return strings.HasPrefix(ctype, "video/") || strings.HasPrefix(ctype, "audio/")
+}
+
+type indexEntry struct {
+	Name, Href, Play, Lab, HLS string
+	Size                       int64
+}
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Dir}}</title></head>
+<body>
+<h1>{{.Dir}}</h1>
+<ul>
+{{- if ne .Dir "/"}}
+<li><a href="../">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="{{.Href}}">{{.Name}}</a>{{if .Size}} ({{.Size}} bytes){{end}}{{if .Play}} <a href="{{.Play}}">[play]</a> <a href="{{.Lab}}">[lab]</a>{{end}}{{if .HLS}} <a href="{{.HLS}}">[hls]</a>{{end}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+func serveIndex(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) {
+	dirents, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	sort.Slice(dirents, func(i, j int) bool { return dirents[i].Name() < dirents[j].Name() })
+
+	var entries []indexEntry
+	for _, d := range dirents {
+		if strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		e := indexEntry{Name: d.Name(), Href: href(d.Name())}
+		if d.IsDir() {
+			e.Name += "/"
+			e.Href += "/"
+		} else {
+			if finfo, err := d.Info(); err == nil {
+				e.Size = finfo.Size()
+			}
+			if isMedia(mime.TypeByExtension(path.Ext(d.Name()))) {
+				e.Play = href("/play/" + path.Join(name, d.Name()))
+				e.Lab = href("/lab/" + path.Join(name, d.Name()))
+			}
+			if hlsSegmentDuration > 0 && path.Ext(d.Name()) == ".mp4" {
+				e.HLS = href("/hls/" + path.Join(name, d.Name()) + ".m3u8")
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTmpl.Execute(w, struct {
+		Dir     string
+		Entries []indexEntry
+	}{"/" + strings.TrimPrefix(name+"/", "./"), entries})
+}
+
+var playerTmpl = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+{{- if .Audio}}
+<audio controls preload="metadata" src="{{.Src}}"></audio>
+{{- else}}
+<video controls preload="metadata" width="960" src="{{.Src}}"></video>
+{{- end}}
+<p><a href="{{.Dir}}">back to {{.Dir}}</a></p>
+</body>
+</html>
+`))
+
+// servePlayer serves a page embedding the media file at /play/<name> in a
+// HTML5 player.
+func servePlayer(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	name, ok := mediaName(strings.TrimPrefix(r.URL.Path, "/play"))
+	if !ok || name == "." {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if _, err := fs.Stat(fsys, name); err != nil {
+		fsError(w, err)
+		return
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if !isMedia(ctype) {
+		http.Error(w, name+" is not a media file", http.StatusBadRequest)
+		return
+	}
+	dir := path.Dir("/" + name)
+	if dir != "/" {
+		dir += "/"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	playerTmpl.Execute(w, struct {
+		Name, Src, Dir string
+		Audio          bool
+	}{
+		Name:  name,
+		Src:   href("/" + name),
+		Dir:   dir,
+		Audio: strings.HasPrefix(ctype, "audio/"),
+	})
+}
+
+// href escapes a slash separated path for use in a link.
+func href(p string) string {
+	u := url.URL{Path: p}
+	return u.String()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMediaHandler(t *testing.T) {
+	parent := t.TempDir()
+	if err := os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(parent, "media")
+	for name, content := range map[string]string{
+		"a.mp4":        "0123456789",
+		"empty.mp4":    "",
+		"sub/b.mp3":    "abc",
+		"notes":        "plain text notes",
+		".hidden.json": "{}",
+	} {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(parent, "secret.txt"), filepath.Join(dir, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	h := &mediaHandler{fsys: root.FS()}
+
+	tests := []struct {
+		path, rangeHeader string
+		wantCode          int
+		wantType          string
+		wantBody          string
+	}{
+		{"/a.mp4", "bytes=1-2", 206, "video/mp4", "12"},
+		{"/a.mp4", "", 206, "video/mp4", "0123456789"},
+		{"/empty.mp4", "", 200, "video/mp4", ""},
+		{"/sub/b.mp3", "bytes=-1", 206, "audio/mpeg", "c"},
+		{"/notes", "", 200, "text/plain; charset=utf-8", "plain text notes"},
+		{"/notes", "bytes=0-4", 206, "text/plain; charset=utf-8", "plain"},
+		{"/missing.mp4", "", 404, "", ""},
+		{"/.hidden.json", "", 400, "", ""},
+		{"/../secret.txt", "", 400, "", ""},
+		{"/sub/../../secret.txt", "", 400, "", ""},
+		{"/escape.txt", "", 403, "", ""},
+		{"/sub", "", 301, "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = tt.path
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.path, rec.Code, tt.wantCode)
+			continue
+		}
+		if strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("%s: served content outside of the media directory", tt.path)
+		}
+		if rec.Code >= 400 && strings.Contains(rec.Body.String(), "escape") {
+			t.Errorf("%s: error tells about the files: %q", tt.path, rec.Body)
+		}
+		if tt.wantType != "" && rec.Header().Get("Content-Type") != tt.wantType {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.path, rec.Header().Get("Content-Type"), tt.wantType)
+		}
+		if cr := rec.Header().Get("Content-Range"); rec.Code == 200 && cr != "" {
+			t.Errorf("%s: Content-Range %q on a 200", tt.path, cr)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("%s: body = %q, want %q", tt.path, rec.Body.String(), tt.wantBody)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	index := rec.Body.String()
+	for _, want := range []string{`href="a.mp4"`, `href="/play/a.mp4"`, `href="sub/"`, `href="notes"`} {
+		if !strings.Contains(index, want) {
+			t.Errorf("index misses %s:\n%s", want, index)
+		}
+	}
+	if strings.Contains(index, "hidden") {
+		t.Errorf("index lists hidden file:\n%s", index)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	sizeBuckets    = []float64{1 << 10, 64 << 10, 256 << 10, 1 << 20, 2 << 20, 5 << 20, 10 << 20, 50 << 20}
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// metrics of all responses that went through withLog.
+var metrics = newServerMetrics()
+
+// histogram is a Prometheus histogram with cumulative buckets.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] counts observations <= bounds[i]
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// serverMetrics counts responses by status code.
+type serverMetrics struct {
+	mu        sync.Mutex
+	responses map[int]uint64
+	sizes     map[int]*histogram
+	latencies map[int]*histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		responses: map[int]uint64{},
+		sizes:     map[int]*histogram{},
+		latencies: map[int]*histogram{},
+	}
+	// always export the codes of a range server, even before they happen
+	for _, code := range []int{http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable} {
+		m.responses[code] = 0
+	}
+	return m
+}
+
+func (m *serverMetrics) observe(code int, size int64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[code]++
+	if m.sizes[code] == nil {
+		m.sizes[code] = newHistogram(sizeBuckets)
+		m.latencies[code] = newHistogram(latencyBuckets)
+	}
+	m.sizes[code].observe(float64(size))
+	m.latencies[code].observe(elapsed.Seconds())
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := make([]int, 0, len(m.responses))
+	for code := range m.responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP range_http_responses_total Number of responses by status code.")
+	fmt.Fprintln(w, "# TYPE range_http_responses_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "range_http_responses_total{code=\"%d\"} %d\n", code, m.responses[code])
+	}
+	fmt.Fprintln(w, "# HELP range_http_response_size_bytes Bytes of response bodies by status code.")
+	fmt.Fprintln(w, "# TYPE range_http_response_size_bytes histogram")
+	for _, code := range codes {
+		if h := m.sizes[code]; h != nil {
+			h.write(w, "range_http_response_size_bytes", fmt.Sprintf("code=\"%d\"", code))
+		}
+	}
+	fmt.Fprintln(w, "# HELP range_http_request_duration_seconds Latency of requests by status code.")
+	fmt.Fprintln(w, "# TYPE range_http_request_duration_seconds histogram")
+	for _, code := range codes {
+		if h := m.latencies[code]; h != nil {
+			h.write(w, "range_http_request_duration_seconds", fmt.Sprintf("code=\"%d\"", code))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithLogMetrics(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l *slog.Logger, m *serverMetrics) { accessLog, metrics = l, m }(accessLog, metrics)
+	accessLog, metrics = slog.New(slog.NewJSONHandler(&logs, nil)), newServerMetrics()
+
+	h := withLog(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=100-" {
+			w.Header().Set("Content-Range", "bytes */10")
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-9/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("0123456789"))
+	})
+	for _, ra := range []string{"bytes=0-", "bytes=0-", "bytes=100-"} {
+		req := httptest.NewRequest("GET", "/video.mp4", nil)
+		req.Header.Set("Range", ra)
+		h(httptest.NewRecorder(), req)
+	}
+
+	var entry struct {
+		Msg          string `json:"msg"`
+		Method       string `json:"method"`
+		Path         string `json:"path"`
+		Range        string `json:"range"`
+		Status       int    `json:"status"`
+		ContentRange string `json:"content_range"`
+		Bytes        int    `json:"bytes"`
+		RemoteAddr   string `json:"remote_addr"`
+	}
+	line, _, _ := strings.Cut(logs.String(), "\n")
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("access log %q is not JSON: %v", line, err)
+	}
+	if entry.Msg != "access" || entry.Method != "GET" || entry.Path != "/video.mp4" || entry.Range != "bytes=0-" ||
+		entry.Status != 206 || entry.ContentRange != "bytes 0-9/10" || entry.Bytes != 10 || entry.RemoteAddr == "" {
+		t.Errorf("unexpected access log %+v", entry)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`range_http_responses_total{code="200"} 0`,
+		`range_http_responses_total{code="206"} 2`,
+		`range_http_responses_total{code="416"} 1`,
+		`range_http_response_size_bytes_bucket{code="206",le="1024"} 2`,
+		`range_http_response_size_bytes_sum{code="206"} 20`,
+		`range_http_request_duration_seconds_count{code="416"} 1`,
+		`range_http_request_duration_seconds_bucket{code="206",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics miss %s:\n%s", want, rec.Body.String())
+		}
+	}
+}
@@ -1,51 +1,82 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"strings"
+	"os"
 	"time"
 )
 
+// accessLog writes one JSON line per response, stdout is nothing else.
+var accessLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// logf writes the free-form lines of the handlers to stderr, so that stdout
+// stays a JSON lines stream.
+func logf(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, format, a...)
+}
+
 func withLog(ha func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		fmt.Println()
-		fmt.Println("------ request ------")
-		fmt.Println(r.Method, r.URL)
-		for k, v := range r.Header {
-			if k != "Range" {
-				continue
-			}
-			fmt.Printf("%s: %s\n", k, v)
+		// response bodies are not kept by default, a 5MB chunk per request
+		// adds up quickly
+		ww := &basicWriter{ResponseWriter: w}
+		var head *headBuffer
+		var tees []io.Writer
+		if teeHeadBytes > 0 {
+			head = &headBuffer{limit: teeHeadBytes}
+			tees = append(tees, head)
+		}
+		var c *capture
+		if teeFile != nil {
+			c = newCapture(teeFile)
+			tees = append(tees, c)
+		}
+		switch len(tees) {
+		case 1:
+			ww.Tee(tees[0])
+		case 2:
+			ww.Tee(io.MultiWriter(tees...))
 		}
-
-		var buf bytes.Buffer
-		ww := &basicWriter{ResponseWriter: w, tee: &buf}
 		ha(ww, r)
 
-		fmt.Println("------Response------")
-		fmt.Printf("StatusCode: %d\n", ww.code)
-		for k, v := range ww.Header() {
-			if !strings.Contains(k, "Range") {
-				continue
-			}
-			fmt.Printf("%s: %s\n", k, v)
-		}
 		elapsed := time.Since(start)
-		lenInMB := float64(ww.bytes) / float64(1024*1024)
-		fmt.Printf("Content-Length: %s\n", ww.Header().Get("Content-Length"))
-		fmt.Printf("Written MBytes: %.2fMB\n", lenInMB)
-		fmt.Println("cost:", elapsed.Milliseconds(), "ms")
-		fmt.Println()
+		code := ww.Status()
+		if code == 0 { // handler wrote nothing, net/http sends 200
+			code = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("proto", r.Proto),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("range", r.Header.Get("Range")),
+			slog.Int("status", code),
+			slog.String("content_range", ww.Header().Get("Content-Range")),
+			slog.String("content_length", ww.Header().Get("Content-Length")),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		if head != nil {
+			attrs = append(attrs, slog.String("head_hex", hex.EncodeToString(head.buf)))
+		}
+		if c != nil {
+			attrs = append(attrs, slog.Int64("capture_id", c.id))
+		}
+		accessLog.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+		metrics.observe(code, int64(ww.BytesWritten()), elapsed)
 	}
 }
 
-// basicWriter wraps a http.ResponseWriter that implements the minimal
-// http.ResponseWriter interface.
+// basicWriter wraps a http.ResponseWriter to count the bytes written,
+// keeping the optional interfaces of the wrapped writer.
 // ported from go-chi
 type basicWriter struct {
 	http.ResponseWriter
@@ -75,7 +106,7 @@ func (b *basicWriter) Write(buf []byte) (int, error) {
 	}
 	b.bytes += n
 	if err != nil {
-		fmt.Printf("err writing response: %s\n", err)
+		logf("err writing response: %s\n", err)
 	}
 	return n, err
 }
@@ -101,3 +132,54 @@ func (b *basicWriter) Tee(w io.Writer) {
 func (b *basicWriter) Unwrap() http.ResponseWriter {
 	return b.ResponseWriter
 }
+
+// --- the optional interfaces of http.ResponseWriter, so wrapping the writer
+// doesn't hide them from handlers, e.g. io.ReaderFrom is how io.CopyN from
+// an *os.File ends up in sendfile.
+
+// Flush implements http.Flusher.
+func (b *basicWriter) Flush() {
+	b.FlushError()
+}
+
+// FlushError is what http.ResponseController calls to flush.
+func (b *basicWriter) FlushError() error {
+	b.maybeWriteHeader()
+	return http.NewResponseController(b.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker.
+func (b *basicWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(b.ResponseWriter).Hijack()
+}
+
+// Push implements http.Pusher.
+func (b *basicWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := b.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// ReadFrom implements io.ReaderFrom. Without a tee it hands r to the
+// ReadFrom of the wrapped writer, which for net/http sends files with
+// sendfile(2) instead of copying them through user space.
+func (b *basicWriter) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := b.ResponseWriter.(io.ReaderFrom)
+	if b.tee != nil || !ok {
+		// the tee has to see every byte, so take the plain Write path
+		return io.Copy(writerOnly{b}, r)
+	}
+	b.maybeWriteHeader()
+	n, err := rf.ReadFrom(r)
+	b.bytes += int(n)
+	if err != nil {
+		logf("err writing response: %s\n", err)
+	}
+	return n, err
+}
+
+// writerOnly hides the ReadFrom of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
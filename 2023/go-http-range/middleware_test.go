@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// discardWriter is a http.ResponseWriter that keeps nothing.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// rangeChunkHandler answers like rangeVideo, with a 5MB chunk.
+func rangeChunkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", sizePerRequst-1, 10*sizePerRequst))
+	w.WriteHeader(http.StatusPartialContent)
+	io.CopyN(w, zeroReader{}, sizePerRequst)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func quietLog(tb testing.TB) {
+	l := accessLog
+	accessLog = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	tb.Cleanup(func() { accessLog = l })
+}
+
+func BenchmarkWithLogConcurrentRanges(b *testing.B) {
+	quietLog(b)
+	for _, head := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("tee-bytes=%d", head), func(b *testing.B) {
+			defer func(n int) { teeHeadBytes = n }(teeHeadBytes)
+			teeHeadBytes = head
+			h := withLog(rangeChunkHandler)
+			b.ReportAllocs()
+			b.SetBytes(sizePerRequst)
+			b.RunParallel(func(pb *testing.PB) {
+				req := httptest.NewRequest("GET", "/video.mp4", nil)
+				req.Header.Set("Range", "bytes=0-")
+				for pb.Next() {
+					h(&discardWriter{header: http.Header{}}, req)
+				}
+			})
+		})
+	}
+}
+
+// TestWithLogMemoryFlat serves 5MB chunks concurrently and checks that the
+// memory allocated per request doesn't grow with the size of the chunk.
+func TestWithLogMemoryFlat(t *testing.T) {
+	quietLog(t)
+	defer func(n int) { teeHeadBytes = n }(teeHeadBytes)
+	teeHeadBytes = 4096
+	h := withLog(rangeChunkHandler)
+
+	const requests = 64
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	done := make(chan struct{})
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			req := httptest.NewRequest("GET", "/video.mp4", nil)
+			req.Header.Set("Range", "bytes=0-")
+			h(&discardWriter{header: http.Header{}}, req)
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		<-done
+	}
+	runtime.ReadMemStats(&after)
+
+	perRequest := (after.TotalAlloc - before.TotalAlloc) / requests
+	if perRequest > sizePerRequst/10 {
+		t.Errorf("allocated %d bytes per %d bytes response", perRequest, sizePerRequst)
+	}
+}
+
+func TestTeeHeadBytes(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l *slog.Logger, n int) { accessLog, teeHeadBytes = l, n }(accessLog, teeHeadBytes)
+	accessLog, teeHeadBytes = slog.New(slog.NewJSONHandler(&logs, nil)), 4
+
+	withLog(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ab"))
+		w.Write([]byte("cdef"))
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(logs.String(), `"head_hex":"61626364"`) {
+		t.Errorf("access log misses head of body: %s", logs.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture")
+	f, err := openRotatingFile(name, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		c := newCapture(f)
+		c.Write(bytes.Repeat([]byte{'x'}, 60))
+	}
+	for _, n := range []string{name, name + ".1", name + ".2"} {
+		data, err := os.ReadFile(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 100 {
+			t.Errorf("%s has %d bytes, rotated at 100", n, len(data))
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 backups should be kept, stat %s.3: %v", name, err)
+	}
+}
+
+func TestRotatingFileFailedReopen(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture")
+	f, err := openRotatingFile(name, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCapture(f)
+	if _, err := c.Write(bytes.Repeat([]byte{'x'}, 60)); err != nil {
+		t.Fatal(err)
+	}
+	// a directory in the way of the new file fails the rotation
+	os.Remove(name)
+	if err := os.MkdirAll(filepath.Join(name, "in-the-way"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(bytes.Repeat([]byte{'y'}, 60)); err != nil {
+		t.Errorf("write after a failed rotation: %v", err)
+	}
+	os.RemoveAll(name)
+	if _, err := c.Write([]byte("z")); err != nil {
+		t.Errorf("write once the rotation works again: %v", err)
+	}
+	if data, err := os.ReadFile(name); err != nil || !bytes.HasSuffix(data, []byte("z\n")) {
+		t.Errorf("rotated file %q: %v", data, err)
+	}
+}
+
+// readFromWriter records what its ReadFrom was given.
+type readFromWriter struct {
+	discardWriter
+	src io.Reader
+}
+
+func (w *readFromWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.src = r
+	return io.Copy(io.Discard, r)
+}
+
+func TestBasicWriterReadFrom(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(name, bytes.Repeat([]byte("0123456789"), 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rw := &readFromWriter{discardWriter: discardWriter{header: http.Header{}}}
+	bw := &basicWriter{ResponseWriter: rw}
+	if n, err := io.CopyN(bw, f, 4000); n != 4000 || err != nil {
+		t.Fatalf("CopyN = %d, %v", n, err)
+	}
+	// the *os.File reaches the ReadFrom of net/http, which takes the
+	// sendfile path for an *io.LimitedReader of an *os.File
+	lr, ok := rw.src.(*io.LimitedReader)
+	if !ok {
+		t.Fatalf("ReadFrom got %T, want *io.LimitedReader", rw.src)
+	}
+	if _, ok := lr.R.(*os.File); !ok {
+		t.Fatalf("ReadFrom got a LimitedReader of %T, want *os.File", lr.R)
+	}
+	if bw.BytesWritten() != 4000 || bw.Status() != http.StatusOK {
+		t.Errorf("BytesWritten = %d, Status = %d", bw.BytesWritten(), bw.Status())
+	}
+
+	// with a tee, every byte goes through Write so the tee sees it
+	rw = &readFromWriter{discardWriter: discardWriter{header: http.Header{}}}
+	var tee bytes.Buffer
+	bw = &basicWriter{ResponseWriter: rw, tee: &tee}
+	f.Seek(0, io.SeekStart)
+	io.CopyN(bw, f, 1234)
+	if rw.src != nil || tee.Len() != 1234 || bw.BytesWritten() != 1234 {
+		t.Errorf("ReadFrom used with tee, tee has %d bytes, BytesWritten = %d", tee.Len(), bw.BytesWritten())
+	}
+}
+
+func TestBasicWriterOptionalInterfaces(t *testing.T) {
+	bw := http.ResponseWriter(&basicWriter{ResponseWriter: httptest.NewRecorder()})
+	if _, ok := bw.(http.Flusher); !ok {
+		t.Error("basicWriter is not a http.Flusher")
+	}
+	if _, ok := bw.(http.Hijacker); !ok {
+		t.Error("basicWriter is not a http.Hijacker")
+	}
+	if _, ok := bw.(io.ReaderFrom); !ok {
+		t.Error("basicWriter is not an io.ReaderFrom")
+	}
+
+	rec := httptest.NewRecorder()
+	if err := http.NewResponseController(&basicWriter{ResponseWriter: rec}).Flush(); err != nil || !rec.Flushed {
+		t.Errorf("ResponseController.Flush = %v, flushed %v", err, rec.Flushed)
+	}
+	if _, _, err := http.NewResponseController(&basicWriter{ResponseWriter: rec}).Hijack(); err == nil {
+		t.Error("hijacking a ResponseRecorder should fail")
+	}
+
+	// against a real connection: sendfile, hijack and deadlines
+	name := filepath.Join(t.TempDir(), "video.mp4")
+	content := bytes.Repeat([]byte("abcdefghij"), 100000)
+	if err := os.WriteFile(name, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := &basicWriter{ResponseWriter: w}
+		if r.URL.Path == "/hijack" {
+			conn, buf, err := bw.Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buf.WriteString("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n")
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		if err := http.NewResponseController(bw).SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			t.Error(err)
+		}
+		f, _ := os.Open(name)
+		defer f.Close()
+		io.CopyN(bw, f, int64(len(content)))
+		written <- bw.BytesWritten()
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, content) {
+		t.Errorf("got %d bytes of body, want %d", len(body), len(content))
+	}
+	if n := <-written; n != len(content) {
+		t.Errorf("BytesWritten = %d, want %d", n, len(content))
+	}
+
+	resp, err = http.Get(srv.URL + "/hijack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("hijacked response status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// box encodes an MP4 box of typ around the concatenated payloads.
+func box(typ string, payloads ...[]byte) []byte {
+	body := bytes.Join(payloads, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+// mvhd encodes a version 0 mvhd box.
+func mvhd(timescale, duration uint32) []byte {
+	payload := make([]byte, 100)
+	binary.BigEndian.PutUint32(payload[12:], timescale)
+	binary.BigEndian.PutUint32(payload[16:], duration)
+	return box("mvhd", payload)
+}
+
+func TestMP4Duration(t *testing.T) {
+	movie := append(box("ftyp", []byte("isom")), box("mdat", make([]byte, 100))...)
+	movie = append(movie, box("moov", box("trak"), mvhd(600, 5400))...)
+	f, finfo, err := openfile(fstest.MapFS{"m.mp4": {Data: movie}}, "m.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := mp4Duration(f, finfo.Size()); err != nil || d != 9*time.Second {
+		t.Errorf("mp4Duration = %v, %v, want 9s", d, err)
+	}
+	_, err = mp4Duration(strings.NewReader("not an mp4 file"), 15)
+	if err == nil {
+		t.Error("mp4Duration of garbage should fail")
+	}
+}
+
+// fullBox encodes a version 0 full box.
+func fullBox(typ string, payloads ...[]byte) []byte {
+	return box(typ, append([][]byte{{0, 0, 0, 0}}, payloads...)...)
+}
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// testTrack describes a track of buildMP4, all samples last delta.
+type testTrack struct {
+	handler   string
+	timescale uint32
+	delta     uint32
+	sizes     []uint32
+	sync      []uint32 // 1-based numbers of sync samples, nil for no stss
+	perChunk  int
+}
+
+// buildMP4 encodes a MP4 file with the chunks of all tracks interleaved in
+// mdat. Every byte of a sample is the track number followed by the low byte
+// of the sample number, so tests can tell where bytes come from.
+func buildMP4(tracks []testTrack, moovFirst bool) []byte {
+	chunks := 0
+	for _, t := range tracks {
+		chunks = max(chunks, (len(t.sizes)+t.perChunk-1)/t.perChunk)
+	}
+	// lay out mdat relative to its body, chunk offsets get fixed up below
+	var mdat []byte
+	offsets := make([][]uint32, len(tracks))
+	for c := 0; c < chunks; c++ {
+		for ti, t := range tracks {
+			first := c * t.perChunk
+			if first >= len(t.sizes) {
+				continue
+			}
+			offsets[ti] = append(offsets[ti], uint32(len(mdat)))
+			for s := first; s < min(first+t.perChunk, len(t.sizes)); s++ {
+				sample := bytes.Repeat([]byte{byte(ti + 1), byte(s)}, int(t.sizes[s]))[:t.sizes[s]]
+				mdat = append(mdat, sample...)
+			}
+		}
+	}
+
+	moov := func(base uint32) []byte {
+		var traks [][]byte
+		for ti, t := range tracks {
+			var duration uint32
+			stbl := [][]byte{
+				fullBox("stsd", u32s(0)),
+				fullBox("stts", u32s(1, uint32(len(t.sizes)), t.delta)),
+				fullBox("stsz", u32s(0, uint32(len(t.sizes))), u32s(t.sizes...)),
+				fullBox("stsc", u32s(1, 1, uint32(t.perChunk), 1)),
+			}
+			if t.sync != nil {
+				stbl = append(stbl, fullBox("stss", u32s(uint32(len(t.sync))), u32s(t.sync...)))
+			}
+			var stco []uint32
+			for _, o := range offsets[ti] {
+				stco = append(stco, base+o)
+			}
+			stbl = append(stbl, fullBox("stco", u32s(uint32(len(stco))), u32s(stco...)))
+			duration = t.delta * uint32(len(t.sizes))
+			traks = append(traks, box("trak",
+				fullBox("tkhd", u32s(0, 0, uint32(ti+1), 0, duration), make([]byte, 60)),
+				box("mdia",
+					fullBox("mdhd", u32s(0, 0, t.timescale, duration, 0)),
+					fullBox("hdlr", u32s(0), []byte(t.handler), make([]byte, 13)),
+					box("minf", box("stbl", stbl...)),
+				),
+			))
+		}
+		return box("moov", append([][]byte{mvhd(1000, 0)}, traks...)...)
+	}
+
+	ftyp := box("ftyp", []byte("isom"), u32s(512), []byte("isomiso2mp41"))
+	if moovFirst {
+		base := uint32(len(ftyp) + len(moov(0)) + 8)
+		return bytes.Join([][]byte{ftyp, moov(base), box("mdat", mdat)}, nil)
+	}
+	base := uint32(len(ftyp) + 8)
+	return bytes.Join([][]byte{ftyp, box("mdat", mdat), moov(base)}, nil)
+}
+
+// testTracks are 4 seconds of 10fps video with a keyframe every second, and
+// audio in chunks of 5 samples.
+func testTracks() []testTrack {
+	video := testTrack{handler: "vide", timescale: 1000, delta: 100, perChunk: 2, sync: []uint32{1, 11, 21, 31}}
+	for i := 0; i < 40; i++ {
+		video.sizes = append(video.sizes, uint32(100+i))
+	}
+	audio := testTrack{handler: "soun", timescale: 8000, delta: 1600, perChunk: 5}
+	for i := 0; i < 20; i++ {
+		audio.sizes = append(audio.sizes, 20)
+	}
+	return []testTrack{video, audio}
+}
+
+func TestReadMP4Tracks(t *testing.T) {
+	for _, moovFirst := range []bool{true, false} {
+		movie := buildMP4(testTracks(), moovFirst)
+		tracks, err := readMP4Tracks(bytes.NewReader(movie), int64(len(movie)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tracks) != 2 || tracks[0].handler != "vide" || tracks[1].handler != "soun" {
+			t.Fatalf("got tracks %+v", tracks)
+		}
+		for ti, track := range tracks {
+			for si, s := range track.samples {
+				want := []byte{byte(ti + 1), byte(si)}
+				if got := movie[s.offset : s.offset+2]; !bytes.Equal(got, want) {
+					t.Fatalf("moovFirst %v, track %d sample %d at %d starts with %v, want %v", moovFirst, ti, si, s.offset, got, want)
+				}
+			}
+		}
+		v := tracks[0]
+		if v.duration != 4000 || v.samples[11].time != 1100 || !v.samples[10].sync || v.samples[11].sync {
+			t.Errorf("bad video track timing: duration %d, sample 11 at %d", v.duration, v.samples[11].time)
+		}
+	}
+}
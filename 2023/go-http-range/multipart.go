@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+)
+
+// coalesceRanges sorts ranges by start and merges the ones that overlap or
+// touch, so a request like "bytes=0-99,0-99,0-99" can't make us send the same
+// bytes many times. RFC 9110 Section 14.2 allows a server to do so.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := make([]httpRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	merged := sorted[:1]
+	for _, ra := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if ra.start > last.start+last.length {
+			merged = append(merged, ra)
+			continue
+		}
+		if end := ra.start + ra.length; end > last.start+last.length {
+			last.length = end - last.start
+		}
+	}
+	return merged
+}
+
+// serveMultipart writes ranges of f as a multipart/byteranges response.
+// The Content-Length is computed before any byte is sent.
+func serveMultipart(w http.ResponseWriter, req *http.Request, f io.ReadSeeker, ranges []httpRange, contentType string, size int64) {
+	mw := multipart.NewWriter(w)
+	sendSize := rangesMIMESize(ranges, mw.Boundary(), contentType, size)
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	logf("response multipart/byteranges, %d parts, %d bytes\n", len(ranges), sendSize)
+
+	if req.Method == "HEAD" {
+		return
+	}
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+		if err != nil {
+			logf("err creating part %s: %v\n\n", ra.contentRange(size), err)
+			return
+		}
+		if _, err := f.Seek(ra.start, io.SeekStart); err != nil {
+			logf("err seeking part %s: %v\n\n", ra.contentRange(size), err)
+			return
+		}
+		if written, err := io.CopyN(part, f, ra.length); err != nil {
+			logf("desired part size: %d, actual written: %d, err: %v\n\n", ra.length, written, err)
+			return
+		}
+	}
+	mw.Close()
+	logf("\n")
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangesMIMESize returns the number of bytes it takes to encode the
+// provided ranges as a multipart response using boundary.
+func rangesMIMESize(ranges []httpRange, boundary, contentType string, contentSize int64) (encSize int64) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, contentSize))
+		encSize += ra.length
+	}
+	mw.Close()
+	encSize += int64(w)
+	return
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := []struct {
+		in, want []httpRange
+	}{
+		{nil, nil},
+		{[]httpRange{{0, 10}}, []httpRange{{0, 10}}},
+		{[]httpRange{{0, 100}, {500, 100}}, []httpRange{{0, 100}, {500, 100}}},
+		{[]httpRange{{500, 100}, {0, 100}}, []httpRange{{0, 100}, {500, 100}}},
+		{[]httpRange{{0, 100}, {0, 100}, {0, 100}}, []httpRange{{0, 100}}},
+		{[]httpRange{{0, 100}, {100, 100}}, []httpRange{{0, 200}}},      // adjacent
+		{[]httpRange{{0, 100}, {50, 100}}, []httpRange{{0, 150}}},       // overlapping
+		{[]httpRange{{0, 100}, {10, 10}}, []httpRange{{0, 100}}},        // contained
+		{[]httpRange{{0, 10}, {20, 10}, {5, 20}}, []httpRange{{0, 30}}}, // bridged
+	}
+	for _, tt := range tests {
+		if got := coalesceRanges(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("coalesceRanges(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestServeMultipart(t *testing.T) {
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+	size := int64(len(content))
+	ranges := []httpRange{{0, 5}, {10, 3}, {30, 6}}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	serveMultipart(rec, req, strings.NewReader(content), ranges, "video/mp4", size)
+
+	if rec.Code != 206 {
+		t.Fatalf("status = %d, want 206", rec.Code)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Fatalf("Content-Length = %s, body has %d bytes", cl, rec.Body.Len())
+	}
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, %v", rec.Header().Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for i, ra := range ranges {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if got, want := part.Header.Get("Content-Range"), ra.contentRange(size); got != want {
+			t.Errorf("part %d Content-Range = %q, want %q", i, got, want)
+		}
+		if got := part.Header.Get("Content-Type"); got != "video/mp4" {
+			t.Errorf("part %d Content-Type = %q", i, got)
+		}
+		body, _ := io.ReadAll(part)
+		if want := content[ra.start : ra.start+ra.length]; string(body) != want {
+			t.Errorf("part %d body = %q, want %q", i, body, want)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected EOF after last part, got %v", err)
+	}
+}
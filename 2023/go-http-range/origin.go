@@ -0,0 +1,608 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// originHeaderTimeout is how long the origin may take to answer a request.
+// The body has no deadline: a fallback to all of a large object, or a large
+// block from a slow origin, takes as long as it takes.
+var originHeaderTimeout = time.Minute
+
+// originFS is the files of an origin server, fetched in blocks as they are
+// read and kept in a sparse cache file per object. It is an fs.FS, so
+// rangeVideo, its chunk policies, faststart and HLS work on it as they do on
+// a local directory, only the blocks they touch are fetched.
+//
+// The cache of an object is three files named by the hash of its name:
+// .data is as large as the object with holes where blocks are missing,
+// .bitmap has a bit per block fetched, and .json the validators of the
+// object the blocks belong to. They survive restarts. Once the blocks of all
+// objects take more than maxSize, the objects used least recently are
+// dropped.
+type originFS struct {
+	base      *url.URL
+	client    *http.Client
+	dir       string
+	blockSize int64
+	// ttl is how long an object is served without asking the origin whether
+	// it changed
+	ttl     time.Duration
+	maxSize int64 // of the cached blocks, 0 is unlimited
+
+	mu       sync.Mutex
+	objects  map[string]*originObject
+	size     int64 // of the cached blocks of all objects
+	evicting bool
+}
+
+func newOriginFS(base, dir string, blockSize int64, ttl time.Duration, maxSize int64) (*originFS, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid origin %q", base)
+	}
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid origin block size %d", blockSize)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DisableCompression = true // blocks are of the bytes the origin stores
+	tr.ResponseHeaderTimeout = originHeaderTimeout
+	return &originFS{
+		base:      u,
+		client:    &http.Client{Transport: tr},
+		dir:       dir,
+		blockSize: blockSize,
+		ttl:       ttl,
+		maxSize:   maxSize,
+		objects:   map[string]*originObject{},
+	}, nil
+}
+
+// originMeta is what the .json of an object holds.
+type originMeta struct {
+	URL          string    `json:"url"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func (m originMeta) same(n originMeta) bool {
+	return m.URL == n.URL && m.Size == n.Size && m.ETag == n.ETag && m.LastModified.Equal(n.LastModified)
+}
+
+// originObject is an object of the origin and its cache.
+type originObject struct {
+	fsys *originFS
+	name string
+	path string    // of the cache files, without extension
+	used time.Time // last opened, guarded by fsys.mu
+
+	// readers hold reading while they read the data file, evict holds it
+	// exclusively to drop the blocks under them
+	reading sync.RWMutex
+
+	mu           sync.Mutex
+	meta         originMeta
+	checked      time.Time     // last time the origin confirmed meta
+	revalidating chan struct{} // closed once the revalidation in flight is done
+	notFound     bool
+	gen          int // increments when the object changed at the origin
+	data         *os.File
+	bitmap       []byte
+	cachedSize   int64 // of the blocks in bitmap
+	inflight     map[int64]*blockFetch
+}
+
+// blockFetch is a block being fetched, the readers of the block wait on done.
+type blockFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func (fsys *originFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return originDir{}, nil
+	}
+	o, gen, err := fsys.object(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &originFile{o: o, gen: gen}, nil
+}
+
+func (fsys *originFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// ReadDir lists nothing, an origin has no directory listing.
+func (fsys *originFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil, nil
+}
+
+// object returns the object name, revalidated with the origin if the ttl
+// passed, and its generation. The origin is asked without holding o.mu, and
+// while one reader asks, the others are served the cache as it is, unless
+// there is none yet.
+func (fsys *originFS) object(name string) (*originObject, int, error) {
+	fsys.mu.Lock()
+	o, ok := fsys.objects[name]
+	if !ok {
+		sum := sha256.Sum256([]byte(name))
+		o = &originObject{
+			fsys:     fsys,
+			name:     name,
+			path:     filepath.Join(fsys.dir, hex.EncodeToString(sum[:16])),
+			inflight: map[int64]*blockFetch{},
+		}
+		o.loadCache()
+		fsys.objects[name] = o
+		fsys.size += o.cachedSize
+	}
+	o.used = time.Now()
+	fsys.mu.Unlock()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.checked) > fsys.ttl {
+		switch {
+		case o.revalidating == nil:
+			done := make(chan struct{})
+			o.revalidating = done
+			meta := o.meta
+			o.mu.Unlock()
+			resp, err := o.ask(meta)
+			o.mu.Lock()
+			if err == nil {
+				err = o.revalidated(resp)
+			}
+			o.revalidating = nil
+			close(done)
+			if err != nil {
+				return nil, 0, err
+			}
+		case o.data == nil && !o.notFound:
+			// nothing to serve until the origin answers
+			done := o.revalidating
+			o.mu.Unlock()
+			<-done
+			o.mu.Lock()
+			if o.data == nil && !o.notFound {
+				return nil, 0, fmt.Errorf("origin %s: no answer", o.url())
+			}
+		}
+	}
+	if o.notFound {
+		return nil, 0, fs.ErrNotExist
+	}
+	return o, o.gen, nil
+}
+
+func (o *originObject) url() string {
+	return o.fsys.base.JoinPath(o.name).String()
+}
+
+// loadCache picks up the cache files of a previous run.
+func (o *originObject) loadCache() {
+	b, err := os.ReadFile(o.path + ".json")
+	if err != nil || json.Unmarshal(b, &o.meta) != nil || o.meta.URL != o.url() {
+		o.meta = originMeta{}
+		return
+	}
+	bitmap, err := os.ReadFile(o.path + ".bitmap")
+	data, derr := os.OpenFile(o.path+".data", os.O_RDWR, 0)
+	if err != nil || derr != nil || int64(len(bitmap)) != o.blocks()/8+1 {
+		if data != nil {
+			data.Close()
+		}
+		o.meta = originMeta{}
+		return
+	}
+	o.data, o.bitmap = data, bitmap
+	for i := int64(0); i < o.blocks(); i++ {
+		if o.cached(i) {
+			o.cachedSize += o.blockRange(i).length
+		}
+	}
+}
+
+// blocks is the number of blocks of the object.
+func (o *originObject) blocks() int64 {
+	return (o.meta.Size + o.fsys.blockSize - 1) / o.fsys.blockSize
+}
+
+// ask sends a HEAD for the object, conditional on the validators of meta if
+// it has any. A HEAD has the size and validators, and no body to download
+// from an origin without ranges.
+func (o *originObject) ask(meta originMeta) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", o.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	} else if !meta.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", meta.LastModified.UTC().Format(http.TimeFormat))
+	}
+	resp, err := o.fsys.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// revalidated applies the answer of ask. A changed object starts a new
+// cache. o.mu is held.
+func (o *originObject) revalidated(resp *http.Response) error {
+	meta := originMeta{URL: o.url(), ETag: resp.Header.Get("Etag")}
+	meta.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	o.notFound = false
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if o.data != nil {
+			o.checked = time.Now()
+			return nil
+		}
+		return fmt.Errorf("origin %s: 304 without a cache", o.url())
+	case http.StatusNotFound, http.StatusGone:
+		o.reset(originMeta{})
+		o.notFound, o.checked = true, time.Now()
+		return nil
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return fs.ErrPermission
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return fmt.Errorf("origin %s: HEAD without Content-Length", o.url())
+		}
+		meta.Size = resp.ContentLength
+	default:
+		return fmt.Errorf("origin %s: %s", o.url(), resp.Status)
+	}
+
+	if o.data == nil || !meta.same(o.meta) {
+		if err := o.reset(meta); err != nil {
+			return err
+		}
+		logf("origin %s: %d bytes, etag %s, cache %s\n", o.url(), meta.Size, meta.ETag, o.path)
+	}
+	o.checked = time.Now()
+	return nil
+}
+
+// reset starts a new, empty cache for meta. o.mu is held.
+func (o *originObject) reset(meta originMeta) error {
+	if o.data != nil {
+		o.data.Close()
+		o.data = nil
+	}
+	o.fsys.grow(-o.cachedSize)
+	o.cachedSize = 0
+	o.gen++
+	o.meta = meta
+	os.Remove(o.path + ".json")
+	if meta.URL == "" {
+		os.Remove(o.path + ".data")
+		os.Remove(o.path + ".bitmap")
+		return nil
+	}
+	data, err := os.Create(o.path + ".data")
+	if err != nil {
+		return err
+	}
+	if err := data.Truncate(meta.Size); err != nil { // a hole, no disk used yet
+		data.Close()
+		return err
+	}
+	o.bitmap = make([]byte, o.blocks()/8+1)
+	if err := os.WriteFile(o.path+".bitmap", o.bitmap, 0o644); err != nil {
+		data.Close()
+		return err
+	}
+	b, _ := json.Marshal(meta)
+	if err := os.WriteFile(o.path+".json", b, 0o644); err != nil {
+		data.Close()
+		return err
+	}
+	o.data = data
+	return nil
+}
+
+// blockRange is the range of the object block i covers.
+func (o *originObject) blockRange(i int64) httpRange {
+	start := i * o.fsys.blockSize
+	return httpRange{start: start, length: min(o.fsys.blockSize, o.meta.Size-start)}
+}
+
+func (o *originObject) cached(i int64) bool {
+	return o.bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// writeBlock writes the bytes of ra from r to the data file.
+func writeBlock(data *os.File, ra httpRange, r io.Reader) error {
+	_, err := io.CopyN(io.NewOffsetWriter(data, ra.start), r, ra.length)
+	return err
+}
+
+// mark marks block i as cached, after its bytes are written. o.mu is held.
+func (o *originObject) mark(i int64) error {
+	if o.cached(i) {
+		return nil
+	}
+	o.bitmap[i/8] |= 1 << (i % 8)
+	o.cachedSize += o.blockRange(i).length
+	o.fsys.grow(o.blockRange(i).length)
+	f, err := os.OpenFile(o.path+".bitmap", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(o.bitmap[i/8:i/8+1], i/8)
+	return err
+}
+
+// block makes sure block i of generation gen is in the cache. Readers of a
+// block being fetched wait for that fetch rather than starting their own.
+func (o *originObject) block(i int64, gen int) error {
+	o.mu.Lock()
+	if o.gen != gen {
+		o.mu.Unlock()
+		return fmt.Errorf("%s changed at the origin", o.name)
+	}
+	if o.cached(i) {
+		o.mu.Unlock()
+		return nil
+	}
+	if f, ok := o.inflight[i]; ok {
+		o.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &blockFetch{done: make(chan struct{})}
+	o.inflight[i] = f
+	meta, data, ra := o.meta, o.data, o.blockRange(i)
+	o.mu.Unlock()
+
+	body, got, err := o.fetch(meta, ra)
+	if err == nil {
+		err = writeBlock(data, got, body)
+		body.Close()
+	}
+	o.mu.Lock()
+	switch {
+	case err != nil:
+	case o.gen != gen:
+		err = fmt.Errorf("%s changed at the origin", o.name)
+	default:
+		// all of the blocks of got, more than i if the origin sent it all
+		for j := got.start / o.fsys.blockSize; j*o.fsys.blockSize < got.start+got.length && err == nil; j++ {
+			err = o.mark(j)
+		}
+	}
+	delete(o.inflight, i)
+	o.mu.Unlock()
+	f.err = err
+	close(f.done)
+	return err
+}
+
+// fetch asks the origin for ra, if it is still the object of meta. It
+// returns the body and the range it has, all of the object if the origin
+// has no ranges.
+func (o *originObject) fetch(meta originMeta, ra httpRange) (io.ReadCloser, httpRange, error) {
+	req, err := http.NewRequest("GET", meta.URL, nil)
+	if err != nil {
+		return nil, ra, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", ra.start, ra.start+ra.length-1))
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		req.Header.Set("If-Range", meta.ETag)
+	} else if !meta.LastModified.IsZero() {
+		req.Header.Set("If-Range", meta.LastModified.UTC().Format(http.TimeFormat))
+	}
+	resp, err := o.fsys.client.Do(req)
+	if err != nil {
+		return nil, ra, err
+	}
+	if resp.StatusCode == http.StatusPartialContent && resp.Header.Get("Content-Range") == ra.contentRange(meta.Size) {
+		logf("origin %s: fetched %s\n", meta.URL, resp.Header.Get("Content-Range"))
+		return resp.Body, ra, nil
+	}
+	if resp.StatusCode == http.StatusOK && resp.ContentLength == meta.Size && sameValidators(meta, resp.Header) {
+		// the origin has no ranges, it sent the object once and for all
+		logf("origin %s: fetched all %d bytes, no ranges\n", meta.URL, meta.Size)
+		return resp.Body, httpRange{start: 0, length: meta.Size}, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		// If-Range failed, the origin has another object now
+		o.mu.Lock()
+		o.checked = time.Time{}
+		o.mu.Unlock()
+		return nil, ra, fmt.Errorf("%s changed at the origin", o.name)
+	}
+	return nil, ra, fmt.Errorf("origin %s: %s for %s", meta.URL, resp.Status, ra.contentRange(meta.Size))
+}
+
+// sameValidators reports whether the validators of h are the ones of meta.
+func sameValidators(meta originMeta, h http.Header) bool {
+	if meta.ETag != "" {
+		return h.Get("Etag") == meta.ETag
+	}
+	t, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !meta.LastModified.IsZero() && t.Equal(meta.LastModified)
+}
+
+// grow adds n to the size of the cache, and drops objects if it is beyond
+// maxSize.
+func (fsys *originFS) grow(n int64) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.size += n
+	if fsys.maxSize > 0 && fsys.size > fsys.maxSize && !fsys.evicting {
+		// not here, the caller holds the lock of an object
+		fsys.evicting = true
+		go fsys.evict()
+	}
+}
+
+// evict drops the blocks of the objects used least recently until the cache
+// fits in maxSize. The object used last is kept, even if it alone doesn't
+// fit.
+func (fsys *originFS) evict() {
+	fsys.mu.Lock()
+	objects := make([]*originObject, 0, len(fsys.objects))
+	for _, o := range fsys.objects {
+		objects = append(objects, o)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].used.Before(objects[j].used) })
+	fsys.mu.Unlock()
+
+	for _, o := range objects[:max(len(objects)-1, 0)] {
+		fsys.mu.Lock()
+		fits := fsys.size <= fsys.maxSize
+		fsys.mu.Unlock()
+		if fits {
+			break
+		}
+		o.drop()
+	}
+	fsys.mu.Lock()
+	fsys.evicting = false
+	fsys.mu.Unlock()
+}
+
+// drop empties the cache of o, keeping its validators, its data file is
+// truncated to free the disk of its blocks. Readers wait until it is done.
+func (o *originObject) drop() {
+	o.reading.Lock()
+	defer o.reading.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cachedSize == 0 || o.data == nil {
+		return
+	}
+	if o.data.Truncate(0) != nil || o.data.Truncate(o.meta.Size) != nil {
+		return
+	}
+	clear(o.bitmap)
+	os.WriteFile(o.path+".bitmap", o.bitmap, 0o644)
+	logf("origin %s: dropped %d cached bytes\n", o.url(), o.cachedSize)
+	o.fsys.grow(-o.cachedSize)
+	o.cachedSize = 0
+}
+
+// originFile reads an object of generation gen through its cache.
+type originFile struct {
+	o      *originObject
+	gen    int
+	offset int64
+}
+
+func (f *originFile) Stat() (fs.FileInfo, error) {
+	f.o.mu.Lock()
+	defer f.o.mu.Unlock()
+	return originInfo{name: path.Base(f.o.name), meta: f.o.meta}, nil
+}
+
+// Read reads up to the end of the block at the offset, fetching the block
+// if it isn't cached.
+func (f *originFile) Read(p []byte) (int, error) {
+	o := f.o
+	o.reading.RLock()
+	defer o.reading.RUnlock()
+	o.mu.Lock()
+	size, data := o.meta.Size, o.data
+	o.mu.Unlock()
+	if f.offset >= size {
+		return 0, io.EOF
+	}
+	i := f.offset / o.fsys.blockSize
+	if err := o.block(i, f.gen); err != nil {
+		return 0, err
+	}
+	ra := o.blockRange(i)
+	p = p[:min(int64(len(p)), ra.start+ra.length-f.offset)]
+	n, err := data.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *originFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.o.mu.Lock()
+		offset += f.o.meta.Size
+		f.o.mu.Unlock()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *originFile) Close() error { return nil }
+
+type originInfo struct {
+	name string
+	meta originMeta
+}
+
+func (fi originInfo) Name() string       { return fi.name }
+func (fi originInfo) Size() int64        { return fi.meta.Size }
+func (fi originInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi originInfo) ModTime() time.Time { return fi.meta.LastModified }
+func (fi originInfo) IsDir() bool        { return false }
+func (fi originInfo) Sys() any           { return nil }
+
+// originDir is the root of an originFS, an empty directory.
+type originDir struct{}
+
+func (originDir) Stat() (fs.FileInfo, error) { return originDirInfo{}, nil }
+func (originDir) Read([]byte) (int, error)   { return 0, io.EOF }
+func (originDir) Close() error               { return nil }
+
+func (originDir) ReadDir(int) ([]fs.DirEntry, error) { return nil, nil }
+
+type originDirInfo struct{}
+
+func (originDirInfo) Name() string       { return "." }
+func (originDirInfo) Size() int64        { return 0 }
+func (originDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (originDirInfo) ModTime() time.Time { return time.Time{} }
+func (originDirInfo) IsDir() bool        { return true }
+func (originDirInfo) Sys() any           { return nil }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOrigin serves video.mp4 with ranges, unless noRanges, and counts the
+// responses with a body it sends.
+type testOrigin struct {
+	mu       sync.Mutex
+	content  []byte
+	modtime  time.Time
+	noRanges bool
+
+	fetches atomic.Int64 // 206 responses
+	fulls   atomic.Int64 // 200 responses to a GET
+	delay   time.Duration
+	slow    time.Duration // between the headers and the body of a GET
+}
+
+func (o *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/media/video.mp4" {
+		http.NotFound(w, r)
+		return
+	}
+	o.mu.Lock()
+	content, modtime := o.content, o.modtime
+	o.mu.Unlock()
+	time.Sleep(o.delay)
+	if o.noRanges {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+	w.Header().Set("Etag", fmt.Sprintf(`"%d"`, modtime.Unix()))
+	rec := &statusRecorder{ResponseWriter: w}
+	if r.Method == "GET" {
+		rec.slow = o.slow
+	}
+	http.ServeContent(rec, r, "video.mp4", modtime, bytes.NewReader(content))
+	switch {
+	case rec.status == http.StatusPartialContent:
+		o.fetches.Add(1)
+	case rec.status == http.StatusOK && r.Method == "GET":
+		o.fulls.Add(1)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	slow   time.Duration
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+	if w.slow > 0 {
+		w.ResponseWriter.(http.Flusher).Flush()
+		time.Sleep(w.slow)
+	}
+}
+
+// getRange asks h for rangeHeader of video.mp4.
+func getRange(h http.Handler, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/video.mp4", nil)
+	req.Header.Set("Range", rangeHeader)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOriginFS(t *testing.T) {
+	quietLog(t)
+	origin := &testOrigin{
+		content: bytes.Repeat([]byte("0123456789"), 1000),
+		modtime: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	srv := httptest.NewServer(origin)
+	defer srv.Close()
+	cache := t.TempDir()
+	newHandler := func() *mediaHandler {
+		fsys, err := newOriginFS(srv.URL+"/media/", cache, 1000, time.Hour, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &mediaHandler{fsys: fsys}
+	}
+	h := newHandler()
+	get := func(h *mediaHandler, rangeHeader string) *httptest.ResponseRecorder {
+		return getRange(h, rangeHeader)
+	}
+	expect := func(rec *httptest.ResponseRecorder, body string, fetches int64) {
+		t.Helper()
+		if rec.Code != 206 || rec.Body.String() != body {
+			t.Fatalf("status %d, body %.40q, want %.40q", rec.Code, rec.Body, body)
+		}
+		if n := origin.fetches.Load(); n != fetches {
+			t.Fatalf("%d fetches from the origin, want %d", n, fetches)
+		}
+	}
+
+	// a HEAD for the size, then one block per range
+	expect(get(h, "bytes=2500-2504"), "01234", 1)
+	expect(get(h, "bytes=10-19"), "0123456789", 2)
+	expect(get(h, "bytes=2990-3009"), "01234567890123456789", 3)
+	if cr := get(h, "bytes=9995-").Header().Get("Content-Range"); cr != "bytes 9995-9999/10000" {
+		t.Errorf("Content-Range %q", cr)
+	}
+
+	// concurrent readers of a block wait for one fetch
+	origin.delay = 50 * time.Millisecond
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expect(get(h, "bytes=5000-5009"), "0123456789", 5)
+		}()
+	}
+	wg.Wait()
+	origin.delay = 0
+
+	// the cache outlives the process, a 304 confirms it
+	expect(get(newHandler(), "bytes=2500-2504"), "01234", 5)
+
+	// a changed object is fetched again
+	origin.mu.Lock()
+	origin.content = []byte(strings.Repeat("abcdefghij", 500))
+	origin.modtime = origin.modtime.Add(time.Hour)
+	origin.mu.Unlock()
+	h = newHandler()
+	expect(get(h, "bytes=2500-2504"), "abcde", 6)
+	if rec := get(h, "bytes=5000-"); rec.Code != 416 || rec.Header().Get("Content-Range") != "bytes */5000" {
+		t.Errorf("beyond the new size: %d %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/missing.mp4", nil))
+	if rec.Code != 404 {
+		t.Errorf("missing object: %d", rec.Code)
+	}
+	f, err := h.fsys.Open("video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || len(b) != 5000 {
+		t.Errorf("ReadAll: %d bytes, %v", len(b), err)
+	}
+}
+
+func TestOriginFSRevalidation(t *testing.T) {
+	quietLog(t)
+	origin := &testOrigin{
+		content: bytes.Repeat([]byte("0123456789"), 1000),
+		modtime: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	srv := httptest.NewServer(origin)
+	defer srv.Close()
+	fsys, err := newOriginFS(srv.URL+"/media/", t.TempDir(), 1000, time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &mediaHandler{fsys: fsys}
+	if rec := getRange(h, "bytes=0-9"); rec.Code != 206 {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	// while one reader waits on a slow origin, the others read the cache
+	origin.delay = time.Second
+	time.Sleep(2 * time.Millisecond)
+	go getRange(h, "bytes=0-9")
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if rec := getRange(h, "bytes=0-9"); rec.Code != 206 || rec.Body.String() != "0123456789" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body)
+	}
+	if d := time.Since(start); d > origin.delay/2 {
+		t.Errorf("reader blocked %v on the revalidation of another", d)
+	}
+}
+
+func TestOriginFSNoRanges(t *testing.T) {
+	quietLog(t)
+	origin := &testOrigin{
+		content:  bytes.Repeat([]byte("0123456789"), 1000),
+		modtime:  time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+		noRanges: true,
+	}
+	srv := httptest.NewServer(origin)
+	defer srv.Close()
+	fsys, err := newOriginFS(srv.URL+"/media/", t.TempDir(), 1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &mediaHandler{fsys: fsys}
+	// every request revalidates with a HEAD, the body is downloaded once
+	for _, r := range []string{"bytes=2500-2504", "bytes=9000-9004", "bytes=10-14"} {
+		if rec := getRange(h, r); rec.Code != 206 || rec.Body.String() != "01234" {
+			t.Errorf("%s: status %d, body %q", r, rec.Code, rec.Body)
+		}
+	}
+	if n := origin.fulls.Load(); n != 1 {
+		t.Errorf("%d downloads of the object, want 1", n)
+	}
+}
+
+// TestOriginFSSlowBody reads a block whose body takes longer than the
+// origin may take to answer.
+func TestOriginFSSlowBody(t *testing.T) {
+	quietLog(t)
+	defer func(d time.Duration) { originHeaderTimeout = d }(originHeaderTimeout)
+	originHeaderTimeout = 100 * time.Millisecond
+	origin := &testOrigin{
+		content: bytes.Repeat([]byte("0123456789"), 1000),
+		modtime: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+		slow:    300 * time.Millisecond,
+	}
+	srv := httptest.NewServer(origin)
+	defer srv.Close()
+	fsys, err := newOriginFS(srv.URL+"/media/", t.TempDir(), 1000, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &mediaHandler{fsys: fsys}
+	if rec := getRange(h, "bytes=2500-2504"); rec.Code != 206 || rec.Body.String() != "01234" {
+		t.Errorf("slow body: status %d, body %q", rec.Code, rec.Body)
+	}
+
+	// an origin that doesn't answer at all still times out
+	origin.slow, origin.delay = 0, 300*time.Millisecond
+	fsys, err = newOriginFS(srv.URL+"/media/", t.TempDir(), 1000, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if rec := getRange(&mediaHandler{fsys: fsys}, "bytes=2500-2504"); rec.Code == 206 {
+		t.Errorf("no answer: status %d", rec.Code)
+	}
+	if d := time.Since(start); d >= 300*time.Millisecond {
+		t.Errorf("gave up on the origin after %v", d)
+	}
+}
+
+func TestOriginFSEviction(t *testing.T) {
+	quietLog(t)
+	origin := &testOrigin{
+		content: bytes.Repeat([]byte("0123456789"), 1000),
+		modtime: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	srv := httptest.NewServer(origin)
+	defer srv.Close()
+	fsys, err := newOriginFS(srv.URL+"/media/", t.TempDir(), 1000, time.Hour, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &mediaHandler{fsys: fsys}
+	for i := range 10 {
+		r := fmt.Sprintf("bytes=%d-%d", i*1000, i*1000+4)
+		if rec := getRange(h, r); rec.Code != 206 || rec.Body.String() != "01234" {
+			t.Fatalf("%s: status %d, body %q", r, rec.Code, rec.Body)
+		}
+	}
+	// one object alone is kept even beyond the limit, a second one is not
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = "/media/video.mp4"
+		origin.ServeHTTP(w, r)
+	})
+	req := httptest.NewRequest("GET", "/other.mp4", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	deadline := time.Now().Add(time.Second)
+	for {
+		fsys.mu.Lock()
+		size := fsys.size
+		fsys.mu.Unlock()
+		if size <= 3000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache of %d bytes, limit 3000", size)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the dropped blocks are fetched again
+	n := origin.fetches.Load()
+	if rec := getRange(h, "bytes=0-4"); rec.Body.String() != "01234" || origin.fetches.Load() != n+1 {
+		t.Errorf("body %q, %d fetches, want %d", rec.Body, origin.fetches.Load(), n+1)
+	}
+}
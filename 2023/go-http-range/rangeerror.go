@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"example.zeng.dev/httprange"
+)
+
+// maxRanges is the most ranges served as one multipart/byteranges response,
+// counted after coalescing. RFC 9110 14.2 lets a server reject a set of many
+// small ranges, which costs a part header and a seek each.
+var maxRanges = 32
+
+// problem is a problem details object of RFC 9457, the body of the error
+// responses of rangeVideo.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	// extension members, what a client needs to fix its request
+	Range     string `json:"range,omitempty"`
+	Size      int64  `json:"size"`
+	MaxRanges int    `json:"max_ranges,omitempty"`
+}
+
+// problem types, each one a section of RFC 9110 saying why
+const (
+	problemNoOverlap = "https://www.rfc-editor.org/rfc/rfc9110#section-15.5.17"
+	problemTooMany   = "https://www.rfc-editor.org/rfc/rfc9110#section-14.2"
+)
+
+// rangeError answers a Range header s that parseRange failed with err.
+//
+// A header that doesn't parse or has a unit other than bytes is ignored, as
+// RFC 9110 14.2 requires for units and allows for the rest: the whole file
+// is sent with a 200. Ranges that are all beyond the end get a 416 with
+// Content-Range "bytes */size", which tells the client the current size to
+// resynchronize with.
+func rangeError(w http.ResponseWriter, req *http.Request, content io.Reader, s string, size int64, err error) {
+	if errors.Is(err, errNoOverlap) {
+		rangeNotSatisfiable(w, req, size, problem{
+			Type:   problemNoOverlap,
+			Title:  "Range Not Satisfiable",
+			Detail: fmt.Sprintf("no range of %q overlaps the %d bytes of %s", s, size, req.URL.Path),
+			Range:  s,
+		})
+		return
+	}
+	unit, _, _ := strings.Cut(s, "=")
+	if !strings.EqualFold(unit, "bytes") {
+		logf("ignore Range of unit %q, response 200, %d bytes\n", unit, size)
+	} else {
+		logf("ignore invalid Range %q: %v, response 200, %d bytes\n", s, err, size)
+	}
+	serveFull(w, req, content, size)
+}
+
+// tooManyRanges answers a request of more than maxRanges ranges with a 416.
+func tooManyRanges(w http.ResponseWriter, req *http.Request, s string, n int, size int64) {
+	rangeNotSatisfiable(w, req, size, problem{
+		Type:      problemTooMany,
+		Title:     "Too Many Ranges",
+		Detail:    fmt.Sprintf("%d ranges after coalescing, at most %d are served", n, maxRanges),
+		Range:     s,
+		MaxRanges: maxRanges,
+	})
+}
+
+// rangeNotSatisfiable sends p as a 416 with the Content-Range of RFC 9110
+// 15.5.17. The headers of the representation rangeVideo has already set,
+// like Content-Encoding, don't describe the problem body and are dropped,
+// the validators are kept.
+func rangeNotSatisfiable(w http.ResponseWriter, req *http.Request, size int64, p problem) {
+	p.Status = http.StatusRequestedRangeNotSatisfiable
+	p.Size = size
+	body, _ := json.Marshal(p)
+	body = append(body, '\n')
+
+	h := w.Header()
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("Content-Range", httprange.Unsatisfied(size))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(p.Status)
+	logf("response 416 %s: %s\n\n", p.Title, p.Detail)
+	if req.Method != "HEAD" {
+		w.Write(body)
+	}
+}
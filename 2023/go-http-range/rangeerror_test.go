@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRangeErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "video.mp4"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(n int) { maxRanges = n }(maxRanges)
+	maxRanges = 4
+	many := "bytes=0-0" + strings.Repeat(",2-2,4-4,6-6,8-8", 10) // 5 after coalescing
+
+	for _, tt := range []struct {
+		method, rangeHeader string
+		wantCode            int
+		wantBody            string
+		problemType         string
+	}{
+		{"GET", "bytes=10-", 416, "", problemNoOverlap},
+		{"GET", "bytes=20-29,-0", 416, "", problemNoOverlap},
+		{"HEAD", "bytes=10-", 416, "", ""},
+		{"GET", many, 416, "", problemTooMany},
+		// ignored, the whole file
+		{"GET", "bytes=5-2", 200, "0123456789", ""},
+		{"GET", "bytes=", 200, "0123456789", ""},
+		{"GET", "items=0-1", 200, "0123456789", ""},
+	} {
+		req := httptest.NewRequest(tt.method, "/video.mp4", nil)
+		req.Header.Set("Range", tt.rangeHeader)
+		rec := httptest.NewRecorder()
+		rangeVideo(rec, req, os.DirFS(dir), "video.mp4")
+
+		if rec.Code != tt.wantCode {
+			t.Fatalf("%s Range %q: status %d, want %d", tt.method, tt.rangeHeader, rec.Code, tt.wantCode)
+		}
+		if rec.Code != 416 {
+			if rec.Body.String() != tt.wantBody || rec.Header().Get("Content-Range") != "" {
+				t.Errorf("Range %q: body %q, Content-Range %q", tt.rangeHeader, rec.Body, rec.Header().Get("Content-Range"))
+			}
+			continue
+		}
+		if cr := rec.Header().Get("Content-Range"); cr != "bytes */10" {
+			t.Errorf("Range %q: Content-Range %q, want bytes */10", tt.rangeHeader, cr)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("Range %q: Content-Type %q", tt.rangeHeader, ct)
+		}
+		if tt.method == "HEAD" {
+			if rec.Body.Len() != 0 {
+				t.Errorf("HEAD got a body %q", rec.Body)
+			}
+			continue
+		}
+		var p problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Fatalf("Range %q: %v of body %q", tt.rangeHeader, err, rec.Body)
+		}
+		if p.Type != tt.problemType || p.Status != 416 || p.Size != 10 || p.Range != tt.rangeHeader {
+			t.Errorf("Range %q: problem %+v", tt.rangeHeader, p)
+		}
+	}
+}
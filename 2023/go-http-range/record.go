@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// recorder writes a trace of every request if set.
+var recorder *traceRecorder
+
+// traceHeaders are the request headers a trace keeps, the ones that decide
+// what a range server answers.
+var traceHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Accept-Encoding"}
+
+// traceResponseHeaders are the response headers a trace keeps.
+var traceResponseHeaders = []string{"Content-Type", "Content-Range", "Content-Length", "Content-Encoding", "Accept-Ranges", "Etag"}
+
+// traceEntry is a request and its response in a trace, one JSON line each.
+// Entries of a session, the requests of one browser on one host, are
+// numbered by Seq and timed from the first request of the session.
+type traceEntry struct {
+	Client     string            `json:"client"`
+	Agent      string            `json:"agent,omitempty"`
+	Seq        int               `json:"seq"`
+	Time       time.Time         `json:"time"`
+	OffsetMs   float64           `json:"offset_ms"`
+	Proto      string            `json:"proto,omitempty"`
+	Method     string            `json:"method"`
+	URI        string            `json:"uri"`
+	Header     map[string]string `json:"header,omitempty"`
+	Status     int               `json:"status"`
+	RespHeader map[string]string `json:"resp_header,omitempty"`
+	Bytes      int               `json:"bytes"`
+	BodySHA256 string            `json:"body_sha256"`
+	DurationMs float64           `json:"duration_ms"`
+	Err        string            `json:"err,omitempty"`
+}
+
+func (e *traceEntry) session() string {
+	return e.Client + " " + e.Agent
+}
+
+// traceRecorder appends trace entries to a JSON lines file.
+type traceRecorder struct {
+	mu       sync.Mutex
+	f        *os.File
+	enc      *json.Encoder
+	sessions map[string]*traceSession
+}
+
+type traceSession struct {
+	start time.Time
+	seq   int
+	seen  time.Time
+}
+
+// traceSessionTTL is how long an idle session is kept, the next request of
+// its client starts a new one from seq 1.
+const traceSessionTTL = 10 * time.Minute
+
+func openTraceRecorder(name string) (*traceRecorder, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &traceRecorder{f: f, enc: json.NewEncoder(f), sessions: map[string]*traceSession{}}, nil
+}
+
+// begin numbers a new entry of its session.
+func (t *traceRecorder) begin(e *traceEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, s := range t.sessions {
+		if e.Time.Sub(s.seen) > traceSessionTTL {
+			delete(t.sessions, k)
+		}
+	}
+	s, ok := t.sessions[e.session()]
+	if !ok {
+		s = &traceSession{start: e.Time}
+		t.sessions[e.session()] = s
+	}
+	s.seq++
+	s.seen = e.Time
+	e.Seq, e.OffsetMs = s.seq, float64(e.Time.Sub(s.start).Microseconds())/1000
+}
+
+func (t *traceRecorder) write(e *traceEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.enc.Encode(e)
+}
+
+// withRecord records the request and response of ha into recorder. The body
+// is hashed rather than kept, which is enough to tell if two servers sent
+// the same bytes.
+func withRecord(ha func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if recorder == nil {
+			ha(w, r)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		e := &traceEntry{
+			Client: client,
+			Agent:  r.UserAgent(),
+			Time:   time.Now(),
+			Proto:  r.Proto,
+			Method: r.Method,
+			URI:    r.URL.RequestURI(),
+			Header: pickHeaders(r.Header, traceHeaders),
+		}
+		recorder.begin(e)
+
+		body := sha256.New()
+		ww := &basicWriter{ResponseWriter: w, tee: body}
+		ha(ww, r)
+
+		finishEntry(e, ww.Status(), ww.Header(), ww.BytesWritten(), body, time.Since(e.Time))
+		if err := recorder.write(e); err != nil {
+			accessLog.Error("record", "err", err)
+		}
+	}
+}
+
+func finishEntry(e *traceEntry, code int, header http.Header, bytes int, body hash.Hash, elapsed time.Duration) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	e.Status = code
+	e.RespHeader = pickHeaders(header, traceResponseHeaders)
+	e.Bytes = bytes
+	e.BodySHA256 = hex.EncodeToString(body.Sum(nil))
+	e.DurationMs = float64(elapsed.Microseconds()) / 1000
+}
+
+func pickHeaders(h http.Header, keys []string) map[string]string {
+	var m map[string]string
+	for _, k := range keys {
+		if v := h.Get(k); v != "" {
+			if m == nil {
+				m = map[string]string{}
+			}
+			m[k] = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayMain runs the replay command, which re-issues the sessions of a
+// trace recorded by -record against a server and prints the new trace. With
+// -diff it replays against two servers and prints where they answered
+// differently instead.
+func replayMain(args []string) error {
+	fl := flag.NewFlagSet("replay", flag.ExitOnError)
+	traceName := fl.String("trace", "trace.jsonl", "trace recorded by -record")
+	target := fl.String("target", "http://localhost:9100", "base URL of the server to replay against")
+	diff := fl.String("diff", "", "base URL of a second server, print the responses that differ from -target")
+	timing := fl.Bool("timing", false, "wait between the requests of a session as recorded, instead of sending them back to back")
+	insecure := fl.Bool("insecure", false, "skip verifying TLS certificates, e.g. the self-signed one of -tls")
+	fl.Parse(args)
+
+	entries, err := readTrace(*traceName)
+	if err != nil {
+		return err
+	}
+	client := replayClient(*insecure)
+	a := replay(client, *target, entries, *timing)
+	if *diff == "" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range a {
+			enc.Encode(e)
+		}
+		return nil
+	}
+
+	b := replay(client, *diff, entries, *timing)
+	n := 0
+	for i, e := range entries {
+		for _, d := range diffEntries(a[i], b[i]) {
+			fmt.Printf("%s #%d %s %s Range %q: %s\n", e.session(), e.Seq, e.Method, e.URI, e.Header["Range"], d)
+			n++
+		}
+	}
+	fmt.Printf("%d requests, %d differences between %s and %s\n", len(entries), n, *target, *diff)
+	if n > 0 {
+		return fmt.Errorf("%s and %s answered differently", *target, *diff)
+	}
+	return nil
+}
+
+func readTrace(name string) ([]traceEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []traceEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var e traceEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// replayClient sends requests as they are: no transparent gzip, which would
+// add an Accept-Encoding the trace doesn't have, and no redirects.
+func replayClient(insecure bool) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DisableCompression = true
+	if insecure {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// replay sends the entries to the server at base, the sessions concurrently
+// and the requests of a session in order. The result at i is the answer to
+// entries[i].
+func replay(client *http.Client, base string, entries []traceEntry, timing bool) []traceEntry {
+	sessions := map[string][]int{}
+	var order []string
+	for i, e := range entries {
+		if _, ok := sessions[e.session()]; !ok {
+			order = append(order, e.session())
+		}
+		sessions[e.session()] = append(sessions[e.session()], i)
+	}
+
+	results := make([]traceEntry, len(entries))
+	var wg sync.WaitGroup
+	for _, s := range order {
+		wg.Add(1)
+		go func(idx []int) {
+			defer wg.Done()
+			start := time.Now()
+			for _, i := range idx {
+				if timing {
+					time.Sleep(time.Until(start.Add(time.Duration(entries[i].OffsetMs * float64(time.Millisecond)))))
+				}
+				results[i] = replayOne(client, base, entries[i])
+				results[i].OffsetMs = float64(results[i].Time.Sub(start).Microseconds()) / 1000
+			}
+		}(sessions[s])
+	}
+	wg.Wait()
+	return results
+}
+
+func replayOne(client *http.Client, base string, e traceEntry) traceEntry {
+	r := traceEntry{
+		Client: e.Client,
+		Agent:  e.Agent,
+		Seq:    e.Seq,
+		Time:   time.Now(),
+		Method: e.Method,
+		URI:    e.URI,
+		Header: e.Header,
+	}
+	req, err := http.NewRequest(e.Method, strings.TrimSuffix(base, "/")+e.URI, nil)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	for k, v := range e.Header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", e.Agent)
+	resp, err := client.Do(req)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	defer resp.Body.Close()
+	r.Proto = resp.Proto
+	body := sha256.New()
+	n, err := io.Copy(body, resp.Body)
+	if err != nil {
+		r.Err = err.Error()
+	}
+	finishEntry(&r, resp.StatusCode, resp.Header, int(n), body, time.Since(r.Time))
+	return r
+}
+
+// diffEntries lists how two answers to the same request differ. ETags are
+// left out, they depend on the modification time of the file.
+func diffEntries(a, b traceEntry) []string {
+	var diffs []string
+	add := func(what string, x, y any) {
+		if x != y {
+			diffs = append(diffs, fmt.Sprintf("%s %v != %v", what, x, y))
+		}
+	}
+	add("err", a.Err, b.Err)
+	add("status", a.Status, b.Status)
+	for _, k := range traceResponseHeaders {
+		if k != "Etag" {
+			add(k, a.RespHeader[k], b.RespHeader[k])
+		}
+	}
+	add("bytes", a.Bytes, b.Bytes)
+	if a.Bytes == b.Bytes {
+		add("body sha256", a.BodySHA256, b.BodySHA256)
+	}
+	return diffs
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	quietLog(t)
+	mediaDir := func(content []byte) string {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "video.mp4"), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	server := func(dir string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(withRecord((&mediaHandler{fsys: os.DirFS(dir)}).ServeHTTP)))
+	}
+	dir := mediaDir(bytes.Repeat([]byte("0123456789"), 1000))
+	srv := server(dir)
+
+	trace := filepath.Join(t.TempDir(), "trace.jsonl")
+	var err error
+	if recorder, err = openTraceRecorder(trace); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { recorder = nil }()
+
+	for _, agent := range []string{"Chrome", "Firefox"} {
+		for _, ra := range []string{"", "bytes=0-", "bytes=100-199", "bytes=9990-"} {
+			req, _ := http.NewRequest("GET", srv.URL+"/video.mp4", nil)
+			req.Header.Set("User-Agent", agent)
+			if ra != "" {
+				req.Header.Set("Range", ra)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+	srv.Close() // waits for the handlers writing the trace
+	recorder.f.Close()
+	recorder = nil
+
+	entries, err := readTrace(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 8 {
+		t.Fatalf("got %d trace entries, want 8", len(entries))
+	}
+	if e := entries[6]; e.Agent != "Firefox" || e.Seq != 3 || e.Header["Range"] != "bytes=100-199" ||
+		e.Status != 206 || e.RespHeader["Content-Range"] != "bytes 100-199/10000" || e.Bytes != 100 {
+		t.Errorf("bad trace entry %+v", e)
+	}
+
+	// the same server answers the trace the same way
+	srv = server(dir)
+	defer srv.Close()
+	client := replayClient(false)
+	a := replay(client, srv.URL, entries, false)
+	for i := range entries {
+		if d := diffEntries(entries[i], a[i]); d != nil {
+			t.Errorf("replay of #%d differs from the recording: %v", i, d)
+		}
+	}
+
+	// a server with other bytes of the same size only differs in bodies
+	other := server(mediaDir(bytes.Repeat([]byte("abcdefghij"), 1000)))
+	defer other.Close()
+	b := replay(client, other.URL, entries, false)
+	for i := range entries {
+		d := diffEntries(a[i], b[i])
+		if len(d) != 1 || !strings.HasPrefix(d[0], "body sha256") {
+			t.Errorf("diff of #%d = %v, want only the body", i, d)
+		}
+	}
+}
+
+func TestTraceSessionExpiry(t *testing.T) {
+	rec, err := openTraceRecorder(filepath.Join(t.TempDir(), "trace.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.f.Close()
+	start := time.Now()
+	begin := func(client string, at time.Duration) *traceEntry {
+		e := &traceEntry{Client: client, Time: start.Add(at)}
+		rec.begin(e)
+		return e
+	}
+	begin("a", 0)
+	begin("b", 0)
+	if e := begin("a", time.Minute); e.Seq != 2 || e.OffsetMs != 60000 {
+		t.Errorf("second request of a: seq %d at %vms", e.Seq, e.OffsetMs)
+	}
+	// b is idle for longer than the TTL, a isn't
+	later := time.Minute + traceSessionTTL
+	if e := begin("a", later); e.Seq != 3 {
+		t.Errorf("third request of a: seq %d", e.Seq)
+	}
+	if _, ok := rec.sessions["b "]; ok {
+		t.Error("idle session of b is kept")
+	}
+	if e := begin("b", later); e.Seq != 1 || e.OffsetMs != 0 {
+		t.Errorf("b after the TTL: seq %d at %vms, want a new session", e.Seq, e.OffsetMs)
+	}
+}
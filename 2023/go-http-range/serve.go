@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// serveOptions are the protocols a range server speaks. Browsers schedule
+// range requests quite differently over HTTP/1.1, h2 and h3.
+type serveOptions struct {
+	addr     string // TCP address, and UDP address of HTTP/3
+	tls      bool   // HTTPS with HTTP/1.1 and h2
+	certFile string // a self-signed certificate is generated if empty
+	keyFile  string
+	h2c      bool // cleartext h2 with prior knowledge, without tls
+	h3       bool // HTTP/3 over QUIC, with tls
+
+	// timeouts of http.Server, 0 is none. A write timeout cuts off a chunk
+	// sent slower than it allows, e.g. by a throttle.
+	readHeaderTimeout, readTimeout, writeTimeout, idleTimeout time.Duration
+	// maxConns caps the TCP connections, more wait to be accepted, and
+	// maxConnsPerIP the ones of a client address, more are closed. 0 is no cap.
+	maxConns, maxConnsPerIP int
+	// shutdownTimeout is how long the transfers in flight at SIGINT or
+	// SIGTERM may take to finish before they are cut short.
+	shutdownTimeout time.Duration
+}
+
+// newServers returns the TCP server of opts, and the HTTP/3 server if
+// opts.h3. The TCP server advertises HTTP/3 by Alt-Svc.
+func newServers(opts serveOptions, handler http.Handler) (*http.Server, *http3.Server, error) {
+	srv := &http.Server{
+		Addr:              opts.addr,
+		Handler:           handler,
+		Protocols:         new(http.Protocols),
+		ReadHeaderTimeout: opts.readHeaderTimeout,
+		ReadTimeout:       opts.readTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+	}
+	srv.Protocols.SetHTTP1(true)
+	if !opts.tls {
+		if opts.h3 {
+			return nil, nil, errors.New("HTTP/3 needs TLS")
+		}
+		srv.Protocols.SetUnencryptedHTTP2(opts.h2c)
+		return srv, nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if opts.certFile != "" || opts.keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+	} else {
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	srv.Protocols.SetHTTP2(true)
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if !opts.h3 {
+		return srv, nil, nil
+	}
+
+	h3 := &http3.Server{
+		Addr:        opts.addr,
+		Handler:     handler,
+		TLSConfig:   http3.ConfigureTLSConfig(srv.TLSConfig.Clone()),
+		IdleTimeout: opts.idleTimeout,
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+	return srv, h3, nil
+}
+
+// listenAndServe serves handler, nil means http.DefaultServeMux, with the
+// protocols of opts until one of the listeners fails, or until SIGINT or
+// SIGTERM, which drains the transfers in flight. A second signal exits at
+// once.
+func listenAndServe(opts serveOptions, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ln, err := net.Listen("tcp", opts.addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		stop() // the default action again for a second signal
+	}()
+	return serve(ctx, opts, handler, ln)
+}
+
+// serve is listenAndServe on ln, shutting down when ctx is done.
+func serve(ctx context.Context, opts serveOptions, handler http.Handler, ln net.Listener) error {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	tr := &transfers{}
+	srv, h3, err := newServers(opts, tr.track(handler))
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	ln = newLimitListener(ln, opts.maxConns, opts.maxConnsPerIP)
+
+	errc := make(chan error, 2)
+	if opts.tls {
+		go func() { errc <- srv.ServeTLS(ln, "", "") }()
+	} else {
+		go func() { errc <- srv.Serve(ln) }()
+	}
+	if h3 != nil {
+		go func() { errc <- h3.ListenAndServe() }()
+	}
+	select {
+	case err := <-errc:
+		srv.Close()
+		if h3 != nil {
+			h3.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	active := tr.active.Load()
+	logf("\nshutdown: draining %d transfers for up to %s\n", active, opts.shutdownTimeout)
+	dctx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	if h3 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h3.Shutdown(dctx)
+		}()
+	}
+	srv.Shutdown(dctx)
+	wg.Wait()
+	cut := tr.active.Load()
+	if cut > 0 {
+		srv.Close()
+		if h3 != nil {
+			h3.Close()
+		}
+	}
+	logf("shutdown: %d transfers finished, %d cut short\n", max(active-cut, 0), cut)
+	return nil
+}
+
+// transfers counts the requests being served.
+type transfers struct {
+	active atomic.Int64
+}
+
+func (t *transfers) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.active.Add(1)
+		defer t.active.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitListener accepts at most max connections at a time, like
+// x/net/netutil.LimitListener, and closes the ones of a client address
+// beyond perIP.
+type limitListener struct {
+	net.Listener
+	sem   chan struct{} // nil without max
+	perIP int
+	done  chan struct{}
+	once  sync.Once
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newLimitListener(ln net.Listener, max, perIP int) net.Listener {
+	if max <= 0 && perIP <= 0 {
+		return ln
+	}
+	l := &limitListener{Listener: ln, perIP: perIP, done: make(chan struct{}), conns: map[string]int{}}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.sem != nil {
+			select {
+			case l.sem <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		l.mu.Lock()
+		if l.perIP > 0 && l.conns[ip] >= l.perIP {
+			l.mu.Unlock()
+			logf("%s has %d connections already, closing %s\n", ip, l.perIP, c.RemoteAddr())
+			c.Close()
+			l.release()
+			continue
+		}
+		l.conns[ip]++
+		l.mu.Unlock()
+		return &limitConn{Conn: c, l: l, ip: ip}, nil
+	}
+}
+
+func (l *limitListener) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	l    *limitListener
+	ip   string
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.l.mu.Lock()
+		if c.l.conns[c.ip]--; c.l.conns[c.ip] <= 0 {
+			delete(c.l.conns, c.ip)
+		}
+		c.l.mu.Unlock()
+		c.l.release()
+	})
+	return err
+}
+
+// selfSignedCert generates a certificate of localhost and this host. Its
+// SPKI hash is printed for Chrome's --ignore-certificate-errors-spki-list,
+// as Chrome won't use HTTP/3 with an untrusted certificate otherwise.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"go-http-range"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	logf("self-signed certificate of %v, SPKI sha256 %s\n", leaf.DNSNames, base64.StdEncoding.EncodeToString(spki[:]))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestServeProtocols(t *testing.T) {
+	var logs syncBuffer // written after the response, by the handler goroutines
+	defer func(l *slog.Logger) { accessLog = l }(accessLog)
+	accessLog = slog.New(slog.NewJSONHandler(&logs, nil))
+	handler := http.HandlerFunc(withLog(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	insecure := &tls.Config{InsecureSkipVerify: true}
+
+	get := func(client *http.Client, url, want string) http.Header {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != want || resp.Proto != want {
+			t.Errorf("GET %s over %s, handler saw %s, want %s", url, resp.Proto, body, want)
+		}
+		return resp.Header
+	}
+
+	// h2c with prior knowledge
+	srv, _, err := newServers(serveOptions{h2c: true}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	h2c := &http.Transport{Protocols: new(http.Protocols)}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	get(&http.Client{Transport: h2c}, "http://"+ln.Addr().String(), "HTTP/2.0")
+	get(&http.Client{}, "http://"+ln.Addr().String(), "HTTP/1.1")
+
+	// TLS with h2, and h3 advertised by Alt-Svc
+	srv, h3, err := newServers(serveOptions{tls: true, h3: true}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf := srv.TLSConfig.Certificates[0].Leaf; leaf.VerifyHostname("localhost") != nil {
+		t.Errorf("self-signed certificate of %v is not for localhost", leaf.DNSNames)
+	}
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skipf("no UDP on the port of TCP: %v", err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	go h3.Serve(udp)
+	defer h3.Close()
+
+	https := &http.Transport{TLSClientConfig: insecure, ForceAttemptHTTP2: true}
+	header := get(&http.Client{Transport: https}, "https://"+ln.Addr().String(), "HTTP/2.0")
+	if !strings.Contains(header.Get("Alt-Svc"), "h3=") {
+		t.Errorf("Alt-Svc = %q, want h3", header.Get("Alt-Svc"))
+	}
+	h3client := &http.Client{Transport: &http3.Transport{TLSClientConfig: insecure}}
+	get(h3client, "https://"+ln.Addr().String(), "HTTP/3.0")
+
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2.0", "HTTP/3.0"} {
+		if !strings.Contains(logs.String(), `"proto":"`+proto+`"`) {
+			t.Errorf("access log misses %s:\n%s", proto, logs.String())
+		}
+	}
+
+	if _, _, err := newServers(serveOptions{h3: true}, handler); err == nil {
+		t.Error("HTTP/3 without TLS should fail")
+	}
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestServeShutdown(t *testing.T) {
+	started := make(chan struct{}, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.URL.Path == "/short" {
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(w, "done")
+			return
+		}
+		// a transfer longer than the shutdown timeout
+		for i := 0; i < 100; i++ {
+			if _, err := w.Write(make([]byte, 1000)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- serve(ctx, serveOptions{shutdownTimeout: 300 * time.Millisecond}, handler, ln)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := map[string]chan result{}
+	for _, p := range []string{"/short", "/long"} {
+		results[p] = make(chan result, 1)
+		go func(c chan result) {
+			resp, err := http.Get("http://" + ln.Addr().String() + p)
+			if err != nil {
+				c <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			c <- result{string(body), err}
+		}(results[p])
+	}
+	<-started
+	<-started
+	start := time.Now()
+	cancel()
+
+	if r := <-results["/short"]; r.body != "done" || r.err != nil {
+		t.Errorf("the short transfer was not drained: %q, %v", r.body, r.err)
+	}
+	if r := <-results["/long"]; r.err == nil {
+		t.Errorf("the long transfer was not cut short, got %d bytes", len(r.body))
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown took %v", d)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(inner, 0, 1)
+	defer ln.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	get := func(c net.Conn) error {
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	first := dial()
+	if err := get(first); err != nil {
+		t.Fatal(err)
+	}
+	second := dial()
+	defer second.Close()
+	if err := get(second); err == nil {
+		t.Error("a second connection of the address was served")
+	}
+	first.Close()
+	time.Sleep(50 * time.Millisecond) // for the server to see the close
+	third := dial()
+	defer third.Close()
+	if err := get(third); err != nil {
+		t.Errorf("after the first closed: %v", err)
+	}
+}
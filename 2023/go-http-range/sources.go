@@ -0,0 +1,561 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"example.zeng.dev/httprange"
+)
+
+// openSource opens what -d names as an fs.FS rangeVideo serves from:
+//   - a directory, whose root is returned too for uploads
+//   - a .zip or .tar archive, members are served in place
+//   - an http(s) URL of an S3-compatible bucket or any server of ranges,
+//     read with a Range request per seek and nothing cached, see -origin
+//     for a cache
+//
+// Any other fs.FS, like an embed.FS, works as well, openfile makes the
+// files of an fs.FS seekable if they aren't.
+func openSource(spec string) (fs.FS, *os.Root, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		fsys, err := newBucketFS(spec, http.DefaultClient)
+		return fsys, nil, err
+	case strings.HasSuffix(spec, ".zip"):
+		fsys, err := openZipFS(spec)
+		return fsys, nil, err
+	case strings.HasSuffix(spec, ".tar"):
+		fsys, err := openTarFS(spec)
+		return fsys, nil, err
+	}
+	root, err := os.OpenRoot(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root.FS(), root, nil
+}
+
+// seekable makes f a mediaFile: as it is if it seeks, through its ReadAt if
+// it has one, and else by reading it again from the start of name for a seek
+// backwards, which is slow but right, e.g. for compressed zip members.
+func seekable(fsys fs.FS, name string, f fs.File, size int64) mediaFile {
+	switch sf := f.(type) {
+	case mediaFile:
+		return sf
+	case io.ReaderAt:
+		return &sectionFile{File: f, SectionReader: io.NewSectionReader(sf, 0, size)}
+	}
+	return &rereadFile{fsys: fsys, name: name, File: f}
+}
+
+// sectionFile is an fs.File read through a SectionReader.
+type sectionFile struct {
+	fs.File
+	*io.SectionReader
+}
+
+func (f *sectionFile) Read(p []byte) (int, error) { return f.SectionReader.Read(p) }
+
+// rereadFile seeks forwards by discarding and backwards by opening the file
+// again.
+type rereadFile struct {
+	fsys fs.FS
+	name string
+	fs.File
+	pos, target int64
+}
+
+func (f *rereadFile) Read(p []byte) (int, error) {
+	if f.target < f.pos {
+		nf, err := f.fsys.Open(f.name)
+		if err != nil {
+			return 0, err
+		}
+		f.File.Close()
+		f.File, f.pos = nf, 0
+	}
+	if f.target > f.pos {
+		n, err := io.CopyN(io.Discard, f.File, f.target-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.File.Read(p)
+	f.pos += int64(n)
+	f.target = f.pos
+	return n, err
+}
+
+func (f *rereadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.target
+	case io.SeekEnd:
+		finfo, err := f.File.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += finfo.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start")
+	}
+	f.target = offset
+	return offset, nil
+}
+
+// zipFS serves the members of a zip archive. Stored members are sections of
+// the archive and seek as fast as files, compressed ones are rereadFiles.
+type zipFS struct {
+	*zip.Reader
+	ra      io.ReaderAt
+	members map[string]*zip.File
+}
+
+func openZipFS(name string) (*zipFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := zip.NewReader(f, finfo.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return newZipFS(r, f), nil
+}
+
+func newZipFS(r *zip.Reader, ra io.ReaderAt) *zipFS {
+	z := &zipFS{Reader: r, ra: ra, members: map[string]*zip.File{}}
+	for _, m := range r.File {
+		z.members[m.Name] = m
+	}
+	return z
+}
+
+func (z *zipFS) Open(name string) (fs.File, error) {
+	f, err := z.Reader.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := z.members[name]
+	if !ok || m.Method != zip.Store || m.Flags&0x1 != 0 { // encrypted
+		return f, nil
+	}
+	offset, err := m.DataOffset()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sectionFile{File: f, SectionReader: io.NewSectionReader(z.ra, offset, int64(m.UncompressedSize64))}, nil
+}
+
+// tarFS serves the members of a tar archive from an index of where their
+// data starts, built by reading the headers once.
+type tarFS struct {
+	ra      io.ReaderAt
+	members map[string]*tarMember
+}
+
+type tarMember struct {
+	hdr    *tar.Header
+	offset int64
+	// children of a directory, by name
+	children map[string]*tarMember
+}
+
+func (m *tarMember) Name() string               { return path.Base(m.hdr.Name) }
+func (m *tarMember) IsDir() bool                { return m.hdr.Typeflag == tar.TypeDir }
+func (m *tarMember) Type() fs.FileMode          { return m.hdr.FileInfo().Mode().Type() }
+func (m *tarMember) Info() (fs.FileInfo, error) { return m.hdr.FileInfo(), nil }
+
+// countingReader counts the bytes read through it, which is where a tar
+// reader is in the archive.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func openTarFS(name string) (*tarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTarFS(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return t, nil
+}
+
+func newTarFS(ra io.ReaderAt) (*tarFS, error) {
+	t := &tarFS{ra: ra, members: map[string]*tarMember{}}
+	t.members["."] = &tarMember{hdr: &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0o555}, children: map[string]*tarMember{}}
+	cr := &countingReader{r: io.NewSectionReader(ra, 0, 1<<63-1)}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		default:
+			continue // links, devices and sparse files are left out
+		}
+		hdr.Name = name
+		t.add(&tarMember{hdr: hdr, offset: cr.n})
+	}
+}
+
+// add adds m and the directories above it that the archive doesn't have.
+func (t *tarFS) add(m *tarMember) {
+	if old, ok := t.members[m.hdr.Name]; ok && old.IsDir() && m.IsDir() {
+		old.hdr = m.hdr
+		return
+	}
+	if m.IsDir() {
+		m.children = map[string]*tarMember{}
+	}
+	t.members[m.hdr.Name] = m
+	dir := path.Dir(m.hdr.Name)
+	parent, ok := t.members[dir]
+	if !ok {
+		parent = &tarMember{hdr: &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o555, ModTime: m.hdr.ModTime}}
+		t.add(parent)
+	}
+	parent.children[path.Base(m.hdr.Name)] = m
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	m, ok := t.members[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &tarFile{m: m, SectionReader: io.NewSectionReader(t.ra, m.offset, m.hdr.Size)}, nil
+}
+
+type tarFile struct {
+	m *tarMember
+	*io.SectionReader
+	dirPos int
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.m.hdr.FileInfo(), nil }
+func (f *tarFile) Close() error               { return nil }
+
+func (f *tarFile) Read(p []byte) (int, error) {
+	if f.m.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.m.hdr.Name, Err: errors.New("is a directory")}
+	}
+	return f.SectionReader.Read(p)
+}
+
+func (f *tarFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.m.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.m.hdr.Name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, 0, len(f.m.children))
+	for _, c := range f.m.children {
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	entries = entries[f.dirPos:]
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	f.dirPos += len(entries)
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// bucketFS serves the objects of an S3-compatible bucket, or of any server
+// of ranges, at base. A HEAD gives the size and modification time, a read
+// streams from the offset with one open-ended Range request until the next
+// seek. Directories are listed by ListObjectsV2 if the server has it.
+type bucketFS struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func newBucketFS(base string, client *http.Client) (*bucketFS, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + "/")
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid bucket %q", base)
+	}
+	return &bucketFS{base: u, client: client}, nil
+}
+
+func (b *bucketFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &bucketDir{b: b, info: bucketInfo{name: ".", dir: true}}, nil
+	}
+	req, err := http.NewRequest("HEAD", b.base.JoinPath(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// a prefix of keys is a directory
+		if entries, err := b.list(name + "/"); err == nil && len(entries) > 0 {
+			return &bucketDir{b: b, info: bucketInfo{name: path.Base(name), dir: true}, key: name + "/", entries: entries}, nil
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("HEAD %s: %s", req.URL, resp.Status)}
+	}
+	if resp.ContentLength < 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("no Content-Length")}
+	}
+	info := bucketInfo{name: path.Base(name), size: resp.ContentLength}
+	info.modtime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &bucketFile{b: b, url: req.URL.String(), etag: resp.Header.Get("Etag"), info: info}, nil
+}
+
+// listBucketResult is the part of a ListObjectsV2 response a listing needs.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list lists the objects and prefixes right below prefix, following the
+// pages of a listing larger than the bucket answers at once.
+func (b *bucketFS) list(prefix string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		result, err := b.listPage(prefix, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.CommonPrefixes {
+			entries = append(entries, bucketInfo{name: path.Base(strings.TrimSuffix(p.Prefix, "/")), dir: true})
+		}
+		for _, c := range result.Contents {
+			if c.Key != prefix {
+				entries = append(entries, bucketInfo{name: path.Base(c.Key), size: c.Size, modtime: c.LastModified})
+			}
+		}
+		if !result.IsTruncated {
+			return entries, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, fmt.Errorf("list %s: truncated without a continuation token", prefix)
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// listPage gets the page of the listing of prefix that token continues.
+func (b *bucketFS) listPage(prefix, token string) (*listBucketResult, error) {
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	u := *b.base
+	u.RawQuery = q.Encode()
+	resp, err := b.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list %s: %s", prefix, resp.Status)
+	}
+	var result listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("list %s: %w", prefix, err)
+	}
+	return &result, nil
+}
+
+type bucketInfo struct {
+	name    string
+	size    int64
+	modtime time.Time
+	dir     bool
+}
+
+func (fi bucketInfo) Name() string               { return fi.name }
+func (fi bucketInfo) Size() int64                { return fi.size }
+func (fi bucketInfo) ModTime() time.Time         { return fi.modtime }
+func (fi bucketInfo) IsDir() bool                { return fi.dir }
+func (fi bucketInfo) Sys() any                   { return nil }
+func (fi bucketInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi bucketInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi bucketInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// bucketFile reads an object with Range requests, one per seek, and one
+// more whenever the server answered less than the rest of the object, as
+// servers capping open-ended ranges do. If-Range keeps it from mixing bytes
+// of two versions of the object.
+type bucketFile struct {
+	b    *bucketFS
+	url  string
+	etag string
+	info bucketInfo
+
+	offset int64
+	body   io.ReadCloser // of the response from offset, nil after a seek
+	end    int64         // of the bytes of body
+}
+
+func (f *bucketFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *bucketFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		req, err := http.NewRequest("GET", f.url, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		if f.etag != "" {
+			req.Header.Set("If-Range", f.etag)
+		}
+		resp, err := f.b.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		ra, size, err := httprange.ParseContentRange(resp.Header.Get("Content-Range"))
+		if resp.StatusCode != http.StatusPartialContent || err != nil || ra.Start != f.offset || size != f.info.size {
+			resp.Body.Close()
+			return 0, fmt.Errorf("GET %s from %d: %s, %s changed or has no ranges", f.url, f.offset, resp.Status, f.info.name)
+		}
+		f.body, f.end = resp.Body, ra.Start+ra.Length
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.info.size {
+		err = io.ErrUnexpectedEOF
+		if f.offset == f.end {
+			// the next Read asks for the rest
+			f.body.Close()
+			f.body, err = nil, nil
+		}
+	}
+	return n, err
+}
+
+func (f *bucketFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *bucketFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// bucketDir is a prefix of keys, its entries listed when read if not yet.
+type bucketDir struct {
+	b       *bucketFS
+	info    bucketInfo
+	key     string // the prefix, "" for the root
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *bucketDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *bucketDir) Read([]byte) (int, error)   { return 0, errors.New("is a directory") }
+func (d *bucketDir) Close() error               { return nil }
+
+func (d *bucketDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil && !d.listed {
+		var err error
+		if d.entries, err = d.b.list(d.key); err != nil {
+			return nil, err
+		}
+	}
+	d.listed = true
+	if n <= 0 {
+		entries := d.entries
+		d.entries = d.entries[len(d.entries):]
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	entries := d.entries[:min(n, len(d.entries))]
+	d.entries = d.entries[len(entries):]
+	return entries, nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go:embed media/favicon.ico
+var embedded embed.FS
+
+// fakeBucket is a MinIO-like object store: path-style /bucket/key objects
+// with ranges, ETag and Last-Modified, and ListObjectsV2 on the bucket.
+type fakeBucket struct {
+	bucket  string
+	objects map[string][]byte
+	modtime time.Time
+	// maxLength caps open-ended ranges, as rangeVideo does, if not 0
+	maxLength int64
+	// pageSize caps the keys and prefixes of a listing, if not 0
+	pageSize int
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+b.bucket+"/")
+	if !ok {
+		b.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" && r.URL.Query().Get("list-type") == "2" {
+		q := r.URL.Query()
+		b.list(w, q.Get("prefix"), q.Get("delimiter"), q.Get("continuation-token"))
+		return
+	}
+	content, ok := b.objects[key]
+	if !ok {
+		b.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("Etag", fmt.Sprintf(`"%x"`, len(content)))
+	if from, ok := strings.CutSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"); ok && b.maxLength > 0 {
+		start, _ := strconv.ParseInt(from, 10, 64)
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+b.maxLength-1))
+	}
+	http.ServeContent(w, r, key, b.modtime, bytes.NewReader(content))
+}
+
+func (b *fakeBucket) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+// list answers a page of the listing of prefix, continuing after the key or
+// prefix token if not empty.
+func (b *fakeBucket) list(w http.ResponseWriter, prefix, delimiter, token string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	type commonPrefix struct{ Prefix string }
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	result.Name, result.Prefix = b.bucket, prefix
+	// keys and prefixes in the order of the bucket, a page is the first
+	// pageSize of them after token
+	var names []string
+	prefixes := map[string]bool{}
+	for key := range b.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			key = prefix + rest[:i+1]
+			if prefixes[key] {
+				continue
+			}
+			prefixes[key] = true
+		}
+		if key > token {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	if b.pageSize > 0 && len(names) > b.pageSize {
+		names = names[:b.pageSize]
+		result.IsTruncated, result.NextContinuationToken = true, names[len(names)-1]
+	}
+	for _, name := range names {
+		if prefixes[name] {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{name})
+		} else {
+			result.Contents = append(result.Contents, content{name, int64(len(b.objects[name])), b.modtime})
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// noSeekFS hides Seek and ReadAt of the files of an fs.FS.
+type noSeekFS struct{ fs.FS }
+
+func (fsys noSeekFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(fsys.FS, name) }
+
+func (fsys noSeekFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		fs.File
+	}{f}, nil
+}
+
+func TestSources(t *testing.T) {
+	quietLog(t)
+	icon, err := embedded.ReadFile("media/favicon.ico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"favicon.ico":  icon,
+		"sub/clip.mp4": bytes.Repeat([]byte("0123456789"), 1000),
+	}
+	modtime := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	dir := t.TempDir()
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zipped := func(method uint16) fs.FS {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range []string{"favicon.ico", "sub/clip.mp4"} {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modtime})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(files[name])
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newZipFS(r, bytes.NewReader(buf.Bytes()))
+	}
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for _, name := range []string{"favicon.ico", "sub/clip.mp4"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(files[name])), ModTime: modtime})
+		tw.Write(files[name])
+	}
+	tw.Close()
+	tarFS, err := newTarFS(bytes.NewReader(tarball.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&fakeBucket{bucket: "media", objects: files, modtime: modtime})
+	defer srv.Close()
+	bucket, err := newBucketFS(srv.URL+"/media", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []struct {
+		name  string
+		fsys  fs.FS
+		files []string
+	}{
+		{"dir", os.DirFS(dir), nil},
+		{"embed", mustSub(t, embedded, "media"), []string{"favicon.ico"}},
+		{"stored zip", zipped(zip.Store), nil},
+		{"deflated zip", zipped(zip.Deflate), nil},
+		{"tar", tarFS, nil},
+		{"bucket", bucket, nil},
+		{"not seekable", noSeekFS{os.DirFS(dir)}, nil},
+	} {
+		t.Run(source.name, func(t *testing.T) {
+			h := &mediaHandler{fsys: source.fsys}
+			get := func(path, rangeHeader string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				if rangeHeader != "" {
+					req.Header.Set("Range", rangeHeader)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				return rec
+			}
+			names := source.files
+			if names == nil {
+				names = []string{"favicon.ico", "sub/clip.mp4"}
+			}
+			for _, name := range names {
+				content := files[name]
+				size := len(content)
+				for _, tt := range []struct {
+					rangeHeader string
+					from, to    int
+				}{
+					{"bytes=100-109", 100, 110},
+					{"bytes=-10", size - 10, size},
+					{"bytes=0-9", 0, 10}, // backwards after the end
+					{"bytes=500-", 500, size},
+				} {
+					rec := get("/"+name, tt.rangeHeader)
+					want := fmt.Sprintf("bytes %d-%d/%d", tt.from, tt.to-1, size)
+					if rec.Code != 206 || rec.Header().Get("Content-Range") != want || !bytes.Equal(rec.Body.Bytes(), content[tt.from:tt.to]) {
+						t.Errorf("%s %s: %d %q, body %.20q", name, tt.rangeHeader, rec.Code, rec.Header().Get("Content-Range"), rec.Body)
+					}
+				}
+				if rec := get("/"+name, "bytes=0-0,-1"); rec.Code != 206 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges") {
+					t.Errorf("%s multipart: %d %q", name, rec.Code, rec.Header().Get("Content-Type"))
+				}
+			}
+			if rec := get("/missing.mp4", ""); rec.Code != 404 {
+				t.Errorf("missing file: %d", rec.Code)
+			}
+			index := get("/", "").Body.String()
+			if !strings.Contains(index, `href="favicon.ico"`) {
+				t.Errorf("index misses favicon.ico:\n%s", index)
+			}
+			if source.files == nil && !strings.Contains(index, `href="sub/"`) {
+				t.Errorf("index misses sub/:\n%s", index)
+			}
+		})
+	}
+}
+
+func mustSub(t *testing.T, fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestBucketFileChanged(t *testing.T) {
+	b := &fakeBucket{bucket: "media", objects: map[string][]byte{"a.mp4": []byte("0123456789")}, modtime: time.Now()}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	bucket, err := newBucketFS(srv.URL+"/media/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := bucket.Open("a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b.objects["a.mp4"] = []byte("abcdefghijklmnop")
+	if _, err := io.ReadAll(f); err == nil {
+		t.Error("read across versions of an object")
+	}
+}
+
+func TestBucketFileCappedRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	srv := httptest.NewServer(&fakeBucket{bucket: "media", objects: map[string][]byte{"a.mp4": content}, modtime: time.Now(), maxLength: 64})
+	defer srv.Close()
+	bucket, err := newBucketFS(srv.URL+"/media/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := bucket.Open("a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("ReadAll: %d bytes, %v", len(b), err)
+	}
+	f.(io.Seeker).Seek(900, io.SeekStart)
+	if b, err := io.ReadAll(f); err != nil || !bytes.Equal(b, content[900:]) {
+		t.Errorf("ReadAll from 900: %d bytes, %v", len(b), err)
+	}
+}
+
+func TestBucketNestedDirs(t *testing.T) {
+	files := map[string][]byte{"a/b/c.mp4": []byte("c"), "a/b/d/e.mp4": []byte("e"), "a/f.mp4": []byte("f"), "a/g.mp4": nil, "a/h.mp4": nil}
+	// listings of more than 2 keys and prefixes come in pages
+	srv := httptest.NewServer(&fakeBucket{bucket: "media", objects: files, modtime: time.Now(), pageSize: 2})
+	defer srv.Close()
+	bucket, err := newBucketFS(srv.URL+"/media/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]string{".": "a/", "a": "b/ f.mp4 g.mp4 h.mp4", "a/b": "c.mp4 d/", "a/b/d": "e.mp4"} {
+		f, err := bucket.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := f.(fs.ReadDirFile)
+		entries, err := d.ReadDir(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			if e.IsDir() {
+				names = append(names, e.Name()+"/")
+			} else {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("ReadDir(%s) = %q, want %q", dir, got, want)
+		}
+		// the directory is read to its end
+		if entries, err := d.ReadDir(-1); len(entries) != 0 || err != nil {
+			t.Errorf("ReadDir(%s) again = %d entries, %v", dir, len(entries), err)
+		}
+		if _, err := d.ReadDir(1); err != io.EOF {
+			t.Errorf("ReadDir(%s, 1) at the end: %v, want io.EOF", dir, err)
+		}
+		f.Close()
+	}
+}
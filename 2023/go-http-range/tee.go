@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// teeHeadBytes is how many bytes of each response body withLog keeps for a
+// hex dump in the access log, 0 keeps none.
+var teeHeadBytes int
+
+// teeFile streams the bodies of all responses into a rotating capture file
+// if set.
+var teeFile *rotatingFile
+
+// headBuffer keeps the first limit bytes written to it and drops the rest.
+type headBuffer struct {
+	buf   []byte
+	limit int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if n := min(len(p), h.limit-len(h.buf)); n > 0 {
+		h.buf = append(h.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+var captureID atomic.Int64
+
+// capture is the tee of one response into teeFile. Responses are written
+// concurrently, so every write becomes a frame of
+//
+//	<capture id> <offset> <length>\n<length bytes>\n
+type capture struct {
+	f      *rotatingFile
+	id     int64
+	offset int64
+}
+
+func newCapture(f *rotatingFile) *capture {
+	return &capture{f: f, id: captureID.Add(1)}
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	header := strconv.FormatInt(c.id, 10) + " " + strconv.FormatInt(c.offset, 10) + " " + strconv.Itoa(len(p)) + "\n"
+	if err := c.f.writeFrame(header, p); err != nil {
+		return 0, err
+	}
+	c.offset += int64(len(p))
+	return len(p), nil
+}
+
+// rotatingFile is a file renamed to name.1, name.2 and so on once it grows
+// beyond maxSize, keeping at most backups old files.
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, finfo.Size()
+	return nil
+}
+
+// rotate moves the file to name.1 and opens a new one. The old file is kept
+// until the new one is open, so a failed rotation leaves a file to write.
+func (r *rotatingFile) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", r.name, r.backups))
+	for i := r.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+	if r.backups > 0 {
+		if err := os.Rename(r.name, r.name+".1"); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(r.name)
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// writeFrame writes header and p together, so frames of concurrent
+// responses don't interleave.
+func (r *rotatingFile) writeFrame(header string, p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(header)+len(p)+1) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// go on with the old file, the next frame tries again
+			logf("rotate %s: %v\n", r.name, err)
+		}
+	}
+	for _, b := range [][]byte{[]byte(header), p, {'\n'}} {
+		n, err := r.f.Write(b)
+		r.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttle holds the bandwidth limits set by flags, in bytes per second.
+// Zero means unlimited.
+var throttle = throttleConfig{burst: 32 * 1000}
+
+type throttleConfig struct {
+	global, perClient, perRequest int64
+	burst                         int64
+	jitter                        float64 // 0 to 1, fraction of each wait randomly added or removed
+}
+
+// rateProfiles are named rates for the rate query parameter and -rate flags,
+// roughly the downlink of these networks.
+var rateProfiles = map[string]int64{
+	"gprs": 6 * 1000,
+	"edge": 30 * 1000,
+	"3g":   96 * 1000,
+	"dsl":  256 * 1000,
+	"4g":   1500 * 1000,
+}
+
+func profileNames() string {
+	var names []string
+	for name := range rateProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// parseRate parses a rate profile name or a byte size per second, like
+// "3g", "256k" or "1MB".
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	if rate, ok := rateProfiles[s]; ok {
+		return rate, nil
+	}
+	rate, err := parseByteSize(s)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// tokenBucket holds up to burst bytes and is refilled at rate bytes per
+// second. It can go into debt, so a big write waits for its tokens instead of
+// being refused.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now(), now: time.Now}
+}
+
+// reserve takes n tokens and returns how long to wait until they are paid.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// idle reports whether the bucket is full again and hasn't been used since d.
+func (b *tokenBucket) idle(d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.now().Sub(b.last) > d && b.tokens+b.now().Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+var (
+	globalBucket *tokenBucket
+
+	clientBucketsMu    sync.Mutex
+	clientBuckets      = map[string]*tokenBucket{}
+	clientBucketsSwept time.Time
+)
+
+// clientBucket returns the bucket shared by all requests from the host of
+// remoteAddr, dropping buckets of clients gone for a minute.
+func clientBucket(remoteAddr string, rate, burst int64) *tokenBucket {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	clientBucketsMu.Lock()
+	defer clientBucketsMu.Unlock()
+	if time.Since(clientBucketsSwept) > time.Minute {
+		for k, b := range clientBuckets {
+			if b.idle(time.Minute) {
+				delete(clientBuckets, k)
+			}
+		}
+		clientBucketsSwept = time.Now()
+	}
+	b, ok := clientBuckets[host]
+	if !ok {
+		b = newTokenBucket(rate, burst)
+		clientBuckets[host] = b
+	}
+	return b
+}
+
+// withThrottle limits the bandwidth of responses by the throttle flags and the
+// rate, burst and jitter query parameters, e.g. "/video.mp4?rate=3g&jitter=0.3".
+func withThrottle(ha func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := throttle
+		q := r.URL.Query()
+		var err error
+		if s := q.Get("rate"); s != "" {
+			cfg.perRequest, err = parseRate(s)
+		}
+		if s := q.Get("burst"); s != "" && err == nil {
+			cfg.burst, err = parseByteSize(s)
+		}
+		if s := q.Get("jitter"); s != "" && err == nil {
+			cfg.jitter, err = strconv.ParseFloat(s, 64)
+		}
+		if err != nil || cfg.burst <= 0 || cfg.jitter < 0 || cfg.jitter > 1 {
+			http.Error(w, fmt.Sprintf("invalid throttle parameters: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		tw := &throttledWriter{ResponseWriter: w, req: r, jitter: cfg.jitter, piece: int(min(cfg.burst, 16*1000))}
+		if globalBucket != nil {
+			tw.buckets = append(tw.buckets, globalBucket)
+		}
+		if cfg.perClient > 0 {
+			tw.buckets = append(tw.buckets, clientBucket(r.RemoteAddr, cfg.perClient, cfg.burst))
+		}
+		if cfg.perRequest > 0 {
+			tw.buckets = append(tw.buckets, newTokenBucket(cfg.perRequest, cfg.burst))
+		}
+		if len(tw.buckets) == 0 {
+			ha(w, r)
+			return
+		}
+		ha(tw, r)
+	}
+}
+
+// throttledWriter writes in pieces, each waiting for the tokens of all
+// buckets.
+type throttledWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	buckets []*tokenBucket
+	jitter  float64
+	piece   int
+}
+
+func (t *throttledWriter) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		n := min(len(buf), t.piece)
+		var wait time.Duration
+		for _, b := range t.buckets {
+			wait = max(wait, b.reserve(n))
+		}
+		if t.jitter > 0 {
+			wait += time.Duration((rand.Float64()*2 - 1) * t.jitter * float64(wait))
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.req.Context().Done():
+				timer.Stop()
+				return written, t.req.Context().Err()
+			}
+		}
+		m, err := t.ResponseWriter.Write(buf[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		// push the piece to the client now, or it sits in the buffer of
+		// net/http and the client sees bursts instead of a steady rate
+		http.NewResponseController(t.ResponseWriter).Flush()
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(1000, 500)
+	b.now, b.last = func() time.Time { return now }, now
+
+	steps := []struct {
+		advance time.Duration
+		n       int
+		want    time.Duration
+	}{
+		{0, 500, 0},                      // the burst is free
+		{0, 100, 100 * time.Millisecond}, // then 1000 bytes per second
+		{0, 100, 200 * time.Millisecond}, // debt adds up
+		{200 * time.Millisecond, 100, 100 * time.Millisecond},
+		{10 * time.Second, 500, 0}, // refilled up to burst only
+		{0, 1, time.Millisecond},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		if got := b.reserve(s.n); got != s.want {
+			t.Errorf("step %d: reserve(%d) = %v, want %v", i, s.n, got, s.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{"3g": 96e3, "DSL": 256e3, "256k": 256e3, "1MB/s": 1e6, "0": 0} {
+		if got, err := parseRate(s); err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	if _, err := parseRate("fast"); err == nil {
+		t.Error(`parseRate("fast") should fail`)
+	}
+}
+
+func TestWithThrottle(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 40*1000)
+	h := withThrottle(func(w http.ResponseWriter, r *http.Request) { w.Write(body) })
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	defer srv.Close()
+
+	get := func(query string) (time.Duration, int) {
+		start := time.Now()
+		resp, err := http.Get(srv.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		n, _ := io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != 200 || n != int64(len(body)) {
+			t.Fatalf("%s: status %d, %d bytes", query, resp.StatusCode, n)
+		}
+		return time.Since(start), resp.StatusCode
+	}
+
+	// 40KB at 100KB/s with a 10KB burst takes about 300ms
+	if elapsed, _ := get("/?rate=100k&burst=10k"); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("throttled response took %v, want about 300ms", elapsed)
+	}
+	if elapsed, _ := get("/"); elapsed > 250*time.Millisecond {
+		t.Errorf("unthrottled response took %v", elapsed)
+	}
+
+	resp, err := http.Get(srv.URL + "/?rate=fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid rate got status %d, want 400", resp.StatusCode)
+	}
+}
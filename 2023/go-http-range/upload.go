@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.zeng.dev/httprange"
+)
+
+// uploadMax is the largest file accepted by uploads, 0 is unlimited.
+var uploadMax int64
+
+// errUploadTooLarge is returned by write for a body going beyond uploadMax.
+var errUploadTooLarge = errors.New("beyond the upload limit")
+
+// uploadTTL is how long an idle upload is remembered. Its partial file stays,
+// a client resumes at its size, but sizes and digests told before are lost.
+const uploadTTL = time.Hour
+
+// uploader takes resumable uploads into root. A file is written to a hidden
+// partial file next to it, which mediaName never serves, and renamed over the
+// target once all of its bytes arrived and its digest matches, so rangeVideo
+// serves either the old or the new file, never a part.
+//
+// Two flavors share the partial file, the offset is its size:
+//   - PUT with Content-Range "bytes first-last/complete", like the resumable
+//     uploads of cloud storage. A PUT without Content-Range is the whole file.
+//     The first PUT starts the upload.
+//   - tus 1.0: POST with Upload-Length starts the upload, PATCH with
+//     Upload-Offset sends its bytes, and HEAD asks for the offset to resume
+//     at. PATCH and HEAD of an upload never started get a 404.
+type uploader struct {
+	root *os.Root
+
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+// upload is what an upload in progress knows beyond its partial file.
+type upload struct {
+	mu      sync.Mutex // one request writes at a time
+	size    int64      // httprange.UnknownSize until a request tells
+	digests map[string][]byte
+	seen    time.Time // of the last request, guarded by uploader.mu
+}
+
+func newUploader(root *os.Root) *uploader {
+	return &uploader{root: root, uploads: map[string]*upload{}}
+}
+
+// isUpload reports whether r is for the uploader rather than rangeVideo.
+func isUpload(r *http.Request) bool {
+	return r.Method == "PUT" || r.Method == "PATCH" || r.Method == "POST" ||
+		r.Method == "HEAD" && r.Header.Get("Tus-Resumable") != ""
+}
+
+// partName is the partial file of name, hidden next to it.
+func partName(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+".upload")
+}
+
+// get returns the upload of name. A new one is started if start is set, or
+// if a partial file is left of an upload forgotten since, else it is nil.
+func (u *uploader) get(name string, start bool) *upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for k, up := range u.uploads {
+		if now.Sub(up.seen) > uploadTTL {
+			delete(u.uploads, k)
+		}
+	}
+	up, ok := u.uploads[name]
+	if !ok {
+		if _, err := u.root.Stat(partName(name)); !start && err != nil {
+			return nil
+		}
+		up = &upload{size: httprange.UnknownSize, digests: map[string][]byte{}}
+		u.uploads[name] = up
+	}
+	up.seen = now
+	return up
+}
+
+func (u *uploader) forget(name string) {
+	u.mu.Lock()
+	delete(u.uploads, name)
+	u.mu.Unlock()
+}
+
+func (u *uploader) serve(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "." || strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "can not upload a directory", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != "" {
+		w.Header().Set("Tus-Resumable", "1.0.0")
+	}
+	if r.Method == "POST" {
+		u.create(w, r, name)
+		return
+	}
+	up := u.get(name, r.Method == "PUT")
+	if up == nil {
+		http.Error(w, "no upload of "+name+", start it with POST", http.StatusNotFound)
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	offset, err := u.offset(name)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if r.Method == "HEAD" {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if up.size >= 0 {
+			w.Header().Set("Upload-Length", strconv.FormatInt(up.size, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// ra is what this request carries, of a file of size bytes
+	ra, size, err := uploadRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	whole := r.Method == "PUT" && r.Header.Get("Content-Range") == ""
+	if whole {
+		// the whole file again, whatever was uploaded before
+		offset, up.size = 0, size
+		clear(up.digests)
+	}
+	switch {
+	case size >= 0 && up.size >= 0 && size != up.size:
+		http.Error(w, fmt.Sprintf("upload of %d bytes, not %d", up.size, size), http.StatusConflict)
+		return
+	case uploadMax > 0 && (size > uploadMax || ra.length >= 0 && ra.start+ra.length > uploadMax):
+		http.Error(w, fmt.Sprintf("beyond the upload limit of %d bytes", uploadMax), http.StatusRequestEntityTooLarge)
+		return
+	case size >= 0:
+		up.size = size
+	}
+	if err := parseDigests(r.Header, up.digests); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ra.start > offset {
+		// a gap, tell the client where to resume
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, fmt.Sprintf("upload continues at %d, not %d", offset, ra.start), http.StatusConflict)
+		return
+	}
+
+	offset, err = u.write(name, r.Body, ra, offset)
+	logf("upload %s from %d of %d, at %d, err: %v\n", name, ra.start, up.size, offset, err)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		// what arrived is kept, the client resumes at Upload-Offset
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if whole {
+		up.size = offset // known now for a body without Content-Length
+	}
+	if up.size < 0 || offset < up.size {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	status, err := u.commit(name, up)
+	if err != nil {
+		if status == http.StatusBadRequest {
+			w.Header().Set("Upload-Offset", "0") // discarded
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if r.Method == "PATCH" {
+		// tus answers every PATCH that was applied with 204
+		status = http.StatusNoContent
+	}
+	finfo, err := u.root.Stat(name)
+	if err == nil {
+		w.Header().Set("Etag", etag(finfo))
+	}
+	w.WriteHeader(status)
+}
+
+// create starts the tus upload of name, of Upload-Length bytes or of a
+// length told later with Upload-Defer-Length. Whatever was uploaded to name
+// before is discarded.
+func (u *uploader) create(w http.ResponseWriter, r *http.Request, name string) {
+	var size int64 = httprange.UnknownSize
+	if s := r.Header.Get("Upload-Length"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid Upload-Length %q", s), http.StatusBadRequest)
+			return
+		}
+		size = n
+	} else if r.Header.Get("Upload-Defer-Length") != "1" {
+		http.Error(w, "POST needs Upload-Length or Upload-Defer-Length: 1", http.StatusBadRequest)
+		return
+	}
+	if uploadMax > 0 && size > uploadMax {
+		http.Error(w, fmt.Sprintf("beyond the upload limit of %d bytes", uploadMax), http.StatusRequestEntityTooLarge)
+		return
+	}
+	up := u.get(name, true)
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if err := parseDigests(r.Header, up.digests); err != nil {
+		u.forget(name)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := u.root.Remove(partName(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fsError(w, err)
+		return
+	}
+	up.size = size
+	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// uploadRange is the range of the file a request body carries, and the size
+// of the file if the request knows it. The length of ra is -1 if only the end
+// of the body tells.
+func uploadRange(r *http.Request) (ra httpRange, size int64, err error) {
+	size = httprange.UnknownSize
+	if r.Method == "PATCH" && r.Header.Get("Upload-Offset") != "" {
+		if ra.start, err = strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || ra.start < 0 {
+			return ra, 0, fmt.Errorf("invalid Upload-Offset %q", r.Header.Get("Upload-Offset"))
+		}
+		if s := r.Header.Get("Upload-Length"); s != "" {
+			if size, err = strconv.ParseInt(s, 10, 64); err != nil || size < 0 {
+				return ra, 0, fmt.Errorf("invalid Upload-Length %q", s)
+			}
+		}
+		ra.length = r.ContentLength
+		return ra, size, nil
+	}
+
+	s := r.Header.Get("Content-Range")
+	if s == "" {
+		if r.Method == "PATCH" {
+			return ra, 0, errors.New("PATCH needs Content-Range or Upload-Offset")
+		}
+		ra.length = r.ContentLength
+		return ra, max(r.ContentLength, httprange.UnknownSize), nil
+	}
+	cr, size, err := httprange.ParseContentRange(s)
+	if err != nil {
+		return ra, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if r.ContentLength >= 0 && r.ContentLength != cr.Length {
+		return ra, 0, fmt.Errorf("Content-Range %q of a body of %d bytes", s, r.ContentLength)
+	}
+	return httpRange{start: cr.Start, length: cr.Length}, size, nil
+}
+
+// offset is where the upload of name continues, the size of its partial file.
+func (u *uploader) offset(name string) (int64, error) {
+	finfo, err := u.root.Stat(partName(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return finfo.Size(), nil
+}
+
+// write writes the bytes of body from offset on to the partial file of name,
+// skipping the ones of ra before offset, which a client resending after a
+// lost response has sent already. It returns the new offset, which counts
+// what was written even if the body ended early.
+func (u *uploader) write(name string, body io.Reader, ra httpRange, offset int64) (int64, error) {
+	if err := u.root.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return offset, err
+	}
+	f, err := u.root.OpenFile(partName(name), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return offset, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	skip := offset - ra.start
+	if ra.length >= 0 && skip >= ra.length {
+		return offset, nil
+	}
+	if n, err := io.CopyN(io.Discard, body, skip); err != nil {
+		return offset, fmt.Errorf("body ended after %d bytes: %w", n, err)
+	}
+	if ra.length < 0 {
+		// as much as the body has, but not beyond the limit
+		lr := io.Reader(body)
+		if uploadMax > 0 {
+			lr = io.LimitReader(body, uploadMax-offset+1)
+		}
+		n, err := io.Copy(f, lr)
+		if uploadMax > 0 && offset+n > uploadMax {
+			// drop the byte that went over, the offset is the size
+			if err := f.Truncate(offset + n - 1); err != nil {
+				return offset, err
+			}
+			return offset + n - 1, fmt.Errorf("%w of %d bytes", errUploadTooLarge, uploadMax)
+		}
+		return offset + n, err
+	}
+	n, err := io.CopyN(f, body, ra.length-skip)
+	if err != nil {
+		err = fmt.Errorf("body ended after %d bytes: %w", skip+n, err)
+	}
+	return offset + n, err
+}
+
+// commit verifies the digests of the complete partial file of name, and
+// renames it to name. It returns 201 for a new file, 204 for a replaced one.
+func (u *uploader) commit(name string, up *upload) (int, error) {
+	defer u.forget(name)
+	part := partName(name)
+	if len(up.digests) > 0 {
+		f, err := u.root.Open(part)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		err = verifyDigests(f, up.digests)
+		f.Close()
+		if err != nil {
+			// the bytes are wrong somewhere, only starting over helps
+			u.root.Remove(part)
+			return http.StatusBadRequest, err
+		}
+	}
+	status := http.StatusNoContent
+	if _, err := u.root.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		status = http.StatusCreated
+	}
+	if err := u.root.Rename(part, name); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	logf("upload %s complete, %d bytes\n", name, up.size)
+	return status, nil
+}
+
+// digestAlgorithms are the hashes of Repr-Digest, RFC 9530, and of the
+// Digest of RFC 3230 it obsoletes, by lower case name.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// parseDigests adds the digests of the whole file from the Repr-Digest
+// "sha-256=:base64:" and Digest "SHA-256=base64" headers of h to digests.
+// Algorithms not in digestAlgorithms are skipped.
+func parseDigests(h http.Header, digests map[string][]byte) error {
+	for _, k := range []string{"Repr-Digest", "Digest"} {
+		for _, v := range h.Values(k) {
+			for _, d := range strings.Split(v, ",") {
+				alg, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+				if !ok {
+					return fmt.Errorf("invalid %s %q", k, v)
+				}
+				alg = strings.ToLower(alg)
+				if _, ok := digestAlgorithms[alg]; !ok {
+					continue
+				}
+				if k == "Repr-Digest" {
+					value, ok = strings.CutPrefix(value, ":")
+					if value, ok = strings.CutSuffix(value, ":"); !ok {
+						return fmt.Errorf("invalid %s %q", k, v)
+					}
+				}
+				sum, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					return fmt.Errorf("invalid %s %q: %v", k, v, err)
+				}
+				digests[alg] = sum
+			}
+		}
+	}
+	return nil
+}
+
+// verifyDigests hashes r with every algorithm of digests and compares.
+func verifyDigests(r io.Reader, digests map[string][]byte) error {
+	hashes := map[string]hash.Hash{}
+	var ws []io.Writer
+	for alg := range digests {
+		hashes[alg] = digestAlgorithms[alg]()
+		ws = append(ws, hashes[alg])
+	}
+	if _, err := io.Copy(io.MultiWriter(ws...), r); err != nil {
+		return err
+	}
+	for alg, h := range hashes {
+		if sum := h.Sum(nil); !bytes.Equal(sum, digests[alg]) {
+			return fmt.Errorf("%s digest of the upload is %s, not %s, upload discarded", alg,
+				base64.StdEncoding.EncodeToString(sum), base64.StdEncoding.EncodeToString(digests[alg]))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestUpload(t *testing.T) {
+	quietLog(t)
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	h := &mediaHandler{fsys: root.FS(), uploads: newUploader(root)}
+	do := func(method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, code int, offset string) {
+		t.Helper()
+		if rec.Code != code || rec.Header().Get("Upload-Offset") != offset {
+			t.Fatalf("status %d, Upload-Offset %q, want %d, %q: %s", rec.Code, rec.Header().Get("Upload-Offset"), code, offset, rec.Body)
+		}
+	}
+	sum := sha256.Sum256([]byte("0123456789"))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+	// the connection drops after 4 bytes
+	req := httptest.NewRequest("PUT", "/sub/rec.mp4", io.MultiReader(strings.NewReader("0123"), iotest.ErrReader(errors.New("reset"))))
+	req.ContentLength = 10
+	req.Header.Set("Content-Range", "bytes 0-9/10")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	expect(rec, 500, "4")
+	expect(do("HEAD", "/sub/rec.mp4", nil, "Tus-Resumable", "1.0.0"), 200, "4")
+	expect(do("GET", "/sub/rec.mp4", nil), 404, "")
+
+	// a gap, and a resend of bytes that arrived already
+	expect(do("PUT", "/sub/rec.mp4", strings.NewReader("6789"), "Content-Range", "bytes 6-9/10"), 409, "4")
+	expect(do("PUT", "/sub/rec.mp4", strings.NewReader("2345"), "Content-Range", "bytes 2-5/10"), 204, "6")
+	expect(do("PUT", "/sub/rec.mp4", strings.NewReader("6789"), "Content-Range", "bytes 6-9/11"), 409, "")
+
+	// tus finishes it, a wrong digest discards it
+	expect(do("PATCH", "/sub/rec.mp4", strings.NewReader("6789"), "Upload-Offset", "6", "Repr-Digest", "sha-256=:AAAA:"), 400, "0")
+	expect(do("HEAD", "/sub/rec.mp4", nil, "Tus-Resumable", "1.0.0"), 404, "")
+	expect(do("PATCH", "/sub/rec.mp4", strings.NewReader("01234"), "Upload-Offset", "0"), 404, "")
+	expect(do("POST", "/sub/rec.mp4", nil, "Tus-Resumable", "1.0.0", "Upload-Length", "10", "Repr-Digest", digest), 201, "0")
+	expect(do("HEAD", "/sub/rec.mp4", nil, "Tus-Resumable", "1.0.0"), 200, "0")
+	expect(do("PATCH", "/sub/rec.mp4", strings.NewReader("01234"), "Upload-Offset", "0"), 204, "5")
+	// the last PATCH is a 204 too, as tus has it
+	expect(do("PATCH", "/sub/rec.mp4", strings.NewReader("56789"), "Upload-Offset", "5"), 204, "10")
+
+	// playable right away
+	rec = do("GET", "/sub/rec.mp4", nil, "Range", "bytes=2-4")
+	if rec.Code != 206 || rec.Body.String() != "234" {
+		t.Fatalf("GET after upload: %d %q", rec.Code, rec.Body)
+	}
+	if _, err := root.Stat("sub/.rec.mp4.upload"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+
+	// a whole file replaces it
+	expect(do("PUT", "/sub/rec.mp4", strings.NewReader("abc"), "Digest", "SHA-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0="), 204, "3")
+	if data, _ := root.ReadFile("sub/rec.mp4"); string(data) != "abc" {
+		t.Errorf("replaced file has %q", data)
+	}
+
+	// asking about uploads never started doesn't start any
+	for i := 0; i < 3; i++ {
+		expect(do("HEAD", "/sub/none"+strings.Repeat("x", i)+".mp4", nil, "Tus-Resumable", "1.0.0"), 404, "")
+	}
+	if n := len(h.uploads.uploads); n != 0 {
+		t.Errorf("%d uploads remembered after they finished", n)
+	}
+
+	// a body of unknown length beyond the limit keeps the bytes up to it
+	defer func(n int64) { uploadMax = n }(uploadMax)
+	uploadMax = 4
+	req = httptest.NewRequest("PUT", "/big.mp4", strings.NewReader("0123456789"))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	expect(rec, 413, "4")
+	if finfo, err := root.Stat(".big.mp4.upload"); err != nil || finfo.Size() != 4 {
+		t.Errorf("partial file beyond the limit: %v, %v", finfo, err)
+	}
+	uploadMax = 0
+
+	// idle uploads are forgotten, their partial file is still resumed
+	h.uploads.mu.Lock()
+	h.uploads.uploads["big.mp4"].seen = time.Now().Add(-uploadTTL - time.Second)
+	h.uploads.mu.Unlock()
+	h.uploads.get("other", false)
+	if _, ok := h.uploads.uploads["big.mp4"]; ok {
+		t.Error("idle upload is kept")
+	}
+	expect(do("HEAD", "/big.mp4", nil, "Tus-Resumable", "1.0.0"), 200, "4")
+
+	h.uploads = nil
+	expect(do("PUT", "/sub/rec.mp4", strings.NewReader("x")), 405, "")
+}
@@ -0,0 +1,163 @@
+package httprange
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// outcome is what a server makes of a Range header, as seen by a client.
+type outcome struct {
+	kind   string // "ranges", "invalid", "no-overlap" or "ignored", a 200
+	ranges []Range
+}
+
+// netHTTP is what http.ServeContent answers to a Range header s of size
+// bytes. ok is false if net/http answers with a zero length range, which RFC
+// 9110 doesn't allow.
+func netHTTP(t *testing.T, s string, size int64) (o outcome, ok bool) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", s)
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "", time.Time{}, bytes.NewReader(make([]byte, size)))
+
+	parse := func(contentRange string) (Range, bool) {
+		var first, last, total int64
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &total); err != nil || total != size {
+			t.Fatalf("Range %q: net/http sent Content-Range %q", s, contentRange)
+		}
+		return Range{first, last - first + 1}, last >= first
+	}
+	switch rec.Code {
+	case http.StatusOK:
+		return outcome{kind: "ignored"}, true
+	case http.StatusRequestedRangeNotSatisfiable:
+		if rec.Header().Get("Content-Range") != "" {
+			return outcome{kind: "no-overlap"}, true
+		}
+		return outcome{kind: "invalid"}, true
+	case http.StatusPartialContent:
+	default:
+		t.Fatalf("Range %q: net/http answered %d", s, rec.Code)
+	}
+
+	o.kind = "ranges"
+	ok = true
+	mediaType, params, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		r, rok := parse(rec.Header().Get("Content-Range"))
+		return outcome{kind: "ranges", ranges: []Range{r}}, rok
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return o, ok
+		}
+		if err != nil {
+			t.Fatalf("Range %q: bad multipart response: %v", s, err)
+		}
+		r, rok := parse(part.Header.Get("Content-Range"))
+		o.ranges = append(o.ranges, r)
+		ok = ok && rok
+	}
+}
+
+// serveContent is what http.ServeContent would answer with Parse.
+func serveContent(s string, size int64) outcome {
+	ranges, err := Parse(s, size, Options{})
+	switch {
+	case errors.Is(err, ErrNoOverlap) && size == 0:
+		return outcome{kind: "ignored"}
+	case errors.Is(err, ErrNoOverlap):
+		return outcome{kind: "no-overlap"}
+	case err != nil:
+		return outcome{kind: "invalid"}
+	}
+	var sum int64
+	for _, r := range ranges {
+		sum += r.Length
+	}
+	if len(ranges) == 0 || sum > size {
+		return outcome{kind: "ignored"}
+	}
+	return outcome{kind: "ranges", ranges: ranges}
+}
+
+// netHTTPDiffers reports whether s is where Parse follows RFC 9110 rather
+// than net/http, see Parse. Zero length ranges are left to netHTTP.
+func netHTTPDiffers(s string, size int64) bool {
+	unit, set, _ := strings.Cut(s, "=")
+	if strings.EqualFold(unit, "bytes") && unit != "bytes" {
+		return true // case-insensitive unit
+	}
+	if strings.ContainsAny(set, "+") {
+		return true // strconv.ParseInt takes a sign
+	}
+	digits, empty := 0, true
+	for _, c := range set {
+		if c >= '0' && c <= '9' {
+			if digits++; digits > 18 {
+				return true // int64 overflow
+			}
+		} else {
+			digits = 0
+		}
+	}
+	for _, ra := range strings.Split(set, ",") {
+		if strings.Trim(ra, " \t\r\n") != "" {
+			empty = false
+		}
+		// net/http skips a range starting beyond the end before it looks
+		// at the last-pos, Parse rejects an invalid one
+		start, end, _ := strings.Cut(ra, "-")
+		start, end = strings.Trim(start, " \t\r\n"), strings.Trim(end, " \t\r\n")
+		if start != "" && strings.HasPrefix(end, "-") {
+			return true // a sign again
+		}
+		first, ok := parsePos(start)
+		if last, lok := parsePos(end); ok && first >= size && end != "" && (!lok || last < first) {
+			return true
+		}
+	}
+	return empty && strings.HasPrefix(s, "bytes=") // no range at all
+}
+
+func FuzzParseAgainstNetHTTP(f *testing.F) {
+	for _, tt := range rfc9110 {
+		f.Add(tt.s, uint16(10000))
+		f.Add(tt.s, uint16(0))
+		f.Add(tt.s, uint16(600))
+	}
+	f.Fuzz(func(t *testing.T, s string, size16 uint16) {
+		size := int64(size16)
+		got, err := Parse(s, size, Options{})
+		for _, r := range got {
+			if r.Start < 0 || r.Length <= 0 || r.End() >= size {
+				t.Fatalf("Parse(%q, %d) = %v, out of the representation", s, size, got)
+			}
+		}
+		if err != nil && got != nil {
+			t.Fatalf("Parse(%q, %d) = %v with error %v", s, size, got, err)
+		}
+		if netHTTPDiffers(s, size) {
+			return
+		}
+		want, ok := netHTTP(t, s, size)
+		if !ok {
+			return
+		}
+		if o := serveContent(s, size); !reflect.DeepEqual(o, want) {
+			t.Errorf("Range %q of %d bytes: Parse gives %+v, net/http %+v", s, size, o, want)
+		}
+	})
+}
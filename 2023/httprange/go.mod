@@ -0,0 +1,3 @@
+module example.zeng.dev/httprange
+
+go 1.24
@@ -0,0 +1,238 @@
+// Package httprange parses the Range request header of RFC 9110, section
+// 14.2, and formats Content-Range. It started as a copy of the parser of
+// net/http fs.go, and adds the options the range samples need: capping
+// open-ended ranges, suffix handling, and representations whose size isn't
+// known or is made up.
+package httprange
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/textproto"
+	"strings"
+)
+
+// UnknownSize is the size of a representation whose length isn't known yet,
+// like a file still being written.
+const UnknownSize = -1
+
+var (
+	// ErrInvalid is returned for a Range header that doesn't parse. RFC 9110
+	// lets a server ignore such a header and send the whole representation.
+	ErrInvalid = errors.New("httprange: invalid range")
+	// ErrNoOverlap is returned if no range of the header is satisfiable,
+	// which is answered by a 416 with Unsatisfied(size) as Content-Range.
+	ErrNoOverlap = errors.New("httprange: invalid range: failed to overlap")
+	// ErrUnknownSize is returned for ranges relative to the end of a
+	// representation of UnknownSize.
+	ErrUnknownSize = errors.New("httprange: range needs the size of the representation")
+)
+
+// Range is a byte range of a representation.
+type Range struct {
+	Start, Length int64
+}
+
+// End is the offset of the last byte of r.
+func (r Range) End() int64 {
+	return r.Start + r.Length - 1
+}
+
+// ContentRange formats r as the value of a Content-Range header, size may
+// be UnknownSize.
+func (r Range) ContentRange(size int64) string {
+	if size < 0 {
+		return fmt.Sprintf("bytes %d-%d/*", r.Start, r.End())
+	}
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End(), size)
+}
+
+// Unsatisfied is the Content-Range of a 416 response, "bytes */size".
+func Unsatisfied(size int64) string {
+	return fmt.Sprintf("bytes */%d", size)
+}
+
+// ParseContentRange parses the Content-Range of a request carrying a part
+// of a representation, "bytes first-last/complete" where complete may be
+// "*". size is UnknownSize then. The unsatisfied-range form "bytes */N" of
+// responses is ErrInvalid, it carries no bytes.
+func ParseContentRange(s string) (r Range, size int64, err error) {
+	unit, resp, ok := strings.Cut(textproto.TrimString(s), " ")
+	if !ok || !strings.EqualFold(unit, "bytes") {
+		return Range{}, 0, ErrInvalid
+	}
+	rng, complete, ok := strings.Cut(resp, "/")
+	first, last, ok2 := strings.Cut(rng, "-")
+	if !ok || !ok2 {
+		return Range{}, 0, ErrInvalid
+	}
+	size = UnknownSize
+	if complete != "*" {
+		if size, ok = parsePos(complete); !ok || size == math.MaxInt64 {
+			return Range{}, 0, ErrInvalid
+		}
+	}
+	i, ok := parsePos(first)
+	j, ok2 := parsePos(last)
+	if !ok || !ok2 || j < i || j == math.MaxInt64 || size >= 0 && j >= size {
+		return Range{}, 0, ErrInvalid
+	}
+	return Range{Start: i, Length: j - i + 1}, size, nil
+}
+
+// SuffixMode is how Parse treats suffix ranges, "bytes=-N".
+type SuffixMode int
+
+const (
+	// SuffixLast selects the last N bytes, or the whole representation if
+	// it is shorter, per RFC 9110.
+	SuffixLast SuffixMode = iota
+	// SuffixCapped selects the last N bytes, but at most Options.MaxLength.
+	SuffixCapped
+	// SuffixReject fails suffix ranges with ErrInvalid.
+	SuffixReject
+)
+
+// Options are the deviations of Parse from RFC 9110. The zero value parses
+// by the RFC.
+type Options struct {
+	// MaxLength caps an open-ended range "bytes=N-" to at most MaxLength
+	// bytes, 0 doesn't cap. It is the length of open-ended ranges of
+	// UnknownSize, or beyond the end with KeepBeyondEnd.
+	MaxLength int64
+	// Suffix is how suffix ranges are treated.
+	Suffix SuffixMode
+	// KeepBeyondEnd keeps ranges starting at or after size rather than
+	// dropping them as not satisfiable, for a server whose size is a guess.
+	// Their ends are not clamped to size.
+	KeepBeyondEnd bool
+}
+
+// Parse parses a Range header s for a representation of size bytes, which
+// may be UnknownSize. It returns nil for an empty s, ErrInvalid if s doesn't
+// parse, and ErrNoOverlap if none of the ranges is satisfiable. The ranges
+// are in the order of s, neither sorted nor coalesced.
+//
+// Where net/http is lax or RFC 7233 was unclear, Parse follows RFC 9110: the
+// unit is case-insensitive, positions are digits only, positions too large
+// for an int64 are beyond any end rather than invalid, "bytes=-0" is not
+// satisfiable, and a header without any range is invalid.
+func Parse(s string, size int64, opts Options) ([]Range, error) {
+	if s == "" {
+		return nil, nil // header not present
+	}
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(unit, "bytes") {
+		return nil, ErrInvalid
+	}
+	var ranges []Range
+	specs, noOverlap := 0, false
+	for _, ra := range strings.Split(set, ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue // RFC 9110 5.6.1, empty list elements are ignored
+		}
+		specs++
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, ErrInvalid
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r Range
+		if start == "" {
+			// suffix-range, the last n bytes
+			n, ok := parsePos(end)
+			if !ok {
+				return nil, ErrInvalid
+			}
+			switch {
+			case opts.Suffix == SuffixReject:
+				return nil, fmt.Errorf("%w: suffix range", ErrInvalid)
+			case size < 0:
+				return nil, ErrUnknownSize
+			case n == 0 || size == 0:
+				// a suffix range is satisfiable if n is not 0
+				noOverlap = true
+				continue
+			}
+			if opts.Suffix == SuffixCapped && opts.MaxLength > 0 {
+				n = min(n, opts.MaxLength)
+			}
+			r.Length = min(n, size)
+			r.Start = size - r.Length
+		} else {
+			i, ok := parsePos(start)
+			if !ok {
+				return nil, ErrInvalid
+			}
+			r.Start = i
+			last := int64(math.MaxInt64)
+			if end != "" {
+				if last, ok = parsePos(end); !ok || last < i {
+					return nil, ErrInvalid
+				}
+			}
+			beyond := size >= 0 && i >= size
+			switch {
+			case beyond && !opts.KeepBeyondEnd:
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			case end == "" && (size < 0 || beyond):
+				if opts.MaxLength <= 0 {
+					if size < 0 {
+						return nil, ErrUnknownSize
+					}
+					noOverlap = true
+					continue
+				}
+				r.Length = opts.MaxLength
+			case end == "":
+				r.Length = size - i
+				if opts.MaxLength > 0 {
+					r.Length = min(r.Length, opts.MaxLength)
+				}
+			default:
+				if size >= 0 && !beyond {
+					last = min(last, size-1)
+				}
+				r.Length = last - i + 1
+				if r.Length <= 0 { // last - i overflows for i = 0, last = MaxInt64
+					r.Length = math.MaxInt64
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if specs == 0 {
+		return nil, ErrInvalid
+	}
+	if noOverlap && len(ranges) == 0 {
+		// The specified ranges did not overlap with the content.
+		return nil, ErrNoOverlap
+	}
+	return ranges, nil
+}
+
+// parsePos parses the digits of a position. Values beyond an int64 are
+// MaxInt64, which is beyond the end of anything that can be served.
+func parsePos(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	var n int64
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		if n > (math.MaxInt64-int64(c-'0'))/10 {
+			n = math.MaxInt64
+			continue
+		}
+		n = n*10 + int64(c-'0')
+	}
+	return n, true
+}
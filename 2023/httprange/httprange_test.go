@@ -0,0 +1,156 @@
+package httprange
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// rfc9110 are the examples of RFC 9110, section 14.1.2, and the edge cases
+// of its grammar, against a representation of 10000 bytes.
+var rfc9110 = []struct {
+	s    string
+	want []Range
+	err  error
+}{
+	// examples of the RFC
+	{"bytes=0-499", []Range{{0, 500}}, nil},
+	{"bytes=500-999", []Range{{500, 500}}, nil},
+	{"bytes=-500", []Range{{9500, 500}}, nil},
+	{"bytes=9500-", []Range{{9500, 500}}, nil},
+	{"bytes=0-0,-1", []Range{{0, 1}, {9999, 1}}, nil},
+	{"bytes= 0-999, 4500-5499, -1000", []Range{{0, 1000}, {4500, 1000}, {9000, 1000}}, nil},
+	{"bytes=500-600,601-999", []Range{{500, 101}, {601, 399}}, nil},
+	{"bytes=500-700,601-999", []Range{{500, 201}, {601, 399}}, nil},
+
+	// last-pos beyond the end is the end
+	{"bytes=9000-20000", []Range{{9000, 1000}}, nil},
+	{"bytes=0-99999999999999999999999", []Range{{0, 10000}}, nil},
+	// a suffix longer than the representation is all of it
+	{"bytes=-20000", []Range{{0, 10000}}, nil},
+	{"bytes=-99999999999999999999999", []Range{{0, 10000}}, nil},
+	// unsatisfiable ranges are dropped, all of them is a 416
+	{"bytes=10000-", nil, ErrNoOverlap},
+	{"bytes=10000-10001", nil, ErrNoOverlap},
+	{"bytes=99999999999999999999999-", nil, ErrNoOverlap},
+	{"bytes=-0", nil, ErrNoOverlap},
+	{"bytes=20000-,0-9", []Range{{0, 10}}, nil},
+	// the unit is case-insensitive, lists may have empty elements and OWS
+	{"Bytes=0-9", []Range{{0, 10}}, nil},
+	{"BYTES=0-9", []Range{{0, 10}}, nil},
+	{"bytes=0-9,,\t, 20-29", []Range{{0, 10}, {20, 10}}, nil},
+	{"bytes=00-09", []Range{{0, 10}}, nil},
+
+	// invalid
+	{"bytes=", nil, ErrInvalid},
+	{"bytes= , ", nil, ErrInvalid},
+	{"bytes", nil, ErrInvalid},
+	{"bytes =0-9", nil, ErrInvalid},
+	{"items=0-9", nil, ErrInvalid},
+	{"bytes=9-0", nil, ErrInvalid},
+	{"bytes=-", nil, ErrInvalid},
+	{"bytes=0", nil, ErrInvalid},
+	{"bytes=+1-2", nil, ErrInvalid},
+	{"bytes=1-+2", nil, ErrInvalid},
+	{"bytes=--1", nil, ErrInvalid},
+	{"bytes=0x10-", nil, ErrInvalid},
+	{"bytes=1-2-3", nil, ErrInvalid},
+	{"bytes=0-1;q=1", nil, ErrInvalid},
+	{"bytes=0-1,x", nil, ErrInvalid},
+}
+
+func TestParseRFC9110(t *testing.T) {
+	for _, tt := range rfc9110 {
+		got, err := Parse(tt.s, 10000, Options{})
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, %v, want %v, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+	if got, err := Parse("", 10000, Options{}); got != nil || err != nil {
+		t.Errorf(`Parse("") = %v, %v, want no ranges`, got, err)
+	}
+	// nothing of an empty representation is satisfiable
+	for _, s := range []string{"bytes=0-", "bytes=-1", "bytes=0-0"} {
+		if _, err := Parse(s, 0, Options{}); err != ErrNoOverlap {
+			t.Errorf("Parse(%q) of 0 bytes: %v, want ErrNoOverlap", s, err)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		size int64
+		opts Options
+		want []Range
+		err  error
+	}{
+		// capping
+		{"bytes=0-", 10000, Options{MaxLength: 1000}, []Range{{0, 1000}}, nil},
+		{"bytes=9500-", 10000, Options{MaxLength: 1000}, []Range{{9500, 500}}, nil},
+		{"bytes=0-4999", 10000, Options{MaxLength: 1000}, []Range{{0, 5000}}, nil},
+		{"bytes=-5000", 10000, Options{MaxLength: 1000}, []Range{{5000, 5000}}, nil},
+		// suffix handling
+		{"bytes=-5000", 10000, Options{MaxLength: 1000, Suffix: SuffixCapped}, []Range{{9000, 1000}}, nil},
+		{"bytes=-500", 10000, Options{MaxLength: 1000, Suffix: SuffixCapped}, []Range{{9500, 500}}, nil},
+		{"bytes=-500", 10000, Options{Suffix: SuffixReject}, nil, ErrInvalid},
+		// unknown size
+		{"bytes=100-199", UnknownSize, Options{}, []Range{{100, 100}}, nil},
+		{"bytes=0-" + maxInt, UnknownSize, Options{}, []Range{{0, math.MaxInt64}}, nil},
+		{"bytes=100-", UnknownSize, Options{MaxLength: 1000}, []Range{{100, 1000}}, nil},
+		{"bytes=100-", UnknownSize, Options{}, nil, ErrUnknownSize},
+		{"bytes=-100", UnknownSize, Options{MaxLength: 1000}, nil, ErrUnknownSize},
+		// a made up size
+		{"bytes=20000-", 10000, Options{MaxLength: 1000, KeepBeyondEnd: true}, []Range{{20000, 1000}}, nil},
+		{"bytes=20000-20099", 10000, Options{KeepBeyondEnd: true}, []Range{{20000, 100}}, nil},
+		{"bytes=9000-20099", 10000, Options{KeepBeyondEnd: true}, []Range{{9000, 1000}}, nil},
+		{"bytes=20000-", 10000, Options{KeepBeyondEnd: true}, nil, ErrNoOverlap},
+	} {
+		got, err := Parse(tt.s, tt.size, tt.opts)
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q, %d, %+v) = %v, %v, want %v, %v", tt.s, tt.size, tt.opts, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+const maxInt = "9223372036854775807"
+
+func TestContentRange(t *testing.T) {
+	r := Range{Start: 100, Length: 50}
+	for _, tt := range []struct{ got, want string }{
+		{r.ContentRange(1000), "bytes 100-149/1000"},
+		{r.ContentRange(UnknownSize), "bytes 100-149/*"},
+		{Unsatisfied(1000), "bytes */1000"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want Range
+		size int64
+		err  error
+	}{
+		{"bytes 0-499/1234", Range{0, 500}, 1234, nil},
+		{"bytes 500-1233/1234", Range{500, 734}, 1234, nil},
+		{"bytes 42-42/*", Range{42, 1}, UnknownSize, nil},
+		{"Bytes 0-0/1", Range{0, 1}, 1, nil},
+		{"bytes */1234", Range{}, 0, ErrInvalid},
+		{"bytes 0-1234/1234", Range{}, 0, ErrInvalid},
+		{"bytes 5-4/10", Range{}, 0, ErrInvalid},
+		{"bytes 0-4", Range{}, 0, ErrInvalid},
+		{"bytes=0-4/10", Range{}, 0, ErrInvalid},
+		{"bytes -1-4/10", Range{}, 0, ErrInvalid},
+		{"bytes 0-99999999999999999999999/*", Range{}, 0, ErrInvalid},
+	} {
+		got, size, err := ParseContentRange(tt.s)
+		if !errors.Is(err, tt.err) || got != tt.want || size != tt.size {
+			t.Errorf("ParseContentRange(%q) = %v, %d, %v, want %v, %d, %v", tt.s, got, size, err, tt.want, tt.size, tt.err)
+		}
+	}
+}